@@ -0,0 +1,351 @@
+// Package config holds the application settings. Load reads them from
+// defaults, an optional YAML file, a .env file and the environment, in
+// increasing order of precedence.
+//
+// The YAML file may carry a profiles map keyed by environment name (dev,
+// staging, prod). The section for the profile chosen by APP_ENV, or by the
+// file's own profile key, is applied over the rest of the file.
+//
+// Each field names its environment variable in the env tag. A default tag
+// gives its value when no source sets it, required marks fields that must
+// end up non-empty and secret marks fields Redacted hides.
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Profiles the configuration can be loaded for.
+var Profiles = []string{"dev", "staging", "prod"}
+
+type Config struct {
+	Profile      string       `yaml:"profile" env:"APP_ENV" default:"dev"`
+	Server       Server       `yaml:"server"`
+	Log          Log          `yaml:"log"`
+	Metrics      Metrics      `yaml:"metrics"`
+	Tracing      Tracing      `yaml:"tracing"`
+	Database     Database     `yaml:"database"`
+	Auth         Auth         `yaml:"auth"`
+	Mail         Mail         `yaml:"mail"`
+	SMS          SMS          `yaml:"sms"`
+	OAuth        OAuth        `yaml:"oauth"`
+	Verification Verification `yaml:"verification"`
+	Cleanup      Cleanup      `yaml:"cleanup"`
+}
+
+type Server struct {
+	Addr string `yaml:"addr" env:"LISTEN_ADDR" default:":3000"`
+	// ShutdownTimeout bounds how long a stopping server waits for in-flight
+	// requests and background work. Keep it under the grace period docker
+	// stop allows (10s by default).
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" default:"8s"`
+
+	CORSOrigins          []string `yaml:"cors_origins" env:"CORS_ORIGINS" default:"http://localhost,http://localhost:80,http://localhost:3000,http://localhost:8000"`
+	CORSMethods          []string `yaml:"cors_methods" env:"CORS_METHODS" default:"GET,POST,PUT,PATCH,DELETE,OPTIONS"`
+	CORSHeaders          []string `yaml:"cors_headers" env:"CORS_HEADERS" default:"Origin,Content-Type,Accept,Authorization"`
+	CORSAllowCredentials bool     `yaml:"cors_allow_credentials" env:"CORS_ALLOW_CREDENTIALS" default:"true"`
+
+	// TLS is served from TLSCertFile and TLSKeyFile when both are set, or
+	// with certificates obtained from Let's Encrypt for TLSAutocertHosts
+	// and cached in TLSAutocertDir. Plain HTTP is served otherwise.
+	TLSCertFile      string   `yaml:"tls_cert_file" env:"TLS_CERT_FILE"`
+	TLSKeyFile       string   `yaml:"tls_key_file" env:"TLS_KEY_FILE"`
+	TLSAutocertDir   string   `yaml:"tls_autocert_dir" env:"TLS_AUTOCERT_DIR"`
+	TLSAutocertHosts []string `yaml:"tls_autocert_hosts" env:"TLS_AUTOCERT_HOSTS"`
+
+	// TrustedProxies lists the addresses and CIDR ranges of the CDN or
+	// reverse proxies in front of the server. Only requests from them have
+	// their client IP taken from ProxyHeader. While it is empty the client
+	// IP is unknown behind a proxy, so failed attempts aren't counted per
+	// IP.
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	ProxyHeader    string   `yaml:"proxy_header" env:"PROXY_HEADER" default:"CF-Connecting-IP"`
+
+	// PublicAPIURL is the base of links in emails. It must be configured:
+	// the request's Host header is chosen by the client and can't be
+	// trusted to point back at this API. prod warns at startup unless it
+	// is https
+	PublicAPIURL string `yaml:"public_api_url" env:"PUBLIC_API_URL" required:"true"`
+	// MagicLinkURL is the frontend page login emails link to. It posts the
+	// link's token and the nonce its browser got from /api/loginviaemail to
+	// /api/login/magic. Login emails carry only a code while it is empty
+	MagicLinkURL string `yaml:"magic_link_url" env:"MAGIC_LINK_URL"`
+	// GeoCountryHeader and GeoCityHeader name the headers a CDN or proxy
+	// sets with the client's location. They are only read on requests from
+	// TrustedProxies
+	GeoCountryHeader string `yaml:"geo_country_header" env:"GEO_COUNTRY_HEADER" default:"CF-IPCountry"`
+	GeoCityHeader    string `yaml:"geo_city_header" env:"GEO_CITY_HEADER" default:"CF-IPCity"`
+}
+
+type Log struct {
+	// Level is debug, info, warn or error
+	Level string `yaml:"level" env:"LOG_LEVEL" default:"info"`
+	// Format is json or text
+	Format string `yaml:"format" env:"LOG_FORMAT" default:"json"`
+	// Redact masks emails and phone numbers and hides codes and tokens in
+	// log lines. Turn it off only locally, e.g. to read codes from the log
+	// SMS provider.
+	Redact bool `yaml:"redact" env:"LOG_REDACT" default:"true"`
+}
+
+// Metrics configures the Prometheus endpoint. With Addr set, /metrics is
+// served on that separate address only, which should not be reachable from
+// the internet (e.g. "127.0.0.1:9090"). Otherwise it is served on the main
+// address and needs "Authorization: Bearer <Token>". With neither set it is
+// not served.
+type Metrics struct {
+	Addr  string `yaml:"addr" env:"METRICS_ADDR"`
+	Token string `yaml:"token" env:"METRICS_TOKEN" secret:"true"`
+}
+
+// Tracing configures OpenTelemetry traces. Exporter is "otlp" to send them
+// over OTLP/HTTP to Endpoint (e.g. "http://otel-collector:4318"; the
+// collector's default is used when it is empty), "stdout" to print them
+// locally or "none" to turn tracing off.
+type Tracing struct {
+	Exporter    string `yaml:"exporter" env:"OTEL_TRACES_EXPORTER" default:"none"`
+	Endpoint    string `yaml:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	ServiceName string `yaml:"service_name" env:"OTEL_SERVICE_NAME" default:"speak-backend"`
+	// SamplePercent is the share of new traces recorded; requests that
+	// arrive with a sampled parent are always recorded
+	SamplePercent int `yaml:"sample_percent" env:"OTEL_SAMPLE_PERCENT" default:"100"`
+}
+
+type Database struct {
+	Host     string `yaml:"host" env:"DB_HOST" required:"true"`
+	Port     string `yaml:"port" env:"DB_PORT" default:"5432"`
+	User     string `yaml:"user" env:"DB_USER" required:"true"`
+	Password string `yaml:"password" env:"DB_PASSWORD" required:"true" secret:"true"`
+	Name     string `yaml:"name" env:"DB_NAME" required:"true"`
+
+	// SSLMode is passed to lib/pq: disable, require, verify-ca or
+	// verify-full. SSLRootCert is the CA bundle for the verify modes.
+	SSLMode     string `yaml:"sslmode" env:"DB_SSLMODE" default:"disable"`
+	SSLRootCert string `yaml:"sslrootcert" env:"DB_SSLROOTCERT"`
+	// Options holds extra space-separated key=value connection parameters,
+	// such as "application_name=speak connect_timeout=5"
+	Options string `yaml:"options" env:"DB_OPTIONS"`
+
+	MaxOpenConns    int           `yaml:"max_open_conns" env:"DB_MAX_OPEN_CONNS" default:"20"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" env:"DB_MAX_IDLE_CONNS" default:"10"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME" default:"30m"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time" env:"DB_CONN_MAX_IDLE_TIME" default:"5m"`
+
+	// ConnectAttempts and ConnectBackoff control retrying at startup; the
+	// wait doubles after each failed attempt
+	ConnectAttempts int           `yaml:"connect_attempts" env:"DB_CONNECT_ATTEMPTS" default:"10"`
+	ConnectBackoff  time.Duration `yaml:"connect_backoff" env:"DB_CONNECT_BACKOFF" default:"1s"`
+	// QueryTimeout is the deadline for the database work of one request or
+	// one background task
+	QueryTimeout time.Duration `yaml:"query_timeout" env:"DB_QUERY_TIMEOUT" default:"10s"`
+}
+
+type Auth struct {
+	JWTSecret string `yaml:"jwt_secret" env:"JWT_SECRET" required:"true" secret:"true"`
+	// VerificationCodeSecret keys the hashes of stored codes; JWTSecret is
+	// used when it is empty
+	VerificationCodeSecret string `yaml:"verification_code_secret" env:"VERIFICATION_CODE_SECRET" secret:"true"`
+	// TOTPEncryptionKey encrypts authenticator secrets at rest; JWTSecret is
+	// used when it is empty
+	TOTPEncryptionKey string `yaml:"totp_encryption_key" env:"TOTP_ENCRYPTION_KEY" secret:"true"`
+}
+
+// Mail configures the SSH host that hands messages to its local SMTP
+// server.
+type Mail struct {
+	SSHHost     string `yaml:"ssh_host" env:"SSH_HOST"`
+	SSHPort     string `yaml:"ssh_port" env:"SSH_PORT" default:"22"`
+	SSHUser     string `yaml:"ssh_user" env:"SSH_USER"`
+	SSHPassword string `yaml:"ssh_password" env:"SSH_PASSWORD" secret:"true"`
+}
+
+type SMS struct {
+	// Provider is "eskiz" for the Eskiz HTTP API, "log" to print messages
+	// instead of sending them, which prod refuses, or "disabled" to turn
+	// phone sign-in off
+	Provider      string `yaml:"provider" env:"SMS_PROVIDER" default:"log"`
+	EskizBaseURL  string `yaml:"eskiz_base_url" env:"ESKIZ_BASE_URL"`
+	EskizEmail    string `yaml:"eskiz_email" env:"ESKIZ_EMAIL"`
+	EskizPassword string `yaml:"eskiz_password" env:"ESKIZ_PASSWORD" secret:"true"`
+	EskizFrom     string `yaml:"eskiz_from" env:"ESKIZ_FROM"`
+}
+
+// OAuth configures third-party sign-in. A provider is disabled while its
+// credentials are empty.
+type OAuth struct {
+	GoogleClientID   string `yaml:"google_client_id" env:"GOOGLE_CLIENT_ID"`
+	GoogleJWKSURL    string `yaml:"google_jwks_url" env:"GOOGLE_JWKS_URL" default:"https://www.googleapis.com/oauth2/v3/certs"`
+	TelegramBotToken string `yaml:"telegram_bot_token" env:"TELEGRAM_BOT_TOKEN" secret:"true"`
+}
+
+type Verification struct {
+	CodeLength int           `yaml:"code_length" env:"VERIFICATION_CODE_LENGTH" default:"6"`
+	CodeTTL    time.Duration `yaml:"code_ttl" env:"VERIFICATION_CODE_TTL" default:"10m"`
+	// ResendCooldown and ResendDailyCap throttle how often an email or phone
+	// number is sent a code
+	ResendCooldown time.Duration `yaml:"resend_cooldown" env:"RESEND_COOLDOWN" default:"1m"`
+	ResendDailyCap int           `yaml:"resend_daily_cap" env:"RESEND_DAILY_CAP" default:"5"`
+}
+
+type Cleanup struct {
+	// PendingRegistrationTTL is how long an unverified signup is kept
+	PendingRegistrationTTL time.Duration `yaml:"pending_registration_ttl" env:"PENDING_REGISTRATION_TTL" default:"24h"`
+}
+
+// Validate reports every missing required field and out-of-range value at
+// once, so a misconfigured deploy fails at startup rather than on first use.
+func (c *Config) Validate() error {
+	var problems []string
+
+	if !slices.Contains(Profiles, c.Profile) {
+		problems = append(problems, fmt.Sprintf("APP_ENV %q is not one of %s", c.Profile, strings.Join(Profiles, ", ")))
+	}
+
+	for _, f := range fields(c) {
+		if f.required && f.isZero() {
+			problems = append(problems, fmt.Sprintf("%s is required", f.env))
+		}
+	}
+
+	if c.Verification.CodeLength < 4 || c.Verification.CodeLength > 10 {
+		problems = append(problems, "VERIFICATION_CODE_LENGTH must be between 4 and 10")
+	}
+	if c.Verification.CodeTTL <= 0 {
+		problems = append(problems, "VERIFICATION_CODE_TTL must be positive")
+	}
+	if c.Verification.ResendCooldown < 0 {
+		problems = append(problems, "RESEND_COOLDOWN must not be negative")
+	}
+	if c.Verification.ResendDailyCap <= 0 {
+		problems = append(problems, "RESEND_DAILY_CAP must be positive")
+	}
+	if c.Cleanup.PendingRegistrationTTL <= 0 {
+		problems = append(problems, "PENDING_REGISTRATION_TTL must be positive")
+	}
+
+	if c.Server.ShutdownTimeout <= 0 {
+		problems = append(problems, "SHUTDOWN_TIMEOUT must be positive")
+	}
+	if c.Server.CORSAllowCredentials && slices.Contains(c.Server.CORSOrigins, "*") {
+		problems = append(problems, "CORS_ORIGINS can't be * while CORS_ALLOW_CREDENTIALS is true")
+	}
+	if c.Server.PublicAPIURL != "" {
+		if u, err := url.Parse(c.Server.PublicAPIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("PUBLIC_API_URL %q is not an absolute http(s) URL", c.Server.PublicAPIURL))
+		}
+	}
+	if c.Server.MagicLinkURL != "" {
+		if u, err := url.Parse(c.Server.MagicLinkURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			problems = append(problems, fmt.Sprintf("MAGIC_LINK_URL %q is not an absolute http(s) URL without a query", c.Server.MagicLinkURL))
+		}
+	}
+	for _, proxy := range c.Server.TrustedProxies {
+		if _, err := netip.ParsePrefix(proxy); err != nil {
+			if _, err := netip.ParseAddr(proxy); err != nil {
+				problems = append(problems, fmt.Sprintf("TRUSTED_PROXIES entry %q is not an IP address or CIDR range", proxy))
+			}
+		}
+	}
+	if len(c.Server.TrustedProxies) > 0 && c.Server.ProxyHeader == "" {
+		problems = append(problems, "PROXY_HEADER is required with TRUSTED_PROXIES")
+	}
+	if (c.Server.TLSCertFile == "") != (c.Server.TLSKeyFile == "") {
+		problems = append(problems, "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.Server.TLSAutocertDir != "" {
+		if c.Server.TLSCertFile != "" {
+			problems = append(problems, "TLS_AUTOCERT_DIR can't be combined with TLS_CERT_FILE")
+		}
+		if len(c.Server.TLSAutocertHosts) == 0 {
+			problems = append(problems, "TLS_AUTOCERT_HOSTS is required with TLS_AUTOCERT_DIR")
+		}
+	}
+
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("LOG_LEVEL %q is not one of debug, info, warn, error", c.Log.Level))
+	}
+	switch strings.ToLower(c.Log.Format) {
+	case "json", "text":
+	default:
+		problems = append(problems, fmt.Sprintf("LOG_FORMAT %q is not one of json, text", c.Log.Format))
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		problems = append(problems, fmt.Sprintf("OTEL_TRACES_EXPORTER %q is not one of none, stdout, otlp", c.Tracing.Exporter))
+	}
+	if c.Tracing.SamplePercent < 0 || c.Tracing.SamplePercent > 100 {
+		problems = append(problems, "OTEL_SAMPLE_PERCENT must be between 0 and 100")
+	}
+
+	switch c.Database.SSLMode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		problems = append(problems, fmt.Sprintf("DB_SSLMODE %q is not a valid sslmode", c.Database.SSLMode))
+	}
+	if c.Database.MaxOpenConns <= 0 {
+		problems = append(problems, "DB_MAX_OPEN_CONNS must be positive")
+	}
+	if c.Database.MaxIdleConns < 0 || c.Database.MaxIdleConns > c.Database.MaxOpenConns {
+		problems = append(problems, "DB_MAX_IDLE_CONNS must be between 0 and DB_MAX_OPEN_CONNS")
+	}
+	if c.Database.ConnMaxLifetime < 0 || c.Database.ConnMaxIdleTime < 0 {
+		problems = append(problems, "DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME must not be negative")
+	}
+	if c.Database.ConnectAttempts <= 0 {
+		problems = append(problems, "DB_CONNECT_ATTEMPTS must be positive")
+	}
+	if c.Database.ConnectBackoff <= 0 {
+		problems = append(problems, "DB_CONNECT_BACKOFF must be positive")
+	}
+	if c.Database.QueryTimeout <= 0 {
+		problems = append(problems, "DB_QUERY_TIMEOUT must be positive")
+	}
+
+	switch c.SMS.Provider {
+	case "log":
+		if c.Profile == "prod" {
+			problems = append(problems, "SMS_PROVIDER can't be log when APP_ENV is prod")
+		}
+	case "disabled":
+	case "eskiz":
+		if c.SMS.EskizEmail == "" || c.SMS.EskizPassword == "" {
+			problems = append(problems, "ESKIZ_EMAIL and ESKIZ_PASSWORD are required when SMS_PROVIDER is eskiz")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("SMS_PROVIDER %q is not one of log, eskiz, disabled", c.SMS.Provider))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Warnings lists settings that are valid but unsafe for the profile, to be
+// logged at startup. They don't stop the server, so a deploy can move to
+// the safer setting on its own schedule.
+func (c *Config) Warnings() []string {
+	if c.Profile != "prod" {
+		return nil
+	}
+
+	var warnings []string
+	for _, link := range []struct{ env, value string }{
+		{"PUBLIC_API_URL", c.Server.PublicAPIURL},
+		{"MAGIC_LINK_URL", c.Server.MagicLinkURL},
+	} {
+		if strings.HasPrefix(link.value, "http://") {
+			warnings = append(warnings, link.env+" is not https, so links in emails carry login tokens in cleartext")
+		}
+	}
+	return warnings
+}
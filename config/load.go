@@ -0,0 +1,158 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Load builds the configuration from the field defaults, the YAML file at
+// path (skipped when path is empty) followed by the section of its profiles
+// map for the active profile, the .env file in the working directory if
+// there is one, and finally the environment. It does not validate the
+// result; call Validate for that.
+func Load(path string) (*Config, error) {
+	cfg := &Config{}
+	for _, f := range fields(cfg) {
+		if f.def == "" {
+			continue
+		}
+		if err := f.set(f.def); err != nil {
+			return nil, fmt.Errorf("default for %s: %w", f.env, err)
+		}
+	}
+
+	// godotenv leaves variables that are already set alone, so the real
+	// environment wins over .env. It is loaded first so APP_ENV can come
+	// from it when picking the profile below.
+	if err := godotenv.Load(".env"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load .env: %w", err)
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+
+		if profile := os.Getenv("APP_ENV"); profile != "" {
+			cfg.Profile = profile
+		}
+
+		var file struct {
+			Profiles map[string]yaml.Node `yaml:"profiles"`
+		}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+		if node, ok := file.Profiles[cfg.Profile]; ok {
+			if err := node.Decode(cfg); err != nil {
+				return nil, fmt.Errorf("failed to parse profile %s in %s: %w", cfg.Profile, path, err)
+			}
+		}
+	}
+
+	for _, f := range fields(cfg) {
+		value, ok := os.LookupEnv(f.env)
+		if !ok || value == "" {
+			continue
+		}
+		if err := f.set(value); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.env, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// field is a settable leaf of Config together with its struct tags.
+type field struct {
+	value    reflect.Value
+	env      string
+	def      string
+	required bool
+	secret   bool
+}
+
+// fields lists the leaves of cfg that have an env tag.
+func fields(cfg *Config) []field {
+	var out []field
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			fv := v.Field(i)
+			if sf.Type.Kind() == reflect.Struct && sf.Type != reflect.TypeOf(time.Duration(0)) {
+				walk(fv)
+				continue
+			}
+			env := sf.Tag.Get("env")
+			if env == "" {
+				continue
+			}
+			out = append(out, field{
+				value:    fv,
+				env:      env,
+				def:      sf.Tag.Get("default"),
+				required: sf.Tag.Get("required") == "true",
+				secret:   sf.Tag.Get("secret") == "true",
+			})
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem())
+	return out
+}
+
+func (f field) isZero() bool {
+	return f.value.IsZero() || (f.value.Kind() == reflect.Slice && f.value.Len() == 0)
+}
+
+// set parses s into the field according to its type. Lists are comma
+// separated.
+func (f field) set(s string) error {
+	switch f.value.Interface().(type) {
+	case string:
+		f.value.SetString(s)
+	case int:
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		f.value.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		f.value.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		f.value.SetInt(int64(d))
+	case []string:
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", f.value.Type())
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"io"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redactedValue = "******"
+
+// Redacted returns a copy of c with every secret that is set replaced by a
+// placeholder, for printing and logging.
+func (c *Config) Redacted() *Config {
+	out := *c
+	for _, f := range fields(&out) {
+		if f.secret && !f.isZero() {
+			f.value.Set(reflect.ValueOf(redactedValue))
+		}
+	}
+	return &out
+}
+
+// Print writes the redacted configuration to w as YAML, in the same shape
+// Load accepts.
+func (c *Config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.Redacted()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -1,38 +1,90 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"os"
+	"log/slog"
+	"strings"
+	"time"
 
+	"speak/config"
+
+	"github.com/XSAM/otelsql"
 	_ "github.com/lib/pq"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 var DB *sql.DB
 
-func Init() error {
-	host := os.Getenv("DB_HOST")
-	port := os.Getenv("DB_PORT")
-	user := os.Getenv("DB_USER")
-	password := os.Getenv("DB_PASSWORD")
-	dbname := os.Getenv("DB_NAME")
-
-	if host == "" || port == "" || user == "" || password == "" || dbname == "" {
-		return fmt.Errorf("missing database environment variables: DB_HOST=%s, DB_PORT=%s, DB_USER=%s, DB_PASSWORD=%s, DB_NAME=%s", host, port, user, password, dbname)
-	}
-
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
+// maxConnectBackoff caps the wait between connection attempts at startup.
+const maxConnectBackoff = 30 * time.Second
 
+// Init opens the connection pool and waits for Postgres to accept
+// connections, retrying with exponential backoff up to cfg.ConnectAttempts
+// times so the app survives the database starting after it. Every statement
+// is traced as a span under the caller's context.
+func Init(cfg config.Database) error {
 	var err error
-	DB, err = sql.Open("postgres", psqlInfo)
+	DB, err = otelsql.Open("postgres", dsn(cfg),
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+			DisableErrSkip:       true,
+		}),
+	)
 	if err != nil {
 		return err
 	}
 
-	if err = DB.Ping(); err != nil {
-		return err
+	DB.SetMaxOpenConns(cfg.MaxOpenConns)
+	DB.SetMaxIdleConns(cfg.MaxIdleConns)
+	DB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	DB.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+
+	backoff := cfg.ConnectBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.QueryTimeout)
+		err = DB.PingContext(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt >= cfg.ConnectAttempts {
+			DB.Close()
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+
+		slog.Warn("database not ready, retrying",
+			"attempt", attempt, "attempts", cfg.ConnectAttempts, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxConnectBackoff)
 	}
+}
+
+// dsn builds a lib/pq connection string. Values are quoted so passwords
+// with spaces or quotes survive; cfg.Options is appended verbatim.
+func dsn(cfg config.Database) string {
+	params := []string{
+		"host=" + quoteDSNValue(cfg.Host),
+		"port=" + quoteDSNValue(cfg.Port),
+		"user=" + quoteDSNValue(cfg.User),
+		"password=" + quoteDSNValue(cfg.Password),
+		"dbname=" + quoteDSNValue(cfg.Name),
+		"sslmode=" + quoteDSNValue(cfg.SSLMode),
+	}
+	if cfg.SSLRootCert != "" {
+		params = append(params, "sslrootcert="+quoteDSNValue(cfg.SSLRootCert))
+	}
+	if cfg.Options != "" {
+		params = append(params, cfg.Options)
+	}
+	return strings.Join(params, " ")
+}
 
-	return nil
+func quoteDSNValue(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `\'`)
+	return "'" + s + "'"
 }
@@ -0,0 +1,277 @@
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// migrations are applied in order and recorded in schema_migrations.
+// Append new entries at the end; never edit one that has shipped.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "users_profile_columns",
+		// The schema never recorded signup dates, so rows that exist when
+		// this runs keep a NULL created_at instead of the migration time;
+		// only users inserted afterwards get one.
+		SQL: `
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS locale TEXT NOT NULL DEFAULT 'uz';
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ;
+			ALTER TABLE users ALTER COLUMN created_at SET DEFAULT NOW();
+		`,
+	},
+	{
+		Version: 2,
+		Name:    "users_soft_delete",
+		SQL: `
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+			ALTER TABLE users ALTER COLUMN date_of_birth DROP NOT NULL;
+		`,
+	},
+	{
+		Version: 3,
+		Name:    "users_registration_status",
+		// Signups left unverified before this have no created_at; they are
+		// given the migration time so cleanup purges them one TTL later
+		// rather than never. Refreshing a pending signup resets created_at.
+		SQL: `
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active';
+			UPDATE users SET status = 'pending', created_at = COALESCE(created_at, NOW()) WHERE email IS NULL AND deleted_at IS NULL;
+			CREATE INDEX IF NOT EXISTS users_pending_created_at_idx ON users (created_at) WHERE status = 'pending';
+		`,
+	},
+	{
+		Version: 4,
+		Name:    "verification_attempts_and_lockouts",
+		SQL: `
+			ALTER TABLE verifications ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+			CREATE TABLE IF NOT EXISTS auth_lockouts (
+				key          TEXT PRIMARY KEY,
+				failures     INTEGER NOT NULL DEFAULT 0,
+				locked_until TIMESTAMPTZ,
+				updated_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			);
+		`,
+	},
+	{
+		Version: 5,
+		Name:    "verifications_hashed_codes",
+		SQL: `
+			DELETE FROM verifications;
+			ALTER TABLE verifications ALTER COLUMN code TYPE TEXT;
+		`,
+	},
+	{
+		Version: 6,
+		Name:    "verification_sends",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS verification_sends (
+				destination TEXT NOT NULL,
+				sent_at     TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			);
+			CREATE INDEX IF NOT EXISTS verification_sends_destination_sent_at_idx ON verification_sends (destination, sent_at);
+		`,
+	},
+	{
+		Version: 7,
+		Name:    "verifications_magic_link_nonce",
+		SQL: `
+			ALTER TABLE verifications ADD COLUMN IF NOT EXISTS nonce TEXT;
+			CREATE INDEX IF NOT EXISTS verifications_code_idx ON verifications (code);
+		`,
+	},
+	{
+		Version: 8,
+		Name:    "phone_verification",
+		SQL: `
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS phone TEXT;
+			CREATE UNIQUE INDEX IF NOT EXISTS users_phone_key ON users (phone) WHERE phone IS NOT NULL;
+			ALTER TABLE verifications ADD COLUMN IF NOT EXISTS phone TEXT;
+			ALTER TABLE verifications ALTER COLUMN email DROP NOT NULL;
+		`,
+	},
+	{
+		Version: 9,
+		Name:    "user_identities",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS user_identities (
+				id          BIGSERIAL PRIMARY KEY,
+				user_id     BIGINT NOT NULL,
+				provider    TEXT NOT NULL,
+				subject     TEXT NOT NULL,
+				verified_at TIMESTAMPTZ,
+				created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				UNIQUE (provider, subject)
+			);
+			CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
+
+			INSERT INTO user_identities (user_id, provider, subject, verified_at)
+			SELECT user_id, 'email', LOWER(email), NOW() FROM users
+			WHERE email IS NOT NULL AND status = 'active' AND deleted_at IS NULL
+			ON CONFLICT DO NOTHING;
+			INSERT INTO user_identities (user_id, provider, subject, verified_at)
+			SELECT user_id, 'phone', phone, NOW() FROM users
+			WHERE phone IS NOT NULL AND status = 'active' AND deleted_at IS NULL
+			ON CONFLICT DO NOTHING;
+		`,
+	},
+	{
+		Version: 10,
+		Name:    "two_factor",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS user_totp (
+				user_id        BIGINT PRIMARY KEY,
+				secret         TEXT NOT NULL,
+				enabled_at     TIMESTAMPTZ,
+				last_used_step BIGINT NOT NULL DEFAULT 0,
+				created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			);
+			CREATE TABLE IF NOT EXISTS user_recovery_codes (
+				id         BIGSERIAL PRIMARY KEY,
+				user_id    BIGINT NOT NULL,
+				code_hash  TEXT NOT NULL,
+				used_at    TIMESTAMPTZ,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			);
+			CREATE INDEX IF NOT EXISTS user_recovery_codes_user_id_idx ON user_recovery_codes (user_id);
+		`,
+	},
+	{
+		Version: 11,
+		Name:    "user_sessions",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS user_sessions (
+				id           TEXT PRIMARY KEY,
+				user_id      BIGINT NOT NULL,
+				user_agent   TEXT NOT NULL DEFAULT '',
+				ip           TEXT NOT NULL DEFAULT '',
+				location     TEXT NOT NULL DEFAULT '',
+				created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				expires_at   TIMESTAMPTZ NOT NULL,
+				revoked_at   TIMESTAMPTZ
+			);
+			CREATE INDEX IF NOT EXISTS user_sessions_user_id_idx ON user_sessions (user_id);
+		`,
+	},
+	{
+		Version: 12,
+		Name:    "session_revoke_links",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS session_revoke_links (
+				id         TEXT PRIMARY KEY,
+				user_id    BIGINT NOT NULL,
+				expires_at TIMESTAMPTZ NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS session_revoke_links_user_id_idx ON session_revoke_links (user_id);
+		`,
+	},
+	{
+		Version: 13,
+		Name:    "lowercase_emails",
+		// Emails are stored lowercased from now on. Of accounts whose
+		// addresses differ only in case, the one already signing in with the
+		// address keeps it, then an active one before a pending one, then
+		// the oldest. The other pending signups are dropped, as a new signup
+		// for the address would drop them; other active accounts lose the
+		// address and keep their remaining sign-in methods.
+		SQL: `
+			CREATE TEMP TABLE email_case_duplicates ON COMMIT DROP AS
+			SELECT user_id, status FROM (
+				SELECT u.user_id, u.status, ROW_NUMBER() OVER (
+					PARTITION BY LOWER(u.email)
+					ORDER BY EXISTS (
+						SELECT 1 FROM user_identities i
+						WHERE i.user_id = u.user_id AND i.provider = 'email' AND LOWER(i.subject) = LOWER(u.email)
+					) DESC, u.status = 'active' DESC, u.user_id
+				) AS rank
+				FROM users u
+				WHERE u.email IS NOT NULL
+			) ranked
+			WHERE rank > 1;
+
+			DELETE FROM verifications WHERE user_id IN (SELECT user_id FROM email_case_duplicates WHERE status = 'pending');
+			DELETE FROM users WHERE user_id IN (SELECT user_id FROM email_case_duplicates WHERE status = 'pending');
+			DELETE FROM user_identities i
+			USING email_case_duplicates d, users u
+			WHERE i.user_id = d.user_id AND u.user_id = d.user_id
+				AND i.provider = 'email' AND LOWER(i.subject) = LOWER(u.email);
+			UPDATE users SET email = NULL WHERE user_id IN (SELECT user_id FROM email_case_duplicates);
+			UPDATE users SET email = LOWER(email) WHERE email <> LOWER(email);
+
+			-- Identities have been lowercased since they were introduced;
+			-- should two still differ only in case, the older one is kept
+			DELETE FROM user_identities i
+			USING user_identities j
+			WHERE i.provider = 'email' AND j.provider = 'email'
+				AND LOWER(i.subject) = LOWER(j.subject) AND i.id > j.id;
+			UPDATE user_identities SET subject = LOWER(subject) WHERE provider = 'email' AND subject <> LOWER(subject);
+
+			-- Concurrent signups for one address can't both insert a row
+			CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_key ON users (LOWER(email));
+		`,
+	},
+}
+
+func Migrate() error {
+	if _, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		var applied bool
+		if err := DB.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)",
+			m.Version,
+		).Scan(&applied); err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+
+		tx, err := DB.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(m.SQL); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec(
+			"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)",
+			m.Version, m.Name,
+		); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MigrationStatus reports the newest schema version recorded in the
+// database and the newest one this build knows, which differ while
+// migrations are pending or after a rollback to an older build.
+func MigrationStatus(ctx context.Context) (applied, latest int, err error) {
+	latest = migrations[len(migrations)-1].Version
+	err = DB.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&applied)
+	return applied, latest, err
+}
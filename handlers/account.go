@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"speak/sms"
+	"speak/store"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Ways of confirming an account deletion, see deletionMethod.
+const (
+	deletionMethodEmail          = "email"
+	deletionMethodSMS            = "sms"
+	deletionMethodReauthenticate = "reauthenticate"
+)
+
+// deletionReauthWindow is how recently an account without email or phone
+// must have signed in to be deleted.
+const deletionReauthWindow = 10 * time.Minute
+
+type deleteAccountRequest struct {
+	Code string `json:"code"`
+}
+
+type accountExport struct {
+	ExportedAt           time.Time                     `json:"exported_at"`
+	User                 accountExportUser             `json:"user"`
+	Balance              float64                       `json:"balance"`
+	Identities           []identityResponse            `json:"identities"`
+	Sessions             []sessionResponse             `json:"sessions"`
+	PromocodeActivations []promocodeActivationResponse `json:"promocode_activations"`
+}
+
+type accountExportUser struct {
+	UserID      int64  `json:"userid"`
+	Email       string `json:"email,omitempty"`
+	Phone       string `json:"phone,omitempty"`
+	FirstName   string `json:"firstname"`
+	LastName    string `json:"lastname"`
+	DateOfBirth string `json:"dateofbirth,omitempty"`
+	Locale      string `json:"locale"`
+	// CreatedAt is null for accounts made before signup dates were
+	// recorded
+	CreatedAt *time.Time `json:"created_at"`
+}
+
+func (h *Handlers) ExportAccount(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
+	if err != nil {
+		return unauthorizedError(err)
+	}
+
+	profile, err := h.fetchProfile(ctx, claims.UserID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return apiError(codeUserNotFound)
+		}
+		return internalError("failed to fetch profile", err)
+	}
+
+	identities, err := h.fetchIdentities(ctx, claims.UserID)
+	if err != nil {
+		return internalError("failed to fetch identities", err)
+	}
+
+	sessions, err := h.fetchSessions(ctx, claims.UserID, claims.ID)
+	if err != nil {
+		return internalError("failed to fetch sessions", err)
+	}
+
+	activations, err := h.Promocodes.ListPromocodeActivations(ctx, claims.UserID)
+	if err != nil {
+		return internalError("failed to fetch promocode activations", err)
+	}
+
+	export := accountExport{
+		ExportedAt: time.Now().UTC(),
+		User: accountExportUser{
+			UserID:      profile.UserID,
+			Email:       profile.Email,
+			Phone:       profile.Phone,
+			FirstName:   profile.FirstName,
+			LastName:    profile.LastName,
+			DateOfBirth: profile.DateOfBirth,
+			Locale:      profile.Locale,
+			CreatedAt:   profile.CreatedAt,
+		},
+		Balance:              profile.Balance,
+		Identities:           identities,
+		Sessions:             sessions,
+		PromocodeActivations: newPromocodeActivationResponses(activations),
+	}
+
+	c.Attachment(fmt.Sprintf("speakallright-export-%d.json", claims.UserID))
+	return c.JSON(export)
+}
+
+// RequestAccountDeletion starts deleting the account. The user confirms with
+// a code mailed to their email or, failing that, texted to their phone.
+// Accounts with neither confirm by signing in again; the response's method
+// tells the client which applies.
+func (h *Handlers) RequestAccountDeletion(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
+	if err != nil {
+		return unauthorizedError(err)
+	}
+
+	user, err := h.Users.GetUser(ctx, claims.UserID)
+	if errors.Is(err, store.ErrNotFound) {
+		return apiError(codeUserNotFound)
+	}
+	if err != nil {
+		return internalError("failed to fetch user", err)
+	}
+
+	method := deletionMethod(user)
+	if method == deletionMethodReauthenticate {
+		return c.JSON(fiber.Map{
+			"message":       "Sign in again to confirm deletion",
+			"method":        method,
+			"reauth_window": int(deletionReauthWindow.Seconds()),
+		})
+	}
+
+	destination, verificationType := user.Email, verificationTypeDeletion
+	if method == deletionMethodSMS {
+		if !sms.Enabled() {
+			return apiError(codeProviderUnavailable)
+		}
+		destination, verificationType = user.Phone, verificationTypeDeletionSMS
+	}
+
+	if err := h.checkResendLimits(c, destination); err != nil {
+		return err
+	}
+
+	code, err := h.createVerification(ctx, claims.UserID, destination, verificationType)
+	if err != nil {
+		return internalError("failed to create verification", err)
+	}
+
+	if method == deletionMethodSMS {
+		if err := sendSMSCode(ctx, destination, code); err != nil {
+			slog.ErrorContext(ctx, "failed to send SMS", "error", err)
+		}
+		return c.JSON(fiber.Map{"message": "Verification code sent to phone", "method": method})
+	}
+
+	if err := sendAccountDeletionEmail(ctx, destination, code); err != nil {
+		slog.ErrorContext(ctx, "failed to send email", "error", err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Verification code sent to email", "method": method})
+}
+
+// DeleteAccount anonymizes the account once the deletion is confirmed, see
+// store.UserStore.DeleteUser.
+func (h *Handlers) DeleteAccount(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
+	if err != nil {
+		return unauthorizedError(err)
+	}
+
+	user, err := h.Users.GetUser(ctx, claims.UserID)
+	if errors.Is(err, store.ErrNotFound) {
+		return apiError(codeUserNotFound)
+	}
+	if err != nil {
+		return internalError("failed to fetch user", err)
+	}
+
+	if method := deletionMethod(user); method == deletionMethodReauthenticate {
+		if claims.IssuedAt == nil || time.Since(claims.IssuedAt.Time) > deletionReauthWindow {
+			return apiError(codeReauthenticationRequired)
+		}
+	} else if err := h.checkDeletionCode(c, claims.UserID, method); err != nil {
+		return err
+	}
+
+	if err := h.Users.DeleteUser(ctx, claims.UserID); err != nil {
+		return internalError("failed to delete account", err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Account deleted"})
+}
+
+// checkDeletionCode matches the code in the request body against the
+// deletion code sent to the user by method.
+func (h *Handlers) checkDeletionCode(c *fiber.Ctx, userID int64, method string) error {
+	ctx := c.UserContext()
+
+	var req deleteAccountRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest).wrap(err)
+	}
+
+	code := strings.TrimSpace(req.Code)
+	if code == "" {
+		return fieldRequired("code")
+	}
+
+	lockKeys := withClientIP(c, lockoutKeyUser(userID))
+	attempt, retryAfter, err := h.takeAttempt(ctx, lockKeys...)
+	if err != nil {
+		return internalError("failed to check lockout", err)
+	}
+	if retryAfter > 0 {
+		return tooManyAttempts(c, retryAfter)
+	}
+
+	verificationType := verificationTypeDeletion
+	if method == deletionMethodSMS {
+		verificationType = verificationTypeDeletionSMS
+	}
+
+	if _, err := h.matchVerificationByUser(ctx, userID, verificationType, code); err != nil {
+		if errors.Is(err, errInvalidCode) {
+			return apiError(codeCodeInvalid)
+		}
+		return internalError("failed to fetch verification", err)
+	}
+	if err := attempt.release(ctx); err != nil {
+		slog.ErrorContext(ctx, "failed to clear lockout", "error", err)
+	}
+	return nil
+}
+
+// deletionMethod is how user confirms deleting their account: a code to
+// their email, else to their phone, else signing in again with the
+// external provider they use, such as Telegram.
+func deletionMethod(user *store.User) string {
+	switch {
+	case user.Email != "":
+		return deletionMethodEmail
+	case user.Phone != "":
+		return deletionMethodSMS
+	default:
+		return deletionMethodReauthenticate
+	}
+}
+
+func sendAccountDeletionEmail(ctx context.Context, to, code string) error {
+	htmlContent := renderCodeEmail(
+		"Confirm Account Deletion",
+		"Please use the verification code below to permanently delete your SpeakAllRight account:",
+		code,
+		"",
+	)
+	textContent := fmt.Sprintf("SpeakAllRight - Confirm Account Deletion\n\nYour account deletion code is: %s\n\nThis code will expire in %s.\n\nNeed help? Contact support@speakallright.uz", code, verificationCodeTTLText())
+
+	return sendEmail(ctx, to, "Confirm deletion of your SpeakAllRight account", htmlContent, textContent)
+}
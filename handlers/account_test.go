@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"speak/store"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestDeleteAccount(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	phone := "+998901234582"
+	token := s.signUp(t, phone)
+
+	// A wrong guess leaves a lockout counter keyed by the phone number
+	status, reply := s.do(t, "POST", "/api/loginviaphoneverify", "", fiber.Map{"phone": phone, "code": "000000"})
+	expectError(t, status, reply, codeCodeInvalid)
+
+	status, reply = s.do(t, "POST", "/api/me/delete", token, nil)
+	if status != fiber.StatusOK || reply["method"] != deletionMethodSMS {
+		t.Fatalf("requesting deletion: got %d %v", status, reply)
+	}
+
+	status, reply = s.do(t, "DELETE", "/api/me", token, fiber.Map{"code": s.sms.lastCode(t, phone)})
+	if status != fiber.StatusOK {
+		t.Fatalf("deleting: got %d %v", status, reply)
+	}
+
+	if _, err := s.store.FindUserByPhone(ctx, phone); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("user still found by phone: %v", err)
+	}
+	if _, err := s.store.FindUserByIdentity(ctx, store.ProviderPhone, phone); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("phone identity still linked: %v", err)
+	}
+	if sent, err := s.store.SendStats(ctx, phone, time.Time{}); err != nil || sent.Count != 0 {
+		t.Errorf("send history for the phone = %+v, %v; want none", sent, err)
+	}
+	if attempt, err := s.store.TakeAttempt(ctx, lockoutKeyPhone(phone), lockoutPolicy); err != nil || attempt.Attempts != 1 {
+		t.Errorf("lockout for the phone kept %d earlier failures, want none", attempt.Attempts-1)
+	}
+
+	// The account's sessions went with it
+	status, reply = s.do(t, "GET", "/api/me/sessions", token, nil)
+	expectError(t, status, reply, codeSessionRevoked)
+}
+
+func TestVerifyEmailChangeSpendsCode(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	token := s.signUp(t, "+998901234585")
+	claims, err := parseToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	s.store.PutVerification(store.Verification{
+		UserID:    claims.UserID,
+		Email:     "aziz@example.com",
+		Type:      verificationTypeEmailChange,
+		CodeHash:  hashVerificationCode("482913"),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(time.Minute),
+	})
+
+	// Of two requests racing with the same code only one changes the email
+	statuses := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			status, _ := s.do(t, "POST", "/api/me/email/verify", token, fiber.Map{"code": "482913"})
+			statuses <- status
+		}()
+	}
+	ok := 0
+	for i := 0; i < 2; i++ {
+		if <-statuses == fiber.StatusOK {
+			ok++
+		}
+	}
+	if ok != 1 {
+		t.Errorf("%d requests changed the email, want 1", ok)
+	}
+
+	user, err := s.store.GetUser(ctx, claims.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "aziz@example.com" {
+		t.Errorf("email = %q, want %q", user.Email, "aziz@example.com")
+	}
+	if _, err := s.store.FindVerification(ctx, store.VerificationQuery{Type: verificationTypeEmailChange, UserID: claims.UserID, IncludeExpired: true}); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("verification left after the change: %v", err)
+	}
+}
+
+func TestEmailChangeOverPendingSignup(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	token := s.signUp(t, "+998901234588")
+	claims, err := parseToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone signs up with the address and never verifies it
+	s.store.PutUser(store.User{ID: 900, Email: "aziz@example.com", Status: store.StatusPending}, false)
+
+	now := time.Now()
+	s.store.PutVerification(store.Verification{
+		UserID:    claims.UserID,
+		Email:     "aziz@example.com",
+		Type:      verificationTypeEmailChange,
+		CodeHash:  hashVerificationCode("482913"),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(time.Minute),
+	})
+
+	status, reply := s.do(t, "POST", "/api/me/email/verify", token, fiber.Map{"code": "482913"})
+	if status != fiber.StatusOK {
+		t.Fatalf("got %d %v", status, reply)
+	}
+	if user, err := s.store.FindUserByEmail(ctx, "aziz@example.com"); err != nil || user.ID != claims.UserID {
+		t.Errorf("address belongs to %v, %v; want user %d", user, err, claims.UserID)
+	}
+	if _, err := s.store.GetUser(ctx, 900); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("pending signup kept: %v", err)
+	}
+}
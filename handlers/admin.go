@@ -4,21 +4,21 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
-func VerifyAdmin(c *fiber.Ctx) error {
-	claims, err := getClaimsFromContext(c)
+func (h *Handlers) VerifyAdmin(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
 	if err != nil {
-		return unauthorizedResponse(c, err)
+		return unauthorizedError(err)
 	}
 
-	isAdmin, err := isUserAdmin(claims.UserID)
+	isAdmin, err := h.Users.IsAdmin(ctx, claims.UserID)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "Failed to verify admin status",
-			"details": err.Error(),
-		})
+		return internalError("failed to verify admin status", err)
 	}
 
 	return c.JSON(fiber.Map{
-		"is_admin": isAdmin,
+		"is_admin":   isAdmin,
+		"two_factor": claims.hasAMR(amrMFA),
 	})
 }
@@ -2,7 +2,7 @@ package handlers
 
 import "github.com/gofiber/fiber/v2"
 
-func Alive(c *fiber.Ctx) error {
+func (h *Handlers) Alive(c *fiber.Ctx) error {
 	return c.SendString("OK")
 }
 
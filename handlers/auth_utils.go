@@ -1,21 +1,36 @@
 package handlers
 
 import (
-	"database/sql"
+	"context"
 	"errors"
 	"fmt"
-	"os"
+	"log/slog"
 	"strings"
+	"time"
 
-	"speak/db"
+	"speak/store"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/lib/pq"
 )
 
 var (
-	errMissingToken = errors.New("authorization token is required")
+	errMissingToken   = errors.New("authorization token is required")
+	errAccountDeleted = errors.New("account has been deleted")
+	errWrongPurpose   = errors.New("token is not valid for this request")
+)
+
+// Authentication method references carried in Claims.AMR.
+const (
+	amrOTP = "otp"
+	amrMFA = "mfa"
+)
+
+// tokenPurposeMFA marks the short-lived token LoginTwoFactor exchanges for a
+// session once the second factor is checked.
+const (
+	tokenPurposeMFA = "mfa_challenge"
+	mfaChallengeTTL = 5 * time.Minute
 )
 
 func extractTokenFromRequest(c *fiber.Ctx) (string, error) {
@@ -38,17 +53,146 @@ func extractTokenFromRequest(c *fiber.Ctx) (string, error) {
 	return "", errMissingToken
 }
 
-func parseClaimsFromToken(tokenString string) (*Claims, error) {
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "default-secret-key-change-in-production"
+func jwtSecret() string {
+	return appConfig.Auth.JWTSecret
+}
+
+// issueToken records a session for the requesting device and signs a
+// 72-hour token for it, noting the authentication methods used in amr. The
+// owner is emailed when the device or IP is new to the account.
+func (h *Handlers) issueToken(c *fiber.Ctx, userID int64, amr ...string) (string, error) {
+	requestCtx := c.UserContext()
+	notice, err := h.newLoginNotice(c, userID)
+	if err != nil {
+		slog.ErrorContext(requestCtx, "failed to check login history", "error", err)
+	}
+
+	c.Locals(localsUserID, userID)
+
+	expiresAt := time.Now().Add(sessionTTL)
+	sessionID, err := h.createSession(c, userID, expiresAt)
+	if err != nil {
+		return "", err
+	}
+
+	if notice != nil {
+		goBackground(func() {
+			ctx, cancel := backgroundContext(requestCtx)
+			defer cancel()
+
+			if err := h.sendNewLoginEmail(ctx, notice); err != nil {
+				slog.ErrorContext(ctx, "failed to send new login email", "error", err)
+			}
+		})
+	}
+
+	claims := Claims{
+		UserID: userID,
+		AMR:    amr,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        sessionID,
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(jwtSecret()))
+}
+
+func issueChallengeToken(userID int64) (string, error) {
+	claims := Claims{
+		UserID:  userID,
+		Purpose: tokenPurposeMFA,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(mfaChallengeTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
 	}
 
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(jwtSecret()))
+}
+
+// loginResult finishes a first-factor login. Users with two-factor enabled
+// get a challenge token for LoginTwoFactor instead of a session token.
+func (h *Handlers) loginResult(c *fiber.Ctx, userID int64) (fiber.Map, error) {
+	ctx := c.UserContext()
+
+	enabled, err := h.isTwoFactorEnabled(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if enabled {
+		challenge, err := issueChallengeToken(userID)
+		if err != nil {
+			return nil, err
+		}
+		return fiber.Map{
+			"mfa_required": true,
+			"mfa_token":    challenge,
+			"userid":       userID,
+		}, nil
+	}
+
+	tokenString, err := h.issueToken(c, userID)
+	if err != nil {
+		return nil, err
+	}
+	return fiber.Map{
+		"token":  tokenString,
+		"userid": userID,
+	}, nil
+}
+
+// canLogIn reports whether userID may be signed in. Registration and login
+// codes share a verification type, so a matching code alone doesn't mean
+// the account finished signing up.
+func (h *Handlers) canLogIn(ctx context.Context, userID int64) (bool, error) {
+	user, err := h.Users.GetUser(ctx, userID)
+	if errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return user.Status == userStatusActive && !user.Deleted, nil
+}
+
+// hasAMR reports whether the token was issued after authenticating with
+// method.
+func (c *Claims) hasAMR(method string) bool {
+	for _, m := range c.AMR {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClaimsFromToken parses a session token, rejecting restricted tokens
+// such as two-factor challenges and tokens whose session was revoked.
+func (h *Handlers) parseClaimsFromToken(ctx context.Context, tokenString string) (*Claims, error) {
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, errWrongPurpose
+	}
+	if err := h.checkSession(ctx, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func parseToken(tokenString string) (*Claims, error) {
 	parsedToken, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, jwt.ErrSignatureInvalid
 		}
-		return []byte(jwtSecret), nil
+		return []byte(jwtSecret()), nil
 	})
 	if err != nil {
 		return nil, err
@@ -62,59 +206,57 @@ func parseClaimsFromToken(tokenString string) (*Claims, error) {
 	return claims, nil
 }
 
-func getClaimsFromContext(c *fiber.Ctx) (*Claims, error) {
+func (h *Handlers) getClaimsFromContext(c *fiber.Ctx) (*Claims, error) {
+	ctx := c.UserContext()
+
 	tokenString, err := extractTokenFromRequest(c)
 	if err != nil {
 		return nil, err
 	}
 
-	return parseClaimsFromToken(tokenString)
-}
+	claims, err := h.parseClaimsFromToken(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
 
-func isUserAdmin(userID int64) (bool, error) {
-	queries := []string{
-		"SELECT is_admin FROM users WHERE user_id = $1",
-		"SELECT role = 'admin' FROM users WHERE user_id = $1",
-		"SELECT EXISTS (SELECT 1 FROM admins WHERE user_id = $1)",
-		"SELECT EXISTS (SELECT 1 FROM user_roles WHERE user_id = $1 AND role = 'admin')",
-	}
-
-	for _, query := range queries {
-		var isAdmin bool
-		err := db.DB.QueryRow(query, userID).Scan(&isAdmin)
-		switch {
-		case err == nil:
-			return isAdmin, nil
-		case errors.Is(err, sql.ErrNoRows):
-			return false, nil
-		default:
-			if pqErr, ok := err.(*pq.Error); ok {
-				switch pqErr.Code {
-				case "42703", "42P01":
-					continue
-				}
-			}
-			return false, err
-		}
+	if err := h.ensureAccountActive(ctx, claims.UserID); err != nil {
+		return nil, err
 	}
 
-	return false, fmt.Errorf("could not determine admin status for user %d", userID)
+	c.Locals(localsUserID, claims.UserID)
+	return claims, nil
 }
 
-func unauthorizedResponse(c *fiber.Ctx, err error) error {
-	message := "Unauthorized"
-	status := fiber.StatusUnauthorized
-
-	if errors.Is(err, errMissingToken) {
-		message = "Missing authorization token"
-	} else if errors.Is(err, jwt.ErrSignatureInvalid) {
-		message = "Invalid token signature"
-	} else if errors.Is(err, jwt.ErrTokenExpired) {
-		message = "Token expired"
+// ensureAccountActive rejects tokens that belong to deleted accounts, which
+// would otherwise stay usable until they expire.
+func (h *Handlers) ensureAccountActive(ctx context.Context, userID int64) error {
+	user, err := h.Users.GetUser(ctx, userID)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return errAccountDeleted
+	case err != nil:
+		return err
+	case user.Deleted:
+		return errAccountDeleted
 	}
+	return nil
+}
 
-	return c.Status(status).JSON(fiber.Map{
-		"error":   message,
-		"details": err.Error(),
-	})
+// unauthorizedError maps a failed token check to the code telling the
+// client why.
+func unauthorizedError(err error) *APIError {
+	code := codeUnauthorized
+	switch {
+	case errors.Is(err, errMissingToken):
+		code = codeTokenMissing
+	case errors.Is(err, jwt.ErrSignatureInvalid), errors.Is(err, errWrongPurpose):
+		code = codeTokenInvalid
+	case errors.Is(err, jwt.ErrTokenExpired):
+		code = codeTokenExpired
+	case errors.Is(err, errAccountDeleted):
+		code = codeAccountDeleted
+	case errors.Is(err, errSessionRevoked):
+		code = codeSessionRevoked
+	}
+	return apiError(code).wrap(err)
 }
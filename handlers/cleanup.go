@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const cleanupInterval = time.Hour
+
+// StartCleanup periodically purges signups that were never verified,
+// lockouts that have run out, code send history older than a day and
+// sessions that ended over a month ago. The signup TTL comes from
+// PENDING_REGISTRATION_TTL (a Go duration such as "48h"). It runs until ctx
+// is cancelled, finishing the pass in progress first.
+func (h *Handlers) StartCleanup(ctx context.Context) {
+	ttl := appConfig.Cleanup.PendingRegistrationTTL
+	registerWorker("cleanup", cleanupInterval)
+
+	goBackground(func() {
+		ticker := time.NewTicker(cleanupInterval)
+		defer ticker.Stop()
+
+		for {
+			h.runCleanup(ttl)
+			beat("cleanup")
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// runCleanup makes one pass over the stores. It has its own deadline rather
+// than the worker's context, so shutdown doesn't abort a pass halfway.
+func (h *Handlers) runCleanup(ttl time.Duration) {
+	ctx, cancel := backgroundContext(context.Background())
+	defer cancel()
+
+	now := time.Now()
+
+	if purged, err := h.Users.PurgePendingUsers(ctx, now.Add(-ttl)); err != nil {
+		slog.ErrorContext(ctx, "failed to purge abandoned registrations", "error", err)
+	} else if purged > 0 {
+		slog.InfoContext(ctx, "purged abandoned registrations", "count", purged)
+	}
+
+	if err := h.Lockouts.PurgeLockouts(ctx, now.Add(-lockoutWindow)); err != nil {
+		slog.ErrorContext(ctx, "failed to purge stale lockouts", "error", err)
+	}
+
+	if err := h.Verifications.PurgeSends(ctx, now.Add(-resendCapWindow)); err != nil {
+		slog.ErrorContext(ctx, "failed to purge code send history", "error", err)
+	}
+
+	if err := h.Sessions.PurgeSessions(ctx, now.Add(-sessionRetention)); err != nil {
+		slog.ErrorContext(ctx, "failed to purge stale sessions", "error", err)
+	}
+}
@@ -0,0 +1,14 @@
+package handlers
+
+import "speak/config"
+
+// appConfig holds the settings the handlers read. Configure replaces it with
+// the loaded configuration at startup.
+var appConfig = &config.Config{}
+
+// Configure hands the loaded configuration to the handlers. It must be
+// called before the server starts.
+func Configure(cfg *config.Config) {
+	appConfig = cfg
+	googleKeys.url = cfg.OAuth.GoogleJWKSURL
+}
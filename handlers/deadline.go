@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequestDeadline is middleware that gives each request a context with the
+// DB_QUERY_TIMEOUT deadline. Handlers run their queries with
+// c.UserContext(), so a stuck query fails the request instead of holding a
+// pooled connection indefinitely.
+func RequestDeadline(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), appConfig.Database.QueryTimeout)
+	defer cancel()
+
+	c.SetUserContext(ctx)
+	return c.Next()
+}
+
+// backgroundContext returns a context with the DB_QUERY_TIMEOUT deadline for
+// work that runs outside a request, such as a cleanup pass or an email sent
+// after the handler has returned. It keeps parent's values, such as the
+// request ID, but not its cancellation.
+func backgroundContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(parent), appConfig.Database.QueryTimeout)
+}
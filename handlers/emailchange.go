@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"strings"
+
+	"speak/store"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type changeEmailRequest struct {
+	Email string `json:"email"`
+}
+
+type changeEmailVerifyRequest struct {
+	Code string `json:"code"`
+}
+
+func (h *Handlers) RequestEmailChange(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
+	if err != nil {
+		return unauthorizedError(err)
+	}
+
+	var req changeEmailRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest).wrap(err)
+	}
+
+	newEmail := normalizeEmail(req.Email)
+	if !validEmail(newEmail) {
+		return apiError(codeInvalidEmail)
+	}
+
+	user, err := h.Users.GetUser(ctx, claims.UserID)
+	if errors.Is(err, store.ErrNotFound) {
+		return apiError(codeUserNotFound)
+	}
+	if err != nil {
+		return internalError("failed to fetch user", err)
+	}
+
+	if strings.EqualFold(user.Email, newEmail) {
+		return apiError(codeEmailUnchanged)
+	}
+
+	taken, err := h.Users.IsEmailTaken(ctx, newEmail, claims.UserID)
+	if err != nil {
+		return internalError("failed to check email availability", err)
+	}
+	if taken {
+		return apiError(codeEmailTaken)
+	}
+
+	if err := h.checkResendLimits(c, newEmail); err != nil {
+		return err
+	}
+
+	code, err := h.createVerification(ctx, claims.UserID, newEmail, verificationTypeEmailChange)
+	if err != nil {
+		return internalError("failed to create verification", err)
+	}
+
+	if err := sendEmailChangeVerificationEmail(ctx, newEmail, code); err != nil {
+		slog.ErrorContext(ctx, "failed to send email", "error", err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Verification code sent to new email"})
+}
+
+func (h *Handlers) VerifyEmailChange(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
+	if err != nil {
+		return unauthorizedError(err)
+	}
+
+	var req changeEmailVerifyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest).wrap(err)
+	}
+
+	code := strings.TrimSpace(req.Code)
+	if code == "" {
+		return fieldRequired("code")
+	}
+
+	lockKeys := withClientIP(c, lockoutKeyUser(claims.UserID))
+	attempt, retryAfter, err := h.takeAttempt(ctx, lockKeys...)
+	if err != nil {
+		return internalError("failed to check lockout", err)
+	}
+	if retryAfter > 0 {
+		return tooManyAttempts(c, retryAfter)
+	}
+
+	record, err := h.matchVerificationByUser(ctx, claims.UserID, verificationTypeEmailChange, code)
+	if errors.Is(err, errInvalidCode) {
+		return apiError(codeCodeInvalid)
+	}
+	if err != nil {
+		return internalError("failed to fetch verification", err)
+	}
+	if err := attempt.release(ctx, lockKeys[0]); err != nil {
+		slog.ErrorContext(ctx, "failed to clear lockout", "error", err)
+	}
+	newEmail := record.Email
+
+	// The code is spent together with the change, so it can't be used
+	// twice
+	oldEmail, err := h.Users.ChangeEmail(ctx, claims.UserID, newEmail, verificationTypeEmailChange, record.CodeHash)
+	if errors.Is(err, store.ErrConflict) {
+		return apiError(codeEmailTaken)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		return apiError(codeCodeInvalid)
+	}
+	if err != nil {
+		return internalError("failed to update email", err)
+	}
+
+	if oldEmail != "" {
+		if err := sendEmailChangedNotice(ctx, oldEmail, newEmail); err != nil {
+			slog.ErrorContext(ctx, "failed to send email", "error", err)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Email updated",
+		"email":   newEmail,
+	})
+}
+
+func sendEmailChangeVerificationEmail(ctx context.Context, to, code string) error {
+	htmlContent := renderCodeEmail(
+		"Confirm Your New Email",
+		"Please use the verification code below to confirm this address for your SpeakAllRight account:",
+		code,
+		"",
+	)
+	textContent := fmt.Sprintf("SpeakAllRight - Confirm Your New Email\n\nYour verification code is: %s\n\nThis code will expire in %s.\n\nNeed help? Contact support@speakallright.uz", code, verificationCodeTTLText())
+
+	return sendEmail(ctx, to, "Confirm your new SpeakAllRight email", htmlContent, textContent)
+}
+
+func sendEmailChangedNotice(ctx context.Context, to, newEmail string) error {
+	htmlContent := renderNoticeEmail(
+		"Your Email Was Changed",
+		"If you didn't make this change, contact support immediately.",
+		fmt.Sprintf("The email address on your SpeakAllRight account was changed to <strong>%s</strong>.", html.EscapeString(newEmail)),
+		"You will no longer receive login codes at this address.",
+	)
+	textContent := fmt.Sprintf("SpeakAllRight - Your Email Was Changed\n\nThe email address on your SpeakAllRight account was changed to %s.\n\nIf you didn't make this change, contact support@speakallright.uz immediately.", newEmail)
+
+	return sendEmail(ctx, to, "Your SpeakAllRight email was changed", htmlContent, textContent)
+}
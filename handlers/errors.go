@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// APIError is an error response. Handlers return it and ErrorHandler
+// renders it as
+//
+//	{"error": "<message in the client's language>", "code": "<Code>", ...Params}
+//
+// Code is stable and meant for clients to branch on; the message may change.
+// Err is the underlying cause: it is logged but never sent to the client.
+type APIError struct {
+	Code   string
+	Status int
+	// Params are extra fields of the response body, such as retry_after
+	Params fiber.Map
+	Err    error
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return e.Code + ": " + e.Err.Error()
+	}
+	return e.Code
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// StatusCode is the HTTP status the error is rendered with; the metrics and
+// tracing middleware read it.
+func (e *APIError) StatusCode() int {
+	return e.Status
+}
+
+// apiError returns the error for code with its catalogued status.
+func apiError(code string) *APIError {
+	status := fiber.StatusInternalServerError
+	if m, ok := errorMessages[code]; ok {
+		status = m.status
+	}
+	return &APIError{Code: code, Status: status}
+}
+
+// wrap records err as the cause of e, for the log.
+func (e *APIError) wrap(err error) *APIError {
+	e.Err = err
+	return e
+}
+
+// with adds a field to the response body.
+func (e *APIError) with(key string, value any) *APIError {
+	if e.Params == nil {
+		e.Params = fiber.Map{}
+	}
+	e.Params[key] = value
+	return e
+}
+
+// internalError hides err behind INTERNAL_ERROR, describing what failed in
+// the log line only.
+func internalError(what string, err error) *APIError {
+	return apiError(codeInternal).wrap(fmt.Errorf("%s: %w", what, err))
+}
+
+// fieldRequired reports request fields that are missing or empty.
+func fieldRequired(fields ...string) *APIError {
+	return apiError(codeFieldRequired).with("fields", fields)
+}
+
+// ErrorHandler is the app's fiber.Config.ErrorHandler. It renders an
+// APIError in the client's language, maps Fiber's own errors (unknown
+// route, body too large) to codes and turns anything else into
+// INTERNAL_ERROR. Causes of server errors are logged with the request's
+// context.
+func ErrorHandler(c *fiber.Ctx, err error) error {
+	var apiErr *APIError
+	var fe *fiber.Error
+	switch {
+	case errors.As(err, &apiErr):
+	case errors.As(err, &fe):
+		apiErr = fromFiberError(fe)
+	default:
+		apiErr = apiError(codeInternal).wrap(err)
+	}
+
+	ctx := c.UserContext()
+	if apiErr.Status >= fiber.StatusInternalServerError {
+		slog.ErrorContext(ctx, "request failed", "error_code", apiErr.Code, "error", apiErr.Err)
+	} else if apiErr.Err != nil {
+		slog.DebugContext(ctx, "request rejected", "error_code", apiErr.Code, "error", apiErr.Err)
+	}
+
+	body := fiber.Map{
+		"error": errorMessage(apiErr.Code, clientLanguage(c)),
+		"code":  apiErr.Code,
+	}
+	for key, value := range apiErr.Params {
+		body[key] = value
+	}
+	return c.Status(apiErr.Status).JSON(body)
+}
+
+func fromFiberError(fe *fiber.Error) *APIError {
+	var e *APIError
+	switch fe.Code {
+	case fiber.StatusNotFound:
+		e = apiError(codeNotFound)
+	case fiber.StatusMethodNotAllowed:
+		e = apiError(codeMethodNotAllowed)
+	case fiber.StatusRequestEntityTooLarge:
+		e = apiError(codePayloadTooLarge)
+	default:
+		if fe.Code >= fiber.StatusInternalServerError {
+			e = apiError(codeInternal)
+		} else {
+			e = apiError(codeInvalidRequest)
+		}
+		e.Status = fe.Code
+	}
+	return e.wrap(fe)
+}
@@ -0,0 +1,17 @@
+package handlers
+
+import "speak/store"
+
+// Handlers serves the API routes. Its stores hold the data the routes
+// depend on; main wires in the Postgres implementations and a store.Memory
+// can stand in for them when running handlers without a database. Only the
+// readiness probe talks to the database directly.
+type Handlers struct {
+	Users         store.UserStore
+	Sessions      store.SessionStore
+	Verifications store.VerificationStore
+	Lockouts      store.LockoutStore
+	TwoFactor     store.TwoFactorStore
+	Balances      store.BalanceStore
+	Promocodes    store.PromocodeStore
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"speak/config"
+	"speak/sms"
+	"speak/store"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// testSender keeps the texts the handlers send so tests can read the codes.
+// While held it blocks every send until released.
+type testSender struct {
+	mu      sync.Mutex
+	sent    map[string][]string
+	release chan struct{}
+}
+
+func (s *testSender) Send(ctx context.Context, phone, message string) error {
+	s.mu.Lock()
+	release := s.release
+	s.mu.Unlock()
+	if release != nil {
+		<-release
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent[phone] = append(s.sent[phone], message)
+	return nil
+}
+
+// hold makes sends block until the test ends.
+func (s *testSender) hold(t *testing.T) {
+	release := make(chan struct{})
+	s.mu.Lock()
+	s.release = release
+	s.mu.Unlock()
+	t.Cleanup(func() { close(release) })
+}
+
+var smsCodePattern = regexp.MustCompile(`code is (\d+)`)
+
+// lastCode returns the code in the latest text sent to phone.
+func (s *testSender) lastCode(t *testing.T, phone string) string {
+	t.Helper()
+
+	// Some codes are sent after the reply
+	WaitForWorkers(context.Background())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := s.sent[phone]
+	if len(messages) == 0 {
+		t.Fatalf("no text sent to %s", phone)
+	}
+	match := smsCodePattern.FindStringSubmatch(messages[len(messages)-1])
+	if match == nil {
+		t.Fatalf("no code in text %q", messages[len(messages)-1])
+	}
+	return match[1]
+}
+
+type testServer struct {
+	h     *Handlers
+	app   *fiber.App
+	store *store.Memory
+	sms   *testSender
+}
+
+// newTestServer serves the handlers from a fresh in-memory store, with
+// texts captured instead of sent and no resend cooldown.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	Configure(&config.Config{
+		Auth: config.Auth{
+			JWTSecret:              "test-jwt-secret",
+			VerificationCodeSecret: "test-code-secret",
+			TOTPEncryptionKey:      "test-totp-key",
+		},
+		Verification: config.Verification{
+			CodeLength:     6,
+			CodeTTL:        10 * time.Minute,
+			ResendDailyCap: 100,
+		},
+	})
+
+	sender := &testSender{sent: make(map[string][]string)}
+	previous := sms.Default
+	sms.Default = sender
+	t.Cleanup(func() {
+		WaitForWorkers(context.Background())
+		sms.Default = previous
+	})
+
+	mem := store.NewMemory()
+	h := &Handlers{
+		Users:         mem,
+		Sessions:      mem,
+		Verifications: mem,
+		Lockouts:      mem,
+		TwoFactor:     mem,
+		Balances:      mem,
+		Promocodes:    mem,
+	}
+
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+	app.Post("/api/registerviaemail", h.RegisterViaEmail)
+	app.Post("/api/registerviaphone", h.RegisterViaPhone)
+	app.Post("/api/verifyphone", h.VerifyPhone)
+	app.Post("/api/verifyemail", h.VerifyEmail)
+	app.Post("/api/resendcode", h.ResendCode)
+	app.Post("/api/login/magic", h.MagicLinkLogin)
+	app.Post("/api/loginviaphone", h.LoginViaPhone)
+	app.Post("/api/loginviaphoneverify", h.LoginViaPhoneVerify)
+	app.Post("/api/login/2fa", h.LoginTwoFactor)
+	app.Get("/api/me/sessions", h.ListSessions)
+	app.Delete("/api/me/sessions/:id", h.RevokeSession)
+	app.Get(revokeSessionsPath, h.ConfirmRevokeAllSessions)
+	app.Post(revokeSessionsPath, h.RevokeAllSessions)
+	app.Post("/api/me/2fa/totp", h.BeginTOTPEnrollment)
+	app.Post("/api/me/2fa/totp/confirm", h.ConfirmTOTPEnrollment)
+	app.Delete("/api/me/2fa/totp", h.DisableTOTP)
+	app.Post("/api/me/email/verify", h.VerifyEmailChange)
+	app.Post("/api/me/delete", h.RequestAccountDeletion)
+	app.Delete("/api/me", h.DeleteAccount)
+
+	return &testServer{h: h, app: app, store: mem, sms: sender}
+}
+
+// do sends body as JSON, authenticated with token when it isn't empty, and
+// decodes the JSON reply.
+func (s *testServer) do(t *testing.T, method, path, token string, body any) (int, map[string]any) {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	}
+
+	resp, err := s.app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var reply map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatalf("%s %s: decoding reply: %v", method, path, err)
+	}
+	return resp.StatusCode, reply
+}
+
+// expectError checks that the reply is an error with the given code.
+func expectError(t *testing.T, status int, reply map[string]any, code string) {
+	t.Helper()
+	if reply["code"] != code {
+		t.Fatalf("got %d %v, want error %s", status, reply, code)
+	}
+}
+
+// signUp registers phone and confirms it with the texted code, returning
+// the session token VerifyPhone hands out.
+func (s *testServer) signUp(t *testing.T, phone string) string {
+	t.Helper()
+
+	status, reply := s.do(t, "POST", "/api/registerviaphone", "", fiber.Map{
+		"firstname":   "Aziz",
+		"lastname":    "Karimov",
+		"dateofbirth": "1990-05-17",
+		"phone":       phone,
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("registering: got %d %v", status, reply)
+	}
+
+	status, reply = s.do(t, "POST", "/api/verifyphone", "", fiber.Map{
+		"phone": phone,
+		"code":  s.sms.lastCode(t, phone),
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("verifying phone: got %d %v", status, reply)
+	}
+	token, _ := reply["token"].(string)
+	if token == "" {
+		t.Fatalf("verifying phone: no token in %v", reply)
+	}
+	return token
+}
+
+// logIn signs phone in with a texted code and returns the reply.
+func (s *testServer) logIn(t *testing.T, phone string) map[string]any {
+	t.Helper()
+
+	status, reply := s.do(t, "POST", "/api/loginviaphone", "", fiber.Map{"phone": phone})
+	if status != fiber.StatusOK {
+		t.Fatalf("requesting login code: got %d %v", status, reply)
+	}
+
+	status, reply = s.do(t, "POST", "/api/loginviaphoneverify", "", fiber.Map{
+		"phone": phone,
+		"code":  s.sms.lastCode(t, phone),
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("logging in: got %d %v", status, reply)
+	}
+	return reply
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"speak/db"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// healthCheckTimeout bounds each readiness check, so a probe with a 5s
+// timeout gets an answer even when a dependency hangs.
+const healthCheckTimeout = 2 * time.Second
+
+// Check results. A skipped check is for something that isn't configured,
+// such as mail in local development, and doesn't affect readiness.
+const (
+	checkOK      = "ok"
+	checkFailed  = "fail"
+	checkSkipped = "skipped"
+)
+
+type checkResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	// Error is a short description; the underlying error is only logged,
+	// since it can name internal hosts
+	Error string `json:"error,omitempty"`
+}
+
+type migrationsResult struct {
+	checkResult
+	Applied int `json:"applied"`
+	Latest  int `json:"latest"`
+}
+
+type workerResult struct {
+	Status   string    `json:"status"`
+	LastBeat time.Time `json:"last_beat"`
+}
+
+type readinessResponse struct {
+	Status string `json:"status"`
+	Checks struct {
+		Database   checkResult             `json:"database"`
+		Mail       checkResult             `json:"mail"`
+		Migrations migrationsResult        `json:"migrations"`
+		Workers    map[string]workerResult `json:"workers"`
+	} `json:"checks"`
+}
+
+// Healthz is the liveness probe: it answers as long as the process can
+// serve requests at all. Dependencies are left to Readyz, so an outage
+// elsewhere doesn't get the container restarted.
+func (h *Handlers) Healthz(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"status": checkOK})
+}
+
+// Readyz is the readiness probe. It checks that Postgres answers, the mail
+// host accepts connections, every migration this build knows has been
+// applied and the background workers are still running, and responds 503
+// with the breakdown when any of them isn't.
+func (h *Handlers) Readyz(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), healthCheckTimeout)
+	defer cancel()
+
+	var resp readinessResponse
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		resp.Checks.Database = checkDatabase(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		resp.Checks.Mail = checkMail(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		resp.Checks.Migrations = checkMigrations(ctx)
+	}()
+	wg.Wait()
+	resp.Checks.Workers = checkWorkers()
+
+	ready := resp.Checks.Database.Status != checkFailed &&
+		resp.Checks.Mail.Status != checkFailed &&
+		resp.Checks.Migrations.Status != checkFailed
+	for _, w := range resp.Checks.Workers {
+		if w.Status == checkFailed {
+			ready = false
+		}
+	}
+
+	if !ready {
+		resp.Status = "not_ready"
+		return c.Status(fiber.StatusServiceUnavailable).JSON(resp)
+	}
+	resp.Status = "ready"
+	return c.JSON(resp)
+}
+
+func checkDatabase(ctx context.Context) checkResult {
+	start := time.Now()
+	if err := db.DB.PingContext(ctx); err != nil {
+		slog.WarnContext(ctx, "readiness: database unreachable", "error", err)
+		return checkResult{Status: checkFailed, Error: "database unreachable"}
+	}
+	return checkResult{Status: checkOK, LatencyMS: sinceMS(start)}
+}
+
+// checkMail only opens a TCP connection to the SSH port; a full login per
+// probe would flood the mail host's auth log.
+func checkMail(ctx context.Context) checkResult {
+	mail := appConfig.Mail
+	if mail.SSHHost == "" {
+		return checkResult{Status: checkSkipped}
+	}
+
+	start := time.Now()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(mail.SSHHost, mail.SSHPort))
+	if err != nil {
+		slog.WarnContext(ctx, "readiness: mail host unreachable", "error", err)
+		return checkResult{Status: checkFailed, Error: "mail host unreachable"}
+	}
+	conn.Close()
+	return checkResult{Status: checkOK, LatencyMS: sinceMS(start)}
+}
+
+func checkMigrations(ctx context.Context) migrationsResult {
+	applied, latest, err := db.MigrationStatus(ctx)
+	result := migrationsResult{checkResult: checkResult{Status: checkOK}, Applied: applied, Latest: latest}
+	if err != nil {
+		slog.WarnContext(ctx, "readiness: failed to read schema version", "error", err)
+		result.Status = checkFailed
+		result.Error = "schema version unavailable"
+	} else if applied < latest {
+		result.Status = checkFailed
+		result.Error = "migrations pending"
+	}
+	return result
+}
+
+// checkWorkers fails a worker that has missed two passes in a row.
+func checkWorkers() map[string]workerResult {
+	results := map[string]workerResult{}
+	for name, hb := range workerHeartbeats() {
+		status := checkOK
+		if time.Since(hb.last) > 2*hb.interval {
+			status = checkFailed
+		}
+		results[name] = workerResult{Status: status, LastBeat: hb.last.UTC()}
+	}
+	return results
+}
+
+func sinceMS(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"speak/sms"
+	"speak/store"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Values of user_identities.provider, see store.ProviderEmail.
+const (
+	identityProviderEmail    = store.ProviderEmail
+	identityProviderPhone    = store.ProviderPhone
+	identityProviderGoogle   = store.ProviderGoogle
+	identityProviderTelegram = store.ProviderTelegram
+)
+
+type identityResponse struct {
+	ID         int64      `json:"id"`
+	Provider   string     `json:"provider"`
+	Subject    string     `json:"subject"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type linkIdentityRequest struct {
+	Provider string `json:"provider"`
+	Email    string `json:"email"`
+	Phone    string `json:"phone"`
+	IDToken  string `json:"id_token"`
+	// Telegram carries the Login Widget fields unchanged, as the hash covers
+	// every one of them
+	Telegram json.RawMessage `json:"telegram"`
+}
+
+type verifyIdentityRequest struct {
+	Provider string `json:"provider"`
+	Code     string `json:"code"`
+}
+
+func (h *Handlers) ListIdentities(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
+	if err != nil {
+		return unauthorizedError(err)
+	}
+
+	identities, err := h.fetchIdentities(ctx, claims.UserID)
+	if err != nil {
+		return internalError("failed to fetch identities", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"identities": identities,
+	})
+}
+
+// LinkIdentity adds a login method to the current user. Google ID tokens and
+// Telegram widget data are verified and linked right away; emails and phone
+// numbers get a code that VerifyIdentity confirms.
+func (h *Handlers) LinkIdentity(c *fiber.Ctx) error {
+	claims, err := h.getClaimsFromContext(c)
+	if err != nil {
+		return unauthorizedError(err)
+	}
+
+	var req linkIdentityRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest).wrap(err)
+	}
+
+	switch req.Provider {
+	case identityProviderEmail:
+		email := normalizeEmail(req.Email)
+		if !validEmail(email) {
+			return apiError(codeInvalidEmail)
+		}
+		return h.startIdentityVerification(c, claims.UserID, identityProviderEmail, email)
+
+	case identityProviderPhone:
+		if !sms.Enabled() {
+			return apiError(codeProviderUnavailable)
+		}
+		phone, err := sms.NormalizePhone(req.Phone)
+		if err != nil {
+			return apiError(codeInvalidPhone)
+		}
+		return h.startIdentityVerification(c, claims.UserID, identityProviderPhone, phone)
+
+	case identityProviderGoogle:
+		googleClaims, err := verifyGoogleIDToken(req.IDToken)
+		if errors.Is(err, errProviderNotConfigured) {
+			return apiError(codeProviderUnavailable)
+		}
+		if err != nil {
+			return apiError(codeGoogleTokenInvalid).wrap(err)
+		}
+		return h.finishIdentityLink(c, claims.UserID, identityProviderGoogle, googleClaims.Subject)
+
+	case identityProviderTelegram:
+		telegramID, _, err := verifyTelegramPayload(req.Telegram)
+		if errors.Is(err, errProviderNotConfigured) {
+			return apiError(codeProviderUnavailable)
+		}
+		if err != nil {
+			return apiError(codeTelegramDataInvalid).wrap(err)
+		}
+		return h.finishIdentityLink(c, claims.UserID, identityProviderTelegram, strconv.FormatInt(telegramID, 10))
+
+	default:
+		return apiError(codeUnsupportedProvider)
+	}
+}
+
+func (h *Handlers) VerifyIdentity(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
+	if err != nil {
+		return unauthorizedError(err)
+	}
+
+	var req verifyIdentityRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest).wrap(err)
+	}
+
+	var verificationType string
+	switch req.Provider {
+	case identityProviderEmail:
+		verificationType = verificationTypeLinkEmail
+	case identityProviderPhone:
+		verificationType = verificationTypeLinkPhone
+	default:
+		return apiError(codeUnsupportedProvider)
+	}
+
+	code := strings.TrimSpace(req.Code)
+	if code == "" {
+		return fieldRequired("code")
+	}
+
+	lockKeys := withClientIP(c, lockoutKeyUser(claims.UserID))
+	attempt, retryAfter, err := h.takeAttempt(ctx, lockKeys...)
+	if err != nil {
+		return internalError("failed to check lockout", err)
+	}
+	if retryAfter > 0 {
+		return tooManyAttempts(c, retryAfter)
+	}
+
+	record, err := h.matchVerificationByUser(ctx, claims.UserID, verificationType, code)
+	if err != nil {
+		if errors.Is(err, errInvalidCode) {
+			return apiError(codeCodeInvalid)
+		}
+		return internalError("failed to fetch verification", err)
+	}
+	if err := attempt.release(ctx, lockKeys[0]); err != nil {
+		slog.ErrorContext(ctx, "failed to clear lockout", "error", err)
+	}
+
+	subject := record.Email
+	if req.Provider == identityProviderPhone {
+		subject = record.Phone
+	}
+
+	// Spend the code, so of two requests racing with it only one links
+	if spent, err := h.Verifications.DeleteVerificationByCode(ctx, claims.UserID, verificationType, record.CodeHash); err != nil {
+		return internalError("failed to clear verification", err)
+	} else if !spent {
+		return apiError(codeCodeInvalid)
+	}
+
+	return h.finishIdentityLink(c, claims.UserID, req.Provider, subject)
+}
+
+// UnlinkIdentity removes a login method. The last one can't be removed, as
+// the account would become impossible to sign in to.
+func (h *Handlers) UnlinkIdentity(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
+	if err != nil {
+		return unauthorizedError(err)
+	}
+
+	identityID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return apiError(codeInvalidIdentityID)
+	}
+
+	err = h.Users.UnlinkIdentity(ctx, claims.UserID, identityID)
+	if errors.Is(err, store.ErrNotFound) {
+		return apiError(codeIdentityNotFound)
+	}
+	if errors.Is(err, store.ErrLastIdentity) {
+		return apiError(codeLastLoginMethod)
+	}
+	if err != nil {
+		return internalError("failed to unlink identity", err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Identity unlinked"})
+}
+
+func (h *Handlers) startIdentityVerification(c *fiber.Ctx, userID int64, provider, destination string) error {
+	ctx := c.UserContext()
+
+	owner, err := h.Users.FindUserByIdentity(ctx, provider, destination)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return internalError("failed to check identity", err)
+	}
+	if err == nil {
+		if owner == userID {
+			return apiError(codeIdentityAlreadyLinked)
+		}
+		return apiError(codeIdentityLinkedElsewhere)
+	}
+
+	if err := h.checkResendLimits(c, destination); err != nil {
+		return err
+	}
+
+	verificationType := verificationTypeLinkEmail
+	if provider == identityProviderPhone {
+		verificationType = verificationTypeLinkPhone
+	}
+
+	code, err := h.createVerification(ctx, userID, destination, verificationType)
+	if err != nil {
+		return internalError("failed to create verification", err)
+	}
+
+	if provider == identityProviderPhone {
+		err = sendSMSCode(ctx, destination, code)
+	} else {
+		err = sendEmailChangeVerificationEmail(ctx, destination, code)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to send code", "error", err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Verification code sent"})
+}
+
+func (h *Handlers) finishIdentityLink(c *fiber.Ctx, userID int64, provider, subject string) error {
+	err := h.Users.LinkIdentity(c.UserContext(), userID, provider, subject)
+	if errors.Is(err, store.ErrConflict) {
+		return apiError(codeIdentityLinkedElsewhere)
+	}
+	if err != nil {
+		return internalError("failed to link identity", err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Identity linked"})
+}
+
+func (h *Handlers) fetchIdentities(ctx context.Context, userID int64) ([]identityResponse, error) {
+	identities, err := h.Users.ListIdentities(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]identityResponse, 0, len(identities))
+	for _, i := range identities {
+		items = append(items, identityResponse{
+			ID:         i.ID,
+			Provider:   i.Provider,
+			Subject:    i.Subject,
+			VerifiedAt: i.VerifiedAt,
+			CreatedAt:  i.CreatedAt,
+		})
+	}
+	return items, nil
+}
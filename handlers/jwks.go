@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	jwksRefreshInterval = time.Hour
+	// jwksMinFetchInterval spaces out fetches triggered by unknown key IDs,
+	// so tokens naming made-up keys can't make every request wait on one
+	jwksMinFetchInterval = time.Minute
+)
+
+// googleKeys verifies Google ID tokens. Configure sets where its signing keys
+// are fetched from.
+var googleKeys = &jwksCache{}
+
+// jwksCache holds RSA signing keys from a JWKS endpoint, refetching them
+// hourly or when a token names a key it hasn't seen, at most once per
+// jwksMinFetchInterval. The lock is only held to read or swap the key set;
+// requests that need keys while a fetch is in flight wait for that fetch
+// instead of starting their own.
+type jwksCache struct {
+	url string
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	// triedAt is when the last fetch started, whether or not it succeeded
+	triedAt time.Time
+	// inflight is the fetch in progress, if any
+	inflight *jwksFetch
+}
+
+// jwksFetch is one fetch of the key set. done is closed once it finished
+// and err is set.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func (c *jwksCache) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, fmt.Errorf("token has no key id")
+	}
+
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	if ok && time.Since(c.fetchedAt) < jwksRefreshInterval {
+		c.mu.Unlock()
+		return key, nil
+	}
+
+	fetch, leader := c.inflight, false
+	if fetch == nil {
+		if time.Since(c.triedAt) < jwksMinFetchInterval {
+			c.mu.Unlock()
+			if ok {
+				return key, nil
+			}
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+
+		fetch, leader = &jwksFetch{done: make(chan struct{})}, true
+		c.inflight = fetch
+		c.triedAt = time.Now()
+	}
+	c.mu.Unlock()
+
+	if leader {
+		c.refresh(fetch)
+	}
+	<-fetch.done
+	if fetch.err != nil {
+		return nil, fetch.err
+	}
+
+	c.mu.Lock()
+	key, ok = c.keys[kid]
+	c.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// refresh fetches the key set, swaps it in if that succeeded and reports
+// the outcome to everyone waiting on fetch.
+func (c *jwksCache) refresh(fetch *jwksFetch) {
+	keys, err := c.fetchKeys()
+
+	c.mu.Lock()
+	if err == nil {
+		c.keys = keys
+		c.fetchedAt = time.Now()
+	}
+	c.inflight = nil
+	c.mu.Unlock()
+
+	fetch.err = err
+	close(fetch.done)
+}
+
+// fetchKeys downloads the key set from url.
+func (c *jwksCache) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(c.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch signing keys: status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode signing keys: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"speak/store"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Failed code checks are counted per email and, when it is known, per
+// client IP. After lockoutThreshold failures within lockoutWindow the key is
+// locked, starting at lockoutBaseDelay and doubling with every further
+// failure.
+const (
+	lockoutThreshold = 5
+	lockoutWindow    = time.Hour
+	lockoutBaseDelay = time.Minute
+	lockoutMaxDelay  = time.Hour
+)
+
+var lockoutPolicy = store.LockoutPolicy{
+	Threshold: lockoutThreshold,
+	Window:    lockoutWindow,
+	BaseDelay: lockoutBaseDelay,
+	MaxDelay:  lockoutMaxDelay,
+}
+
+func lockoutKeyEmail(email string) string {
+	return store.LockoutKey(store.ProviderEmail, email)
+}
+
+func lockoutKeyPhone(phone string) string {
+	return store.LockoutKey(store.ProviderPhone, phone)
+}
+
+func lockoutKeyUser(userID int64) string {
+	return "user:" + strconv.FormatInt(userID, 10)
+}
+
+func lockoutKeyIP(ip string) string {
+	return "ip:" + ip
+}
+
+// withClientIP adds the client IP's key to keys. Without trusted proxies
+// configured, c.IP() behind a CDN is the edge's address, shared by every
+// client going through it, so no IP key is added: locking it would lock
+// them all out.
+func withClientIP(c *fiber.Ctx, keys ...string) []string {
+	if len(appConfig.Server.TrustedProxies) == 0 {
+		return keys
+	}
+	return append(keys, lockoutKeyIP(c.IP()))
+}
+
+// signupKeys returns the key counting the client IP's unverified signups,
+// under the same conditions as withClientIP. It is apart from the IP's
+// failed code checks, so signing up doesn't lock the client out of
+// verifying.
+func signupKeys(c *fiber.Ctx) []string {
+	if len(appConfig.Server.TrustedProxies) == 0 {
+		return nil
+	}
+	return []string{"signup:" + c.IP()}
+}
+
+// lockoutAttempt is an attempt counted against each of its keys.
+type lockoutAttempt struct {
+	h    *Handlers
+	keys []string
+}
+
+// takeAttempt counts an attempt against every key up front, so concurrent
+// requests can't all slip in before the lock is set. When any key is locked
+// it takes nothing and returns how long to wait. The attempt stays counted
+// as a failure unless released.
+func (h *Handlers) takeAttempt(ctx context.Context, keys ...string) (*lockoutAttempt, time.Duration, error) {
+	attempt := &lockoutAttempt{h: h}
+	var retryAfter time.Duration
+	for _, key := range keys {
+		taken, err := h.Lockouts.TakeAttempt(ctx, key, lockoutPolicy)
+		if err != nil {
+			attempt.release(ctx)
+			return nil, 0, err
+		}
+		if !taken.Counted {
+			retryAfter = max(retryAfter, time.Until(taken.LockedUntil), time.Second)
+			continue
+		}
+		attempt.keys = append(attempt.keys, key)
+	}
+
+	if retryAfter > 0 {
+		if err := attempt.release(ctx); err != nil {
+			return nil, 0, err
+		}
+		return nil, retryAfter, nil
+	}
+	return attempt, 0, nil
+}
+
+// release takes the attempt back once it turned out not to be a failure,
+// and starts the count over for the keys in clear.
+func (a *lockoutAttempt) release(ctx context.Context, clear ...string) error {
+	var firstErr error
+	for _, key := range a.keys {
+		var err error
+		if slices.Contains(clear, key) {
+			err = a.h.Lockouts.ClearLockout(ctx, key)
+		} else {
+			err = a.h.Lockouts.ReturnAttempt(ctx, key, lockoutPolicy)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// tooManyAttempts rejects a request until retryAfter has passed, sending it
+// in the Retry-After header and the retry_after field.
+func tooManyAttempts(c *fiber.Ctx, retryAfter time.Duration) *APIError {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+	return apiError(codeTooManyAttempts).with("retry_after", seconds)
+}
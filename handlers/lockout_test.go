@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestLockoutAfterRepeatedFailures(t *testing.T) {
+	s := newTestServer(t)
+	phone := "+998901234571"
+	s.signUp(t, phone)
+
+	status, reply := s.do(t, "POST", "/api/loginviaphone", "", fiber.Map{"phone": phone})
+	if status != fiber.StatusOK {
+		t.Fatalf("requesting login code: got %d %v", status, reply)
+	}
+	code := s.sms.lastCode(t, phone)
+
+	for i := 0; i < lockoutThreshold; i++ {
+		status, reply := s.do(t, "POST", "/api/loginviaphoneverify", "", fiber.Map{"phone": phone, "code": "000000"})
+		expectError(t, status, reply, codeCodeInvalid)
+	}
+
+	// Even the right code is refused while locked out
+	status, reply = s.do(t, "POST", "/api/loginviaphoneverify", "", fiber.Map{"phone": phone, "code": code})
+	expectError(t, status, reply, codeTooManyAttempts)
+	if status != fiber.StatusTooManyRequests {
+		t.Errorf("status = %d, want %d", status, fiber.StatusTooManyRequests)
+	}
+	if retryAfter, _ := reply["retry_after"].(float64); retryAfter <= 0 || retryAfter > lockoutBaseDelay.Seconds() {
+		t.Errorf("retry_after = %v, want up to %v", reply["retry_after"], lockoutBaseDelay.Seconds())
+	}
+}
+
+func TestLockoutClearedOnSuccess(t *testing.T) {
+	s := newTestServer(t)
+	phone := "+998901234572"
+	s.signUp(t, phone)
+
+	status, reply := s.do(t, "POST", "/api/loginviaphone", "", fiber.Map{"phone": phone})
+	if status != fiber.StatusOK {
+		t.Fatalf("requesting login code: got %d %v", status, reply)
+	}
+	code := s.sms.lastCode(t, phone)
+
+	for i := 0; i < lockoutThreshold-1; i++ {
+		status, reply := s.do(t, "POST", "/api/loginviaphoneverify", "", fiber.Map{"phone": phone, "code": "000000"})
+		expectError(t, status, reply, codeCodeInvalid)
+	}
+	status, reply = s.do(t, "POST", "/api/loginviaphoneverify", "", fiber.Map{"phone": phone, "code": code})
+	if status != fiber.StatusOK {
+		t.Fatalf("logging in: got %d %v", status, reply)
+	}
+
+	// The phone's count starts over, so one more miss doesn't lock it
+	status, reply = s.do(t, "POST", "/api/loginviaphoneverify", "", fiber.Map{"phone": phone, "code": "000000"})
+	expectError(t, status, reply, codeCodeInvalid)
+}
+
+func TestConcurrentAttemptsShareLockout(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	key := lockoutKeyIP("192.0.2.1")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	taken := 0
+	for i := 0; i < 4*lockoutThreshold; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attempt, _, err := s.h.takeAttempt(ctx, key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if attempt != nil {
+				mu.Lock()
+				taken++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if taken != lockoutThreshold {
+		t.Errorf("%d attempts got through, want %d", taken, lockoutThreshold)
+	}
+}
+
+func TestLockoutDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{lockoutThreshold, lockoutBaseDelay},
+		{lockoutThreshold + 1, 2 * lockoutBaseDelay},
+		{lockoutThreshold + 3, 8 * lockoutBaseDelay},
+		{lockoutThreshold + 20, lockoutMaxDelay},
+	}
+	for _, tt := range tests {
+		if got := lockoutPolicy.Delay(tt.failures); got != tt.want {
+			t.Errorf("Delay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestClientIPKeyNeedsTrustedProxies(t *testing.T) {
+	newTestServer(t)
+	app := fiber.New()
+
+	// Behind an untrusted CDN every client shares the edge's address, so
+	// it must not be locked
+	var keys []string
+	app.Get("/", func(c *fiber.Ctx) error {
+		keys = withClientIP(c, "user:1")
+		return nil
+	})
+	if _, err := app.Test(httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Errorf("keys without trusted proxies = %v, want only the user's", keys)
+	}
+
+	appConfig.Server.TrustedProxies = []string{"0.0.0.0"}
+	if _, err := app.Test(httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[1] != lockoutKeyIP("0.0.0.0") {
+		t.Errorf("keys with trusted proxies = %v, want the user's and the IP's", keys)
+	}
+}
+
+func TestRegisterViaPhoneThrottledPerIP(t *testing.T) {
+	s := newTestServer(t)
+	appConfig.Server.TrustedProxies = []string{"0.0.0.0"}
+
+	register := func(phone string) (int, map[string]any) {
+		return s.do(t, "POST", "/api/registerviaphone", "", fiber.Map{
+			"firstname":   "Aziz",
+			"lastname":    "Karimov",
+			"dateofbirth": "1990-05-17",
+			"phone":       phone,
+		})
+	}
+
+	// Each unverified signup texts a code and stays counted
+	for i := 0; i < lockoutThreshold; i++ {
+		if status, reply := register("+99890123460" + string(rune('0'+i))); status != fiber.StatusOK {
+			t.Fatalf("signup %d: got %d %v", i, status, reply)
+		}
+	}
+	status, reply := register("+998901234609")
+	expectError(t, status, reply, codeTooManyAttempts)
+
+	// Verifying one of them gives its attempt back
+	status, reply = s.do(t, "POST", "/api/verifyphone", "", fiber.Map{
+		"phone": "+998901234600",
+		"code":  s.sms.lastCode(t, "+998901234600"),
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("verifying: got %d %v", status, reply)
+	}
+	if status, reply := register("+998901234609"); status != fiber.StatusOK {
+		t.Errorf("signup after verifying: got %d %v", status, reply)
+	}
+}
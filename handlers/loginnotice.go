@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+	"time"
+
+	"speak/store"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	revokeSessionsPath = "/api/sessions/revoke"
+	// revokeLinkTTL is how long the "this wasn't me" link in a new-login
+	// email keeps working. Each link also works only once.
+	revokeLinkTTL = 24 * time.Hour
+)
+
+// tokenPurposeRevokeSessions marks the token in the "this wasn't me" link.
+const tokenPurposeRevokeSessions = "revoke_sessions"
+
+// loginNotice describes a login for the new-device email. Its fields are
+// copied out of the request, as the email is sent after the handler returns.
+type loginNotice struct {
+	UserID    int64
+	UserAgent string
+	IP        string
+	Location  string
+	Time      time.Time
+	BaseURL   string
+}
+
+// ConfirmRevokeAllSessions opens the "this wasn't me" link from a new-login
+// email. It only asks for confirmation, so mail scanners and link previews
+// that fetch the link don't log the account out; the form posts to
+// RevokeAllSessions.
+func (h *Handlers) ConfirmRevokeAllSessions(c *fiber.Ctx) error {
+	token := strings.TrimSpace(c.Query("token"))
+	if _, err := parseRevokeToken(token); err != nil {
+		return sendRevokeLinkInvalid(c)
+	}
+
+	return sendRevokePage(c, fiber.StatusOK, "Log Out All Devices?",
+		"Every device signed in to your SpeakAllRight account, including this one, will be logged out.",
+		fmt.Sprintf(`<form method="post" action="%s" style="margin:0;"><input type="hidden" name="token" value="%s"><button type="submit" style="padding:12px 24px;border:0;border-radius:8px;background-color:#667eea;color:#ffffff;font-size:16px;font-weight:600;cursor:pointer;">Log out all devices</button></form>`,
+			revokeSessionsPath, html.EscapeString(token)),
+	)
+}
+
+// RevokeAllSessions logs the account out everywhere once the owner confirms
+// the "this wasn't me" link. The link is spent on use.
+func (h *Handlers) RevokeAllSessions(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := parseRevokeToken(strings.TrimSpace(c.FormValue("token")))
+	if err != nil {
+		return sendRevokeLinkInvalid(c)
+	}
+
+	userID, err := h.Sessions.UseRevokeLink(ctx, claims.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		return sendRevokeLinkInvalid(c)
+	}
+	if err != nil {
+		return internalError("failed to check link", err)
+	}
+
+	if _, err := h.Sessions.RevokeSessions(ctx, userID); err != nil {
+		return internalError("failed to revoke sessions", err)
+	}
+
+	return sendRevokePage(c, fiber.StatusOK, "All Devices Logged Out",
+		"All sessions have been logged out. Log in again and review your account.")
+}
+
+// parseRevokeToken checks the token from a "this wasn't me" link. Whether
+// it was already used is only known once it is spent.
+func parseRevokeToken(token string) (*Claims, error) {
+	claims, err := parseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != tokenPurposeRevokeSessions || claims.ID == "" {
+		return nil, errWrongPurpose
+	}
+	return claims, nil
+}
+
+func sendRevokeLinkInvalid(c *fiber.Ctx) error {
+	return sendRevokePage(c, fiber.StatusBadRequest, "Link Invalid or Expired",
+		"This link has expired or has already been used. Log in and end your sessions from your account settings.")
+}
+
+// sendRevokePage replies with a page in the layout of the emails.
+func sendRevokePage(c *fiber.Ctx, status int, heading string, paragraphs ...string) error {
+	c.Type("html")
+	return c.Status(status).SendString(renderNoticeEmail(heading,
+		"You are seeing this because you opened the link in a new-login email.",
+		paragraphs...))
+}
+
+// newLoginNotice returns the details for a new-login email if the request
+// comes from a browser or IP the user hasn't logged in from before. A user's
+// first login is not reported.
+func (h *Handlers) newLoginNotice(c *fiber.Ctx, userID int64) (*loginNotice, error) {
+	ctx := c.UserContext()
+
+	userAgent := c.Get(fiber.HeaderUserAgent)
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	ip := c.IP()
+
+	history, err := h.Sessions.LoginHistory(ctx, userID, userAgent, ip)
+	if err != nil {
+		return nil, err
+	}
+	if !history.HasSessions || (history.KnownAgent && history.KnownIP) {
+		return nil, nil
+	}
+
+	return &loginNotice{
+		UserID:    userID,
+		UserAgent: strings.Clone(userAgent),
+		IP:        strings.Clone(ip),
+		Location:  strings.Clone(approximateLocation(c)),
+		Time:      time.Now().UTC(),
+		BaseURL:   appConfig.Server.PublicAPIURL,
+	}, nil
+}
+
+// sendNewLoginEmail emails the account owner about the login, if they have
+// an email address.
+func (h *Handlers) sendNewLoginEmail(ctx context.Context, notice *loginNotice) error {
+	user, err := h.Users.GetUser(ctx, notice.UserID)
+	if errors.Is(err, store.ErrNotFound) || (err == nil && (user.Deleted || user.Email == "")) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	link, err := h.revokeSessionsURL(ctx, notice)
+	if err != nil {
+		return err
+	}
+
+	when := notice.Time.Format("2 January 2006, 15:04 MST")
+	browser := describeUserAgent(notice.UserAgent)
+	place := notice.IP
+	if notice.Location != "" {
+		place = notice.Location + " (" + notice.IP + ")"
+	}
+
+	htmlContent := renderNoticeEmail(
+		"New Login to Your Account",
+		"You are receiving this because a login came from a device or network we haven't seen on your account before.",
+		"Your SpeakAllRight account was just accessed from a new device or location.",
+		fmt.Sprintf("<strong>Time:</strong> %s<br><strong>Browser:</strong> %s<br><strong>IP address:</strong> %s",
+			html.EscapeString(when), html.EscapeString(browser), html.EscapeString(place)),
+		"If this was you, there's nothing to do.",
+		fmt.Sprintf(`If this wasn't you, <a href="%s" style="color:#667eea;font-weight:600;">log out all devices</a> right away and sign in again to review your account.`,
+			html.EscapeString(link)),
+	)
+	textContent := fmt.Sprintf("SpeakAllRight - New Login to Your Account\n\nYour SpeakAllRight account was just accessed from a new device or location.\n\nTime: %s\nBrowser: %s\nIP address: %s\n\nIf this was you, there's nothing to do.\n\nIf this wasn't you, log out all devices right away:\n%s",
+		when, browser, place, link)
+
+	return sendEmail(ctx, user.Email, "New login to your SpeakAllRight account", htmlContent, textContent)
+}
+
+// revokeSessionsURL returns a new "this wasn't me" link. Its jti is stored
+// so RevokeAllSessions can accept it only once.
+func (h *Handlers) revokeSessionsURL(ctx context.Context, notice *loginNotice) (string, error) {
+	id, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	expiresAt := notice.Time.Add(revokeLinkTTL)
+	if err := h.Sessions.CreateRevokeLink(ctx, id, notice.UserID, expiresAt); err != nil {
+		return "", err
+	}
+
+	claims := Claims{
+		UserID:  notice.UserID,
+		Purpose: tokenPurposeRevokeSessions,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(notice.Time),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(jwtSecret()))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(notice.BaseURL, "/") + revokeSessionsPath + "?token=" + url.QueryEscape(token), nil
+}
+
+// describeUserAgent turns a User-Agent header into something like
+// "Chrome on Windows" for emails.
+func describeUserAgent(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown browser"
+	}
+
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "YaBrowser/"):
+		browser = "Yandex Browser"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	}
+
+	system := ""
+	switch {
+	case strings.Contains(userAgent, "Android"):
+		system = "Android"
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		system = "iOS"
+	case strings.Contains(userAgent, "Windows"):
+		system = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		system = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		system = "Linux"
+	}
+
+	if system == "" {
+		return browser
+	}
+	return browser + " on " + system
+}
@@ -1,13 +1,10 @@
 package handlers
 
 import (
-	"database/sql"
-	"os"
-	"speak/db"
-	"time"
+	"errors"
+	"log/slog"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
 )
 
 type LoginViaEmailVerifyRequest struct {
@@ -15,77 +12,69 @@ type LoginViaEmailVerifyRequest struct {
 	Code  string `json:"code"`
 }
 
-func LoginViaEmailVerify(c *fiber.Ctx) error {
+func (h *Handlers) LoginViaEmailVerify(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
 	var req LoginViaEmailVerifyRequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return apiError(codeInvalidRequest)
 	}
 
+	req.Email = normalizeEmail(req.Email)
 	if req.Email == "" || req.Code == "" {
-		return c.Status(400).JSON(fiber.Map{"error": "Email and code are required"})
+		return fieldRequired("email", "code")
 	}
 
-	// Verify code and check expiration
-	var userID int64
-	var expireTime time.Time
-	err := db.DB.QueryRow(
-		"SELECT user_id, expire_time FROM verifications WHERE email = $1 AND code = $2 AND type = 'email'",
-		req.Email, req.Code,
-	).Scan(&userID, &expireTime)
-
-	if err == sql.ErrNoRows {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid code"})
-	}
+	// Refuse to check codes while the email or client IP is locked out
+	lockKeys := withClientIP(c, lockoutKeyEmail(req.Email))
+	attempt, retryAfter, err := h.takeAttempt(ctx, lockKeys...)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		return internalError("database error", err)
 	}
-
-	// Check if code is expired
-	if time.Now().After(expireTime) {
-		return c.Status(400).JSON(fiber.Map{"error": "Code expired"})
+	if retryAfter > 0 {
+		return tooManyAttempts(c, retryAfter)
 	}
 
-	// Start transaction
-	tx, err := db.DB.Begin()
+	// Verify code and check expiration
+	record, err := h.matchVerificationByEmail(ctx, req.Email, verificationTypeEmail, req.Code)
+	if errors.Is(err, errInvalidCode) {
+		return apiError(codeCodeInvalid)
+	}
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		return internalError("database error", err)
+	}
+	if err := attempt.release(ctx, lockKeys[0]); err != nil {
+		slog.ErrorContext(ctx, "failed to clear lockout", "error", err)
 	}
-	defer tx.Rollback()
+	userID := record.UserID
 
-	// Delete verification
-	_, err = tx.Exec("DELETE FROM verifications WHERE user_id = $1", userID)
+	// A code sent at signup can't be used to skip activating the account;
+	// it stays valid for VerifyEmail
+	ok, err := h.canLogIn(ctx, userID)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		return internalError("failed to fetch user", err)
 	}
-
-	// Commit transaction
-	if err = tx.Commit(); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	if !ok {
+		return apiError(codeCodeInvalid)
 	}
 
-	// Generate JWT token (72 hours)
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "default-secret-key-change-in-production"
+	// Spend the code, so of two requests racing with it only one logs in,
+	// then drop the magic link sent with it
+	if spent, err := h.Verifications.DeleteVerificationByCode(ctx, userID, verificationTypeEmail, record.CodeHash); err != nil {
+		return internalError("database error", err)
+	} else if !spent {
+		return apiError(codeCodeInvalid)
 	}
-
-	claims := Claims{
-		UserID: userID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(72 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+	if err := h.Verifications.DeleteVerifications(ctx, userID, verificationTypeMagicLink); err != nil {
+		return internalError("database error", err)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(jwtSecret))
+	// Issue a session token, or a two-factor challenge if it is enabled
+	result, err := h.loginResult(c, userID)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to generate token"})
+		return internalError("failed to generate token", err)
 	}
 
-	return c.JSON(fiber.Map{
-		"token":  tokenString,
-		"userid": userID,
-	})
+	return c.JSON(result)
 }
 
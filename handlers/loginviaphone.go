@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"speak/sms"
+	"speak/store"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type loginViaPhoneRequest struct {
+	Phone string `json:"phone"`
+}
+
+// LoginViaPhone mirrors LoginViaEmail, texting a code instead of mailing it.
+func (h *Handlers) LoginViaPhone(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	if !sms.Enabled() {
+		return apiError(codeProviderUnavailable)
+	}
+
+	var req loginViaPhoneRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest).wrap(err)
+	}
+
+	if req.Phone == "" {
+		return fieldRequired("phone")
+	}
+
+	phone, err := sms.NormalizePhone(req.Phone)
+	if err != nil {
+		return apiError(codeInvalidPhone)
+	}
+
+	// Lookups count against the client IP, when it is known, and only
+	// lookups of unknown numbers stay counted, so the uniform reply below
+	// can't be used to probe many of them
+	attempt, retryAfter, err := h.takeAttempt(ctx, withClientIP(c)...)
+	if err != nil {
+		return internalError("failed to check lockout", err)
+	}
+	if retryAfter > 0 {
+		return tooManyAttempts(c, retryAfter)
+	}
+
+	// Texts cost money, so logins are throttled like resends
+	if err := h.checkResendLimits(c, phone); err != nil {
+		if err := attempt.release(ctx); err != nil {
+			slog.ErrorContext(ctx, "failed to clear lockout", "error", err)
+		}
+		return err
+	}
+
+	userID, err := h.Users.FindUserByIdentity(ctx, identityProviderPhone, phone)
+	if errors.Is(err, store.ErrNotFound) {
+		// Answer as if a code was sent, so neither the reply nor the resend
+		// limits reveal whether the number has an account
+		if err := h.Verifications.RecordSend(ctx, phone, time.Now()); err != nil {
+			slog.ErrorContext(ctx, "failed to record unknown login", "error", err)
+		}
+		return c.JSON(fiber.Map{"message": "Verification code sent to phone"})
+	}
+	if err != nil {
+		return internalError("failed to fetch user", err)
+	}
+	if err := attempt.release(ctx); err != nil {
+		slog.ErrorContext(ctx, "failed to clear lockout", "error", err)
+	}
+
+	code, err := h.createVerification(ctx, userID, phone, verificationTypeSMS)
+	if err != nil {
+		return internalError("failed to create verification", err)
+	}
+
+	// Text the code after replying, so known numbers answer as quickly as
+	// unknown ones
+	goBackground(func() {
+		if err := sendSMSCode(ctx, phone, code); err != nil {
+			slog.ErrorContext(ctx, "failed to send SMS", "error", err)
+		}
+	})
+
+	return c.JSON(fiber.Map{"message": "Verification code sent to phone"})
+}
+
+func (h *Handlers) LoginViaPhoneVerify(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var req verifyPhoneRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest).wrap(err)
+	}
+
+	if req.Phone == "" || req.Code == "" {
+		return fieldRequired("phone", "code")
+	}
+
+	phone, err := sms.NormalizePhone(req.Phone)
+	if err != nil {
+		return apiError(codeCodeInvalid)
+	}
+
+	lockKeys := withClientIP(c, lockoutKeyPhone(phone))
+	attempt, retryAfter, err := h.takeAttempt(ctx, lockKeys...)
+	if err != nil {
+		return internalError("failed to check lockout", err)
+	}
+	if retryAfter > 0 {
+		return tooManyAttempts(c, retryAfter)
+	}
+
+	record, err := h.matchVerificationByPhone(ctx, phone, strings.TrimSpace(req.Code))
+	if errors.Is(err, errInvalidCode) {
+		return apiError(codeCodeInvalid)
+	}
+	if err != nil {
+		return internalError("failed to fetch verification", err)
+	}
+	if err := attempt.release(ctx, lockKeys[0]); err != nil {
+		slog.ErrorContext(ctx, "failed to clear lockout", "error", err)
+	}
+
+	// A code sent at signup can't be used to skip activating the account;
+	// it stays valid for VerifyPhone
+	ok, err := h.canLogIn(ctx, record.UserID)
+	if err != nil {
+		return internalError("failed to fetch user", err)
+	}
+	if !ok {
+		return apiError(codeCodeInvalid)
+	}
+
+	// Spend the code, so of two requests racing with it only one logs in
+	if spent, err := h.Verifications.DeleteVerificationByCode(ctx, record.UserID, verificationTypeSMS, record.CodeHash); err != nil {
+		return internalError("failed to clear verification", err)
+	} else if !spent {
+		return apiError(codeCodeInvalid)
+	}
+
+	result, err := h.loginResult(c, record.UserID)
+	if err != nil {
+		return internalError("failed to generate token", err)
+	}
+
+	return c.JSON(result)
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"speak/store"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type magicLinkLoginRequest struct {
+	Token string `json:"token"`
+	Nonce string `json:"nonce"`
+}
+
+// MagicLinkLogin completes a login started by LoginViaEmail through the link
+// in the email, as an alternative to typing the code. The link opens the
+// frontend's MagicLinkURL page, which posts its token here together with the
+// login_nonce LoginViaEmail returned to the browser that asked for it, so a
+// forwarded link is useless on another device.
+func (h *Handlers) MagicLinkLogin(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var req magicLinkLoginRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest)
+	}
+
+	req.Token = strings.TrimSpace(req.Token)
+	req.Nonce = strings.TrimSpace(req.Nonce)
+	if req.Token == "" || req.Nonce == "" {
+		return fieldRequired("token", "nonce")
+	}
+
+	lockKeys := withClientIP(c)
+	attempt, retryAfter, err := h.takeAttempt(ctx, lockKeys...)
+	if err != nil {
+		return internalError("failed to check lockout", err)
+	}
+	if retryAfter > 0 {
+		return tooManyAttempts(c, retryAfter)
+	}
+
+	userID, err := h.consumeMagicLink(ctx, req.Token, req.Nonce)
+	if errors.Is(err, errInvalidCode) {
+		return apiError(codeLinkInvalid)
+	}
+	if err != nil {
+		return internalError("failed to verify link", err)
+	}
+	if err := attempt.release(ctx); err != nil {
+		slog.ErrorContext(ctx, "failed to clear lockout", "error", err)
+	}
+
+	result, err := h.loginResult(c, userID)
+	if err != nil {
+		return internalError("failed to generate token", err)
+	}
+
+	return c.JSON(result)
+}
+
+// createMagicLink stores a single-use login link for userID alongside the
+// email code, bound to nonce. It returns the link token; like codes, only
+// hashes of the token and nonce are stored.
+func (h *Handlers) createMagicLink(ctx context.Context, userID int64, email, nonce string) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	if err := h.Verifications.CreateVerification(ctx, &store.Verification{
+		UserID:    userID,
+		Email:     email,
+		Type:      verificationTypeMagicLink,
+		CodeHash:  hashVerificationCode(token),
+		NonceHash: hashVerificationCode(nonce),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(verificationCodeTTL()),
+	}); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// consumeMagicLink checks token and the requesting device's nonce, then
+// deletes the link together with the code it was sent with.
+func (h *Handlers) consumeMagicLink(ctx context.Context, token, nonce string) (int64, error) {
+	if nonce == "" {
+		return 0, errInvalidCode
+	}
+
+	link, err := h.Verifications.FindVerification(ctx, store.VerificationQuery{
+		Type:     verificationTypeMagicLink,
+		CodeHash: hashVerificationCode(token),
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, errInvalidCode
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if link.NonceHash == "" || !hmac.Equal([]byte(hashVerificationCode(nonce)), []byte(link.NonceHash)) {
+		return 0, errInvalidCode
+	}
+
+	// Deleting by the token hash makes the link single-use even when two
+	// requests race past the lookup above.
+	deleted, err := h.Verifications.DeleteVerificationByCode(ctx, link.UserID, verificationTypeMagicLink, link.CodeHash)
+	if err != nil {
+		return 0, err
+	}
+	if !deleted {
+		return 0, errInvalidCode
+	}
+
+	if err := h.Verifications.DeleteVerifications(ctx, link.UserID, verificationTypeEmail); err != nil {
+		return 0, err
+	}
+
+	return link.UserID, nil
+}
+
+// magicLinkURL builds the link mailed to the user on the frontend's
+// MagicLinkURL page, or returns "" when none is configured and logins are
+// by code only.
+func magicLinkURL(token string) string {
+	page := appConfig.Server.MagicLinkURL
+	if page == "" {
+		return ""
+	}
+	return page + "?token=" + url.QueryEscape(token)
+}
+
+func randomToken(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/mail"
+	"strings"
+	"time"
+
+	"speak/metrics"
+	"speak/store"
+	"speak/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+// sendEmail delivers a message, tracing it as an email.send span and
+// counting the outcome for metrics.
+func sendEmail(ctx context.Context, to, subject, htmlContent, textContent string) error {
+	ctx, span := tracing.Tracer.Start(ctx, "email.send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("email.subject", subject)),
+	)
+	defer span.End()
+
+	err := deliverEmail(ctx, to, subject, htmlContent, textContent)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "")
+	}
+	metrics.EmailSent(err)
+	return err
+}
+
+// sendMailScript reads a mailPayload from stdin and hands it to the mail
+// host's local SMTP server. It is passed to python3 -c in single quotes, so
+// it must not contain any.
+const sendMailScript = `
+import json, smtplib, sys
+from email.mime.multipart import MIMEMultipart
+from email.mime.text import MIMEText
+
+m = json.load(sys.stdin)
+
+msg = MIMEMultipart("alternative")
+msg["From"] = "SpeakAllRight <noreply@speakallright.uz>"
+msg["To"] = m["to"]
+msg["Subject"] = m["subject"]
+msg["List-Unsubscribe"] = "<mailto:support@speakallright.uz>"
+msg["X-Entity-Type"] = "transactional"
+
+msg.attach(MIMEText(m["text"], "plain", "utf-8"))
+msg.attach(MIMEText(m["html"], "html", "utf-8"))
+
+s = smtplib.SMTP("localhost", 25)
+s.sendmail("noreply@speakallright.uz", [m["to"]], msg.as_string())
+s.quit()
+`
+
+type mailPayload struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Text    string `json:"text"`
+}
+
+// deliverEmail sends a message through the mail host: it opens an SSH
+// session and hands the message to the local SMTP server there.
+func deliverEmail(ctx context.Context, to, subject, htmlContent, textContent string) error {
+	if !validEmail(to) {
+		return fmt.Errorf("refusing to send to invalid address")
+	}
+
+	mail := appConfig.Mail
+
+	// SSH config
+	sshConfig := &ssh.ClientConfig{
+		User: mail.SSHUser,
+		Auth: []ssh.AuthMethod{
+			ssh.Password(mail.SSHPassword),
+		},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	}
+
+	// Connect to SSH server
+	addr := fmt.Sprintf("%s:%s", mail.SSHHost, mail.SSHPort)
+	_, dialSpan := tracing.Tracer.Start(ctx, "ssh.dial", trace.WithAttributes(attribute.String("server.address", addr)))
+	client, err := ssh.Dial("tcp", addr, sshConfig)
+	dialSpan.End()
+	if err != nil {
+		return fmt.Errorf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	// Create session
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	// The message travels as JSON on stdin, so nothing from it ever
+	// becomes part of the command the shell runs
+	payload, err := json.Marshal(mailPayload{To: to, Subject: subject, HTML: htmlContent, Text: textContent})
+	if err != nil {
+		return err
+	}
+	session.Stdin = bytes.NewReader(payload)
+
+	_, runSpan := tracing.Tracer.Start(ctx, "smtp.send")
+	err = session.Run("python3 -c '" + sendMailScript + "'")
+	runSpan.End()
+	if err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+
+	return nil
+}
+
+// renderEmail wraps body in the branded SpeakAllRight layout. body is raw
+// HTML placed under the heading; footer is a short note above the support
+// link.
+func renderEmail(heading, body, footer string) string {
+	return fmt.Sprintf(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1.0">
+</head>
+<body style="margin:0;padding:0;background-color:#f5f7fa;font-family:-apple-system,BlinkMacSystemFont,'Segoe UI',Roboto,'Helvetica Neue',Arial,sans-serif;">
+<table role="presentation" style="width:100%%;border-collapse:collapse;border-spacing:0;background-color:#f5f7fa;padding:40px 20px;">
+<tr>
+<td align="center" style="padding:0;">
+<table role="presentation" style="max-width:600px;width:100%%;background-color:#ffffff;border-radius:12px;box-shadow:0 2px 8px rgba(0,0,0,0.08);overflow:hidden;">
+<tr>
+<td style="padding:48px 40px;text-align:center;background:linear-gradient(135deg, #667eea 0%%, #764ba2 100%%);">
+<h1 style="margin:0;color:#ffffff;font-size:28px;font-weight:600;letter-spacing:-0.5px;">SpeakAllRight</h1>
+</td>
+</tr>
+<tr>
+<td style="padding:48px 40px;">
+<h2 style="margin:0 0 16px 0;color:#1a202c;font-size:24px;font-weight:600;line-height:1.3;">%s</h2>
+%s
+</td>
+</tr>
+<tr>
+<td style="padding:32px 40px;background-color:#f7fafc;border-top:1px solid #e2e8f0;">
+<p style="margin:0 0 8px 0;color:#718096;font-size:14px;line-height:1.5;">%s</p>
+<p style="margin:16px 0 0 0;color:#718096;font-size:14px;line-height:1.5;">Need help? <a href="mailto:support@speakallright.uz" style="color:#667eea;text-decoration:none;font-weight:500;">Contact Support</a></p>
+</td>
+</tr>
+</table>
+</td>
+</tr>
+</table>
+</body>
+</html>`, heading, body, footer)
+}
+
+// renderCodeEmail renders the body of a verification code email. When link
+// is not empty, a button to sign in with one click is shown under the code.
+func renderCodeEmail(heading, intro, code, link string) string {
+	var button string
+	if link != "" {
+		button = fmt.Sprintf(`<div style="text-align:center;margin:0 0 32px 0;">
+<a href="%s" style="display:inline-block;background-color:#667eea;color:#ffffff;font-size:16px;font-weight:600;text-decoration:none;padding:14px 32px;border-radius:8px;">Log in with one click</a>
+</div>
+`, html.EscapeString(link))
+	}
+
+	return renderEmail(heading, fmt.Sprintf(`<p style="margin:0 0 32px 0;color:#4a5568;font-size:16px;line-height:1.6;">%s</p>
+<div style="background-color:#f7fafc;border:2px dashed #cbd5e0;border-radius:8px;padding:24px;margin:32px 0;text-align:center;">
+<div style="font-size:36px;font-weight:700;color:#667eea;letter-spacing:8px;font-family:'Courier New',monospace;line-height:1.2;">%s</div>
+</div>
+%s<p style="margin:16px 0 0 0;color:#718096;font-size:14px;line-height:1.5;">This code will expire in <strong style="color:#4a5568;">%s</strong> for security reasons.</p>`, intro, code, button, verificationCodeTTLText()), "Didn't request this code? You can safely ignore this email.")
+}
+
+// renderNoticeEmail renders a plain informational email made of paragraphs.
+func renderNoticeEmail(heading, footer string, paragraphs ...string) string {
+	var body strings.Builder
+	for _, p := range paragraphs {
+		fmt.Fprintf(&body, `<p style="margin:0 0 16px 0;color:#4a5568;font-size:16px;line-height:1.6;">%s</p>`+"\n", p)
+	}
+	return renderEmail(heading, body.String(), footer)
+}
+
+// validEmail reports whether s is a bare address such as
+// "jane@example.com": no display name, no angle brackets and no line
+// breaks that could inject headers.
+func validEmail(s string) bool {
+	if s == "" || strings.ContainsAny(s, "\r\n") {
+		return false
+	}
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Name == "" && addr.Address == s
+}
+
+// normalizeEmail returns the form addresses are stored and looked up in:
+// trimmed and lowercased, the same as email identities and lockout keys.
+// Handlers apply it once, as soon as they read an address.
+func normalizeEmail(s string) string {
+	return store.NormalizeSubject(store.ProviderEmail, s)
+}
@@ -0,0 +1,340 @@
+package handlers
+
+import "github.com/gofiber/fiber/v2"
+
+// Error codes returned in the code field of error responses. Clients branch
+// on these, so an existing code must never be renamed or change meaning.
+const (
+	codeInvalidRequest      = "INVALID_REQUEST"
+	codeFieldRequired       = "FIELD_REQUIRED"
+	codeInvalidEmail        = "INVALID_EMAIL"
+	codeInvalidPhone        = "INVALID_PHONE"
+	codeInvalidDate         = "INVALID_DATE"
+	codeDateOutOfRange      = "DATE_OUT_OF_RANGE"
+	codeInvalidName         = "INVALID_NAME"
+	codeUnsupportedLocale   = "UNSUPPORTED_LOCALE"
+	codeUnsupportedProvider = "UNSUPPORTED_PROVIDER"
+	codeInvalidIdentityID   = "INVALID_IDENTITY_ID"
+	codeInvalidQuantity     = "INVALID_QUANTITY"
+	codeInvalidTimeRange    = "INVALID_TIME_RANGE"
+	codeEmailUnchanged      = "EMAIL_UNCHANGED"
+	// codeCodeInvalid also covers expired and exhausted codes, so responses
+	// don't reveal which check failed (see errInvalidCode)
+	codeCodeInvalid         = "CODE_INVALID"
+	codeLinkInvalid         = "LINK_INVALID"
+	codeTwoFactorNotStarted = "TWO_FACTOR_NOT_STARTED"
+	codePromocodeInactive   = "PROMOCODE_INACTIVE"
+
+	codeUnauthorized          = "UNAUTHORIZED"
+	codeTokenMissing          = "TOKEN_MISSING"
+	codeTokenInvalid          = "TOKEN_INVALID"
+	codeTokenExpired          = "TOKEN_EXPIRED"
+	codeSessionRevoked        = "SESSION_REVOKED"
+	codeAccountDeleted        = "ACCOUNT_DELETED"
+	codeGoogleTokenInvalid    = "GOOGLE_TOKEN_INVALID"
+	codeGoogleEmailUnverified = "GOOGLE_EMAIL_UNVERIFIED"
+	codeTelegramDataInvalid   = "TELEGRAM_DATA_INVALID"
+
+	codeAdminRequired     = "ADMIN_REQUIRED"
+	codeTwoFactorRequired = "TWO_FACTOR_REQUIRED"
+	// codeReauthenticationRequired asks the user to sign in again before a
+	// sensitive action they have no code to confirm with
+	codeReauthenticationRequired = "REAUTHENTICATION_REQUIRED"
+
+	codeNotFound          = "NOT_FOUND"
+	codeUserNotFound      = "USER_NOT_FOUND"
+	codeSessionNotFound   = "SESSION_NOT_FOUND"
+	codeIdentityNotFound  = "IDENTITY_NOT_FOUND"
+	codePromocodeNotFound = "PROMOCODE_NOT_FOUND"
+	codeMethodNotAllowed  = "METHOD_NOT_ALLOWED"
+
+	codeEmailTaken              = "EMAIL_TAKEN"
+	codePhoneTaken              = "PHONE_TAKEN"
+	codeIdentityAlreadyLinked   = "IDENTITY_ALREADY_LINKED"
+	codeIdentityLinkedElsewhere = "IDENTITY_LINKED_ELSEWHERE"
+	codeLastLoginMethod         = "LAST_LOGIN_METHOD"
+	codeTwoFactorAlreadyEnabled = "TWO_FACTOR_ALREADY_ENABLED"
+	codePromocodeExists         = "PROMOCODE_EXISTS"
+	codePromocodeAlreadyUsed    = "PROMOCODE_ALREADY_USED"
+
+	codePayloadTooLarge     = "PAYLOAD_TOO_LARGE"
+	codeTooManyAttempts     = "TOO_MANY_ATTEMPTS"
+	codeInternal            = "INTERNAL_ERROR"
+	codeProviderUnavailable = "PROVIDER_UNAVAILABLE"
+)
+
+// defaultLanguage is used when the client accepts none of the languages
+// messages are translated to.
+const defaultLanguage = "en"
+
+// messageLanguages are the languages of errorMessages, matching the locales
+// a profile can choose.
+var messageLanguages = []string{"en", "ru", "uz"}
+
+type errorEntry struct {
+	status   int
+	messages map[string]string
+}
+
+// errorMessages gives each code its status and its message per language.
+var errorMessages = map[string]errorEntry{
+	codeInvalidRequest: {fiber.StatusBadRequest, map[string]string{
+		"en": "Invalid request",
+		"ru": "Некорректный запрос",
+		"uz": "Noto'g'ri so'rov",
+	}},
+	codeFieldRequired: {fiber.StatusBadRequest, map[string]string{
+		"en": "Required fields are missing",
+		"ru": "Не заполнены обязательные поля",
+		"uz": "Majburiy maydonlar to'ldirilmagan",
+	}},
+	codeInvalidEmail: {fiber.StatusBadRequest, map[string]string{
+		"en": "A valid email is required",
+		"ru": "Укажите корректный email",
+		"uz": "To'g'ri email manzilini kiriting",
+	}},
+	codeInvalidPhone: {fiber.StatusBadRequest, map[string]string{
+		"en": "Invalid phone number",
+		"ru": "Некорректный номер телефона",
+		"uz": "Telefon raqami noto'g'ri",
+	}},
+	codeInvalidDate: {fiber.StatusBadRequest, map[string]string{
+		"en": "Invalid date format. Use YYYY-MM-DD",
+		"ru": "Неверный формат даты. Используйте ГГГГ-ММ-ДД",
+		"uz": "Sana formati noto'g'ri. YYYY-MM-DD ko'rinishida kiriting",
+	}},
+	codeDateOutOfRange: {fiber.StatusBadRequest, map[string]string{
+		"en": "Date of birth is out of range",
+		"ru": "Недопустимая дата рождения",
+		"uz": "Tug'ilgan sana ruxsat etilgan oraliqda emas",
+	}},
+	codeInvalidName: {fiber.StatusBadRequest, map[string]string{
+		"en": "Name is empty or too long",
+		"ru": "Имя не заполнено или слишком длинное",
+		"uz": "Ism bo'sh yoki juda uzun",
+	}},
+	codeUnsupportedLocale: {fiber.StatusBadRequest, map[string]string{
+		"en": "Unsupported locale",
+		"ru": "Язык не поддерживается",
+		"uz": "Bu til qo'llab-quvvatlanmaydi",
+	}},
+	codeUnsupportedProvider: {fiber.StatusBadRequest, map[string]string{
+		"en": "Unsupported provider",
+		"ru": "Способ входа не поддерживается",
+		"uz": "Bu kirish usuli qo'llab-quvvatlanmaydi",
+	}},
+	codeInvalidIdentityID: {fiber.StatusBadRequest, map[string]string{
+		"en": "Invalid identity id",
+		"ru": "Некорректный идентификатор способа входа",
+		"uz": "Kirish usuli identifikatori noto'g'ri",
+	}},
+	codeInvalidQuantity: {fiber.StatusBadRequest, map[string]string{
+		"en": "Quantity must be a positive whole number",
+		"ru": "Количество должно быть целым положительным числом",
+		"uz": "Miqdor musbat butun son bo'lishi kerak",
+	}},
+	codeInvalidTimeRange: {fiber.StatusBadRequest, map[string]string{
+		"en": "Invalid start or end time",
+		"ru": "Некорректное время начала или окончания",
+		"uz": "Boshlanish yoki tugash vaqti noto'g'ri",
+	}},
+	codeEmailUnchanged: {fiber.StatusBadRequest, map[string]string{
+		"en": "New email must differ from the current one",
+		"ru": "Новый email должен отличаться от текущего",
+		"uz": "Yangi email joriy emaildan farq qilishi kerak",
+	}},
+	codeCodeInvalid: {fiber.StatusBadRequest, map[string]string{
+		"en": "Invalid or expired code",
+		"ru": "Неверный или просроченный код",
+		"uz": "Kod noto'g'ri yoki muddati o'tgan",
+	}},
+	codeLinkInvalid: {fiber.StatusBadRequest, map[string]string{
+		"en": "Invalid or expired link",
+		"ru": "Недействительная или просроченная ссылка",
+		"uz": "Havola yaroqsiz yoki muddati o'tgan",
+	}},
+	codeTwoFactorNotStarted: {fiber.StatusBadRequest, map[string]string{
+		"en": "Two-factor enrollment has not been started",
+		"ru": "Подключение двухфакторной аутентификации не начато",
+		"uz": "Ikki bosqichli autentifikatsiyani ulash boshlanmagan",
+	}},
+	codePromocodeInactive: {fiber.StatusBadRequest, map[string]string{
+		"en": "Promocode is not active",
+		"ru": "Промокод не активен",
+		"uz": "Promokod faol emas",
+	}},
+
+	codeUnauthorized: {fiber.StatusUnauthorized, map[string]string{
+		"en": "Unauthorized",
+		"ru": "Требуется авторизация",
+		"uz": "Avtorizatsiya talab qilinadi",
+	}},
+	codeTokenMissing: {fiber.StatusUnauthorized, map[string]string{
+		"en": "Missing authorization token",
+		"ru": "Отсутствует токен авторизации",
+		"uz": "Avtorizatsiya tokeni yo'q",
+	}},
+	codeTokenInvalid: {fiber.StatusUnauthorized, map[string]string{
+		"en": "Invalid token",
+		"ru": "Недействительный токен",
+		"uz": "Token yaroqsiz",
+	}},
+	codeTokenExpired: {fiber.StatusUnauthorized, map[string]string{
+		"en": "Token expired",
+		"ru": "Срок действия токена истёк",
+		"uz": "Token muddati tugagan",
+	}},
+	codeSessionRevoked: {fiber.StatusUnauthorized, map[string]string{
+		"en": "Session revoked",
+		"ru": "Сеанс завершён",
+		"uz": "Seans yakunlangan",
+	}},
+	codeAccountDeleted: {fiber.StatusUnauthorized, map[string]string{
+		"en": "Account deleted",
+		"ru": "Аккаунт удалён",
+		"uz": "Hisob o'chirilgan",
+	}},
+	codeGoogleTokenInvalid: {fiber.StatusUnauthorized, map[string]string{
+		"en": "Invalid Google ID token",
+		"ru": "Недействительный токен Google",
+		"uz": "Google tokeni yaroqsiz",
+	}},
+	codeGoogleEmailUnverified: {fiber.StatusUnauthorized, map[string]string{
+		"en": "Google account has no verified email",
+		"ru": "У аккаунта Google нет подтверждённого email",
+		"uz": "Google hisobida tasdiqlangan email yo'q",
+	}},
+	codeTelegramDataInvalid: {fiber.StatusUnauthorized, map[string]string{
+		"en": "Invalid Telegram login data",
+		"ru": "Недействительные данные входа через Telegram",
+		"uz": "Telegram orqali kirish ma'lumotlari yaroqsiz",
+	}},
+
+	codeAdminRequired: {fiber.StatusForbidden, map[string]string{
+		"en": "Admin privileges required",
+		"ru": "Требуются права администратора",
+		"uz": "Administrator huquqlari talab qilinadi",
+	}},
+	codeTwoFactorRequired: {fiber.StatusForbidden, map[string]string{
+		"en": "Two-factor authentication required",
+		"ru": "Требуется двухфакторная аутентификация",
+		"uz": "Ikki bosqichli autentifikatsiya talab qilinadi",
+	}},
+	codeReauthenticationRequired: {fiber.StatusForbidden, map[string]string{
+		"en": "Sign in again to confirm this action",
+		"ru": "Войдите снова, чтобы подтвердить это действие",
+		"uz": "Ushbu amalni tasdiqlash uchun qaytadan kiring",
+	}},
+
+	codeNotFound: {fiber.StatusNotFound, map[string]string{
+		"en": "Not found",
+		"ru": "Не найдено",
+		"uz": "Topilmadi",
+	}},
+	codeUserNotFound: {fiber.StatusNotFound, map[string]string{
+		"en": "User not found",
+		"ru": "Пользователь не найден",
+		"uz": "Foydalanuvchi topilmadi",
+	}},
+	codeSessionNotFound: {fiber.StatusNotFound, map[string]string{
+		"en": "Session not found",
+		"ru": "Сеанс не найден",
+		"uz": "Seans topilmadi",
+	}},
+	codeIdentityNotFound: {fiber.StatusNotFound, map[string]string{
+		"en": "Identity not found",
+		"ru": "Способ входа не найден",
+		"uz": "Kirish usuli topilmadi",
+	}},
+	codePromocodeNotFound: {fiber.StatusNotFound, map[string]string{
+		"en": "Promocode not found",
+		"ru": "Промокод не найден",
+		"uz": "Promokod topilmadi",
+	}},
+	codeMethodNotAllowed: {fiber.StatusMethodNotAllowed, map[string]string{
+		"en": "Method not allowed",
+		"ru": "Метод не поддерживается",
+		"uz": "Bu usulga ruxsat berilmagan",
+	}},
+
+	codeEmailTaken: {fiber.StatusConflict, map[string]string{
+		"en": "Email already registered",
+		"ru": "Этот email уже зарегистрирован",
+		"uz": "Bu email allaqachon ro'yxatdan o'tgan",
+	}},
+	codePhoneTaken: {fiber.StatusConflict, map[string]string{
+		"en": "Phone number already registered",
+		"ru": "Этот номер телефона уже зарегистрирован",
+		"uz": "Bu telefon raqami allaqachon ro'yxatdan o'tgan",
+	}},
+	codeIdentityAlreadyLinked: {fiber.StatusConflict, map[string]string{
+		"en": "Already linked to your account",
+		"ru": "Уже привязано к вашему аккаунту",
+		"uz": "Hisobingizga allaqachon bog'langan",
+	}},
+	codeIdentityLinkedElsewhere: {fiber.StatusConflict, map[string]string{
+		"en": "Already linked to another account",
+		"ru": "Уже привязано к другому аккаунту",
+		"uz": "Boshqa hisobga allaqachon bog'langan",
+	}},
+	codeLastLoginMethod: {fiber.StatusConflict, map[string]string{
+		"en": "Cannot unlink the last login method",
+		"ru": "Нельзя отвязать последний способ входа",
+		"uz": "Oxirgi kirish usulini uzib bo'lmaydi",
+	}},
+	codeTwoFactorAlreadyEnabled: {fiber.StatusConflict, map[string]string{
+		"en": "Two-factor authentication is already enabled",
+		"ru": "Двухфакторная аутентификация уже включена",
+		"uz": "Ikki bosqichli autentifikatsiya allaqachon yoqilgan",
+	}},
+	codePromocodeExists: {fiber.StatusConflict, map[string]string{
+		"en": "Promocode keyword already exists",
+		"ru": "Промокод с таким словом уже существует",
+		"uz": "Bunday promokod allaqachon mavjud",
+	}},
+	codePromocodeAlreadyUsed: {fiber.StatusConflict, map[string]string{
+		"en": "Promocode already activated by this user",
+		"ru": "Вы уже активировали этот промокод",
+		"uz": "Siz bu promokodni allaqachon faollashtirgansiz",
+	}},
+
+	codePayloadTooLarge: {fiber.StatusRequestEntityTooLarge, map[string]string{
+		"en": "Request is too large",
+		"ru": "Слишком большой запрос",
+		"uz": "So'rov hajmi juda katta",
+	}},
+	codeTooManyAttempts: {fiber.StatusTooManyRequests, map[string]string{
+		"en": "Too many attempts. Try again later",
+		"ru": "Слишком много попыток. Попробуйте позже",
+		"uz": "Urinishlar soni juda ko'p. Keyinroq qayta urinib ko'ring",
+	}},
+	codeInternal: {fiber.StatusInternalServerError, map[string]string{
+		"en": "Something went wrong. Please try again later",
+		"ru": "Что-то пошло не так. Попробуйте позже",
+		"uz": "Xatolik yuz berdi. Keyinroq qayta urinib ko'ring",
+	}},
+	codeProviderUnavailable: {fiber.StatusServiceUnavailable, map[string]string{
+		"en": "This sign-in method is not available",
+		"ru": "Этот способ входа недоступен",
+		"uz": "Bu kirish usuli mavjud emas",
+	}},
+}
+
+// clientLanguage picks the message language from the Accept-Language
+// header.
+func clientLanguage(c *fiber.Ctx) string {
+	if lang := c.AcceptsLanguages(messageLanguages...); lang != "" {
+		return lang
+	}
+	return defaultLanguage
+}
+
+// errorMessage returns the message for code in lang, falling back to the
+// default language.
+func errorMessage(code, lang string) string {
+	entry := errorMessages[code]
+	if msg, ok := entry.messages[lang]; ok {
+		return msg
+	}
+	return entry.messages[defaultLanguage]
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"speak/store"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// telegramAuthMaxAge bounds how old a Telegram Login Widget payload may be,
+// so a captured one can't be replayed indefinitely.
+const telegramAuthMaxAge = 24 * time.Hour
+
+type googleAuthRequest struct {
+	IDToken string `json:"id_token"`
+}
+
+type googleClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+	jwt.RegisteredClaims
+}
+
+// errProviderNotConfigured is returned when the credentials a sign-in
+// provider needs are missing from the environment.
+var errProviderNotConfigured = errors.New("provider is not configured")
+
+// GoogleAuth signs a user in with a Google ID token. The user is matched by
+// Google account first, then as the active user with the verified email,
+// and created otherwise.
+func (h *Handlers) GoogleAuth(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var req googleAuthRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest).wrap(err)
+	}
+	if req.IDToken == "" {
+		return fieldRequired("id_token")
+	}
+
+	claims, err := verifyGoogleIDToken(req.IDToken)
+	if errors.Is(err, errProviderNotConfigured) {
+		return apiError(codeProviderUnavailable)
+	}
+	if err != nil {
+		return apiError(codeGoogleTokenInvalid).wrap(err)
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return apiError(codeGoogleEmailUnverified)
+	}
+
+	userID, err := h.Users.FindOrCreateExternalUser(ctx, store.ExternalAccount{
+		Provider:  identityProviderGoogle,
+		Subject:   claims.Subject,
+		Email:     normalizeEmail(claims.Email),
+		FirstName: claims.GivenName,
+		LastName:  claims.FamilyName,
+	})
+	if err != nil {
+		return internalError("failed to sign in with Google", err)
+	}
+
+	result, err := h.loginResult(c, userID)
+	if err != nil {
+		return internalError("failed to generate token", err)
+	}
+
+	return c.JSON(result)
+}
+
+// TelegramAuth signs a user in with data from the Telegram Login Widget,
+// creating the user on first sign-in.
+func (h *Handlers) TelegramAuth(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	telegramID, data, err := verifyTelegramPayload(c.Body())
+	if errors.Is(err, errProviderNotConfigured) {
+		return apiError(codeProviderUnavailable)
+	}
+	if err != nil {
+		return apiError(codeTelegramDataInvalid).wrap(err)
+	}
+
+	userID, err := h.Users.FindOrCreateExternalUser(ctx, store.ExternalAccount{
+		Provider:  identityProviderTelegram,
+		Subject:   strconv.FormatInt(telegramID, 10),
+		FirstName: data["first_name"],
+		LastName:  data["last_name"],
+	})
+	if err != nil {
+		return internalError("failed to sign in with Telegram", err)
+	}
+
+	result, err := h.loginResult(c, userID)
+	if err != nil {
+		return internalError("failed to generate token", err)
+	}
+
+	return c.JSON(result)
+}
+
+// verifyGoogleIDToken checks the signature, audience, issuer and expiry of a
+// Google ID token against the configured client ID.
+func verifyGoogleIDToken(idToken string) (*googleClaims, error) {
+	clientID := appConfig.OAuth.GoogleClientID
+	if clientID == "" {
+		return nil, errProviderNotConfigured
+	}
+
+	claims := &googleClaims{}
+	if _, err := jwt.ParseWithClaims(idToken, claims, googleKeys.keyFunc,
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithAudience(clientID),
+		jwt.WithExpirationRequired(),
+	); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != "accounts.google.com" && claims.Issuer != "https://accounts.google.com" {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+	return claims, nil
+}
+
+// verifyTelegramPayload decodes Login Widget data from a JSON object and
+// checks it against the configured bot token, returning the Telegram user id along
+// with the widget fields.
+func verifyTelegramPayload(body []byte) (int64, map[string]string, error) {
+	botToken := appConfig.OAuth.TelegramBotToken
+	if botToken == "" {
+		return 0, nil, errProviderNotConfigured
+	}
+
+	fields := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return 0, nil, err
+	}
+
+	data := make(map[string]string, len(fields))
+	for key, value := range fields {
+		switch v := value.(type) {
+		case string:
+			data[key] = v
+		case json.Number:
+			data[key] = v.String()
+		}
+	}
+
+	if err := verifyTelegramAuth(data, botToken); err != nil {
+		return 0, nil, err
+	}
+
+	telegramID, err := strconv.ParseInt(data["id"], 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid Telegram user id")
+	}
+	return telegramID, data, nil
+}
+
+// verifyTelegramAuth checks the widget hash as described in
+// https://core.telegram.org/widgets/login#checking-authorization.
+func verifyTelegramAuth(data map[string]string, botToken string) error {
+	hash := data["hash"]
+	if hash == "" {
+		return fmt.Errorf("hash is missing")
+	}
+
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		if key != "hash" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lines = append(lines, key+"="+data[key])
+	}
+
+	secret := sha256.Sum256([]byte(botToken))
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(hash))) {
+		return fmt.Errorf("hash mismatch")
+	}
+
+	authDate, err := strconv.ParseInt(data["auth_date"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid auth_date")
+	}
+	if time.Since(time.Unix(authDate, 0)) > telegramAuthMaxAge {
+		return fmt.Errorf("login data is too old")
+	}
+
+	return nil
+}
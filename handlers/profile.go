@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"speak/store"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const maxNameLength = 100
+
+var supportedLocales = map[string]bool{
+	"uz": true,
+	"ru": true,
+	"en": true,
+}
+
+type updateProfileRequest struct {
+	FirstName   *string `json:"firstname"`
+	LastName    *string `json:"lastname"`
+	DateOfBirth *string `json:"dateofbirth"`
+	Locale      *string `json:"locale"`
+}
+
+type profileResponse struct {
+	UserID      int64  `json:"userid"`
+	Email       string `json:"email,omitempty"`
+	Phone       string `json:"phone,omitempty"`
+	FirstName   string `json:"firstname"`
+	LastName    string `json:"lastname"`
+	DateOfBirth string `json:"dateofbirth,omitempty"`
+	Locale      string `json:"locale"`
+	// CreatedAt is null for accounts made before signup dates were
+	// recorded
+	CreatedAt *time.Time `json:"created_at"`
+	Roles     []string   `json:"roles"`
+	Balance   float64    `json:"balance"`
+}
+
+func (h *Handlers) GetProfile(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
+	if err != nil {
+		return unauthorizedError(err)
+	}
+
+	profile, err := h.fetchProfile(ctx, claims.UserID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return apiError(codeUserNotFound)
+		}
+		return internalError("failed to fetch profile", err)
+	}
+
+	return c.JSON(profile)
+}
+
+func (h *Handlers) UpdateProfile(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
+	if err != nil {
+		return unauthorizedError(err)
+	}
+
+	var req updateProfileRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest).wrap(err)
+	}
+
+	var update store.ProfileUpdate
+
+	if req.FirstName != nil {
+		name, ok := validateName(*req.FirstName)
+		if !ok {
+			return apiError(codeInvalidName).with("fields", []string{"firstname"})
+		}
+		update.FirstName = &name
+	}
+
+	if req.LastName != nil {
+		name, ok := validateName(*req.LastName)
+		if !ok {
+			return apiError(codeInvalidName).with("fields", []string{"lastname"})
+		}
+		update.LastName = &name
+	}
+
+	if req.DateOfBirth != nil {
+		dob, err := time.Parse("2006-01-02", strings.TrimSpace(*req.DateOfBirth))
+		if err != nil {
+			return apiError(codeInvalidDate)
+		}
+		if dob.After(time.Now()) || dob.Year() < 1900 {
+			return apiError(codeDateOutOfRange)
+		}
+		update.DateOfBirth = &dob
+	}
+
+	if req.Locale != nil {
+		value := strings.ToLower(strings.TrimSpace(*req.Locale))
+		if !supportedLocales[value] {
+			return apiError(codeUnsupportedLocale)
+		}
+		update.Locale = &value
+	}
+
+	err = h.Users.UpdateProfile(ctx, claims.UserID, update)
+	if errors.Is(err, store.ErrNotFound) {
+		return apiError(codeUserNotFound)
+	}
+	if err != nil {
+		return internalError("failed to update profile", err)
+	}
+
+	profile, err := h.fetchProfile(ctx, claims.UserID)
+	if err != nil {
+		return internalError("failed to fetch profile", err)
+	}
+
+	return c.JSON(profile)
+}
+
+func (h *Handlers) fetchProfile(ctx context.Context, userID int64) (*profileResponse, error) {
+	user, err := h.Users.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &profileResponse{
+		UserID:    userID,
+		Email:     user.Email,
+		Phone:     user.Phone,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Locale:    user.Locale,
+		CreatedAt: user.CreatedAt,
+	}
+	if user.DateOfBirth != nil {
+		profile.DateOfBirth = user.DateOfBirth.Format("2006-01-02")
+	}
+
+	profile.Roles = []string{"user"}
+	isAdmin, err := h.Users.IsAdmin(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if isAdmin {
+		profile.Roles = append(profile.Roles, "admin")
+	}
+
+	if profile.Balance, err = h.Balances.GetBalance(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+// validateName trims a name and reports whether it is non-empty and at most
+// maxNameLength characters.
+func validateName(value string) (string, bool) {
+	name := strings.TrimSpace(value)
+	if name == "" || utf8.RuneCountInString(name) > maxNameLength {
+		return "", false
+	}
+	return name, true
+}
@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"crypto/rand"
-	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,10 +10,10 @@ import (
 	"strings"
 	"time"
 
-	"speak/db"
+	"speak/metrics"
+	"speak/store"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/lib/pq"
 )
 
 type addPromocodeRequest struct {
@@ -31,15 +30,6 @@ type activatePromocodeRequest struct {
 	Keyword string `json:"promocode"`
 }
 
-type promocodeRecord struct {
-	ID        int64
-	Name      string
-	Quantity  float64
-	IsActive  bool
-	StartTime *time.Time
-	EndTime   *time.Time
-}
-
 type promocodeActivationResponse struct {
 	PromocodeID int64      `json:"promocode_id"`
 	Keyword     string     `json:"keyword"`
@@ -49,66 +39,53 @@ type promocodeActivationResponse struct {
 	EndTime     *time.Time `json:"end_time,omitempty"`
 }
 
-func AddPromocode(c *fiber.Ctx) error {
-	claims, err := getClaimsFromContext(c)
+func (h *Handlers) AddPromocode(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
 	if err != nil {
-		return unauthorizedResponse(c, err)
+		return unauthorizedError(err)
 	}
 
-	isAdmin, err := isUserAdmin(claims.UserID)
+	isAdmin, err := h.Users.IsAdmin(ctx, claims.UserID)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "Failed to verify admin status",
-			"details": err.Error(),
-		})
+		return internalError("failed to verify admin status", err)
 	}
 
 	if !isAdmin {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error": "Admin privileges required",
-		})
+		return apiError(codeAdminRequired)
+	}
+
+	if !claims.hasAMR(amrMFA) {
+		return apiError(codeTwoFactorRequired)
 	}
 
 	var req addPromocodeRequest
 	if err := json.Unmarshal(c.Body(), &req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error":   "Invalid request payload",
-			"details": err.Error(),
-		})
+		return apiError(codeInvalidRequest).wrap(err)
 	}
 
 	name := strings.TrimSpace(req.Name)
 	if name == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Name is required",
-		})
+		return fieldRequired("name")
 	}
 
 	quantityValue, err := parseFlexibleQuantity(req.Quantity)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error":   "Invalid quantity",
-			"details": err.Error(),
-		})
+		return apiError(codeInvalidQuantity).wrap(err)
 	}
 
 	if quantityValue <= 0 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Quantity must be greater than zero",
-		})
+		return apiError(codeInvalidQuantity)
 	}
 
 	if math.IsNaN(quantityValue) || math.IsInf(quantityValue, 0) {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Quantity must be a finite number",
-		})
+		return apiError(codeInvalidQuantity)
 	}
 
 	roundedQuantity := math.Round(quantityValue)
 	if math.Abs(quantityValue-roundedQuantity) > 1e-9 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Quantity must be an integer value",
-		})
+		return apiError(codeInvalidQuantity)
 	}
 	quantityInt := int64(roundedQuantity)
 
@@ -117,10 +94,7 @@ func AddPromocode(c *fiber.Ctx) error {
 		var genErr error
 		keyword, genErr = generatePromocodeKeyword(8)
 		if genErr != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error":   "Failed to generate promocode keyword",
-				"details": genErr.Error(),
-			})
+			return internalError("failed to generate promocode keyword", genErr)
 		}
 	}
 
@@ -131,55 +105,27 @@ func AddPromocode(c *fiber.Ctx) error {
 
 	startTime, endTime, parseErr := resolvePromocodeTimes(req.StartTime, req.EndTime)
 	if parseErr != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error":   "Invalid start or end time",
-			"details": parseErr.Error(),
-		})
+		return apiError(codeInvalidTimeRange).wrap(parseErr)
 	}
 
-	if startTime != nil && endTime != nil {
-		insertNew := `
-			INSERT INTO promocode (name, keyword, start_time, end_time, quantity, created_at)
-			VALUES ($1, $2, $3, $4, $5, NOW())
-		`
-		if _, err := db.DB.Exec(insertNew, name, keyword, *startTime, *endTime, quantityInt); err == nil {
-			activeNow := computePromocodeActive(&promocodeRecord{
-				StartTime: startTime,
-				EndTime:   endTime,
-			})
-			return c.JSON(fiber.Map{
-				"keyword":    keyword,
-				"active":     activeNow,
-				"quantity":   quantityInt,
-				"name":       name,
-				"start_time": startTime.Format(time.RFC3339),
-				"end_time":   endTime.Format(time.RFC3339),
-			})
-		} else if pqErr, ok := err.(*pq.Error); ok {
-			switch pqErr.Code {
-			case "23505":
-				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-					"error": "Promocode keyword already exists",
-				})
-			case "42P01", "42703":
-				// fallback to legacy schema below
-			default:
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error":   "Failed to create promocode",
-					"details": err.Error(),
-				})
-			}
-		} else {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error":   "Failed to create promocode",
-				"details": err.Error(),
-			})
+	promocode := &store.Promocode{
+		Name:      name,
+		Keyword:   keyword,
+		Quantity:  float64(quantityInt),
+		IsActive:  isActive,
+		StartTime: startTime,
+		EndTime:   endTime,
+	}
+	if err := h.Promocodes.CreatePromocode(ctx, promocode); err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			return apiError(codePromocodeExists)
 		}
+		return internalError("failed to create promocode", err)
 	}
 
 	response := fiber.Map{
 		"keyword":  keyword,
-		"active":   isActive,
+		"active":   promocode.IsActive,
 		"quantity": quantityInt,
 		"name":     name,
 	}
@@ -190,41 +136,6 @@ func AddPromocode(c *fiber.Ctx) error {
 		response["end_time"] = endTime.Format(time.RFC3339)
 	}
 
-	legacyQuery := `
-		INSERT INTO promocodes (keyword, quantity, is_active, created_at)
-		VALUES ($1, $2, $3, NOW())
-	`
-	if _, err := db.DB.Exec(legacyQuery, keyword, quantityInt, isActive); err != nil {
-		if pqErr, ok := err.(*pq.Error); ok {
-			switch pqErr.Code {
-			case "23505":
-				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-					"error": "Promocode keyword already exists",
-				})
-			case "42703":
-				if _, retryErr := db.DB.Exec(
-					"INSERT INTO promocodes (keyword, quantity, is_active) VALUES ($1, $2, $3)",
-					keyword, quantityInt, isActive,
-				); retryErr != nil {
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"error":   "Failed to create promocode",
-						"details": retryErr.Error(),
-					})
-				}
-			default:
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error":   "Failed to create promocode",
-					"details": err.Error(),
-				})
-			}
-		} else {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error":   "Failed to create promocode",
-				"details": err.Error(),
-			})
-		}
-	}
-
 	return c.JSON(response)
 }
 
@@ -313,172 +224,45 @@ func parseTimeInput(value string) (time.Time, error) {
 	return time.Time{}, fmt.Errorf("unsupported time format: %s", value)
 }
 
-func ActivatePromocode(c *fiber.Ctx) error {
-	claims, err := getClaimsFromContext(c)
+func (h *Handlers) ActivatePromocode(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
 	if err != nil {
-		return unauthorizedResponse(c, err)
+		return unauthorizedError(err)
 	}
 
 	var req activatePromocodeRequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error":   "Invalid request payload",
-			"details": err.Error(),
-		})
+		return apiError(codeInvalidRequest).wrap(err)
 	}
 
 	keyword := strings.TrimSpace(req.Keyword)
 	if keyword == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Promocode keyword is required",
-		})
+		return fieldRequired("promocode")
 	}
 
-	record, err := findPromocodeByKeyword(keyword)
+	record, err := h.Promocodes.FindPromocode(ctx, keyword)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "Promocode not found",
-			})
+		if errors.Is(err, store.ErrNotFound) {
+			return apiError(codePromocodeNotFound)
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "Failed to fetch promocode",
-			"details": err.Error(),
-		})
+		return internalError("failed to fetch promocode", err)
 	}
 
 	if !record.IsActive {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Promocode is not active",
-		})
+		return apiError(codePromocodeInactive)
 	}
 
-	tx, err := db.DB.Begin()
+	newBalance, err := h.Promocodes.ActivatePromocode(ctx, record, claims.UserID)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "Failed to start transaction",
-			"details": err.Error(),
-		})
-	}
-	defer tx.Rollback()
-
-	var existing int
-	checkPrimary := `
-		SELECT 1 FROM promocode_activation WHERE promocode_id = $1 AND user_id = $2
-	`
-	if err := tx.QueryRow(checkPrimary, record.ID, claims.UserID).Scan(&existing); err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			// no activation yet, continue
-		default:
-			if pqErr, ok := err.(*pq.Error); ok {
-				if pqErr.Code == "42P01" || pqErr.Code == "42703" {
-					fallbackQuery := `
-						SELECT 1 FROM promocode_activations WHERE promocode_id = $1 AND user_id = $2
-					`
-					if fallbackErr := tx.QueryRow(fallbackQuery, record.ID, claims.UserID).Scan(&existing); fallbackErr != nil {
-						if errors.Is(fallbackErr, sql.ErrNoRows) {
-							// still no activation, continue
-						} else {
-							return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-								"error":   "Failed to check legacy promocode activation",
-								"details": fallbackErr.Error(),
-							})
-						}
-					} else {
-						return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-							"error": "Promocode already activated by this user",
-						})
-					}
-				} else {
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"error":   "Failed to check promocode activation",
-						"details": err.Error(),
-					})
-				}
-			} else {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error":   "Failed to check promocode activation",
-					"details": err.Error(),
-				})
-			}
-		}
-	} else {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Promocode already activated by this user",
-		})
-	}
-
-	if err := ensureBalanceRecord(tx, claims.UserID); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "Failed to prepare balance record",
-			"details": err.Error(),
-		})
-	}
-
-	if _, err := tx.Exec(
-		"UPDATE balance SET quantity = quantity + $1 WHERE user_id = $2",
-		record.Quantity, claims.UserID,
-	); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "Failed to update balance",
-			"details": err.Error(),
-		})
-	}
-
-	insertActivation := `
-		INSERT INTO promocode_activation (promocode_id, user_id, enable_time, quantity)
-		VALUES ($1, $2, $3, $4)
-	`
-	now := time.Now().UTC()
-	if _, err := tx.Exec(insertActivation, record.ID, claims.UserID, now, int64(math.Round(record.Quantity))); err != nil {
-		if pqErr, ok := err.(*pq.Error); ok {
-			switch pqErr.Code {
-			case "42703", "42P01":
-				if _, retryErr := tx.Exec(
-					"INSERT INTO promocode_activations (promocode_id, user_id, activated_at) VALUES ($1, $2, $3)",
-					record.ID, claims.UserID, now,
-				); retryErr != nil {
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"error":   "Failed to record promocode activation",
-						"details": retryErr.Error(),
-					})
-				}
-			case "23505":
-				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-					"error": "Promocode already activated by this user",
-				})
-			default:
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error":   "Failed to record promocode activation",
-					"details": err.Error(),
-				})
-			}
-		} else {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error":   "Failed to record promocode activation",
-				"details": err.Error(),
-			})
+		if errors.Is(err, store.ErrAlreadyActivated) {
+			return apiError(codePromocodeAlreadyUsed)
 		}
+		return internalError("failed to activate promocode", err)
 	}
 
-	if err := tx.Commit(); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "Failed to complete activation",
-			"details": err.Error(),
-		})
-	}
-
-	var newBalance float64
-	if err := db.DB.QueryRow(
-		"SELECT quantity FROM balance WHERE user_id = $1",
-		claims.UserID,
-	).Scan(&newBalance); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "Failed to fetch updated balance",
-			"details": err.Error(),
-		})
-	}
+	metrics.PromocodeActivated(record.Quantity)
 
 	return c.JSON(fiber.Map{
 		"message": "Promocode activated successfully",
@@ -486,277 +270,37 @@ func ActivatePromocode(c *fiber.Ctx) error {
 	})
 }
 
-func GetPastPromocodes(c *fiber.Ctx) error {
-	claims, err := getClaimsFromContext(c)
+func (h *Handlers) GetPastPromocodes(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
 	if err != nil {
-		return unauthorizedResponse(c, err)
+		return unauthorizedError(err)
 	}
 
-	activations, err := fetchPromocodeActivations(claims.UserID)
+	activations, err := h.Promocodes.ListPromocodeActivations(ctx, claims.UserID)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   "Failed to fetch promocode activations",
-			"details": err.Error(),
-		})
+		return internalError("failed to fetch promocode activations", err)
 	}
 
 	return c.JSON(fiber.Map{
-		"activations": activations,
+		"activations": newPromocodeActivationResponses(activations),
 	})
 }
 
-var errLegacyPromocodeSchema = errors.New("legacy_promocode_schema")
-
-func fetchPromocodeActivations(userID int64) ([]promocodeActivationResponse, error) {
-	records, err := fetchPromocodeActivationsNew(userID)
-	if err != nil {
-		if errors.Is(err, errLegacyPromocodeSchema) {
-			return fetchPromocodeActivationsLegacy(userID)
-		}
-		return nil, err
-	}
-	return records, nil
-}
-
-func fetchPromocodeActivationsNew(userID int64) ([]promocodeActivationResponse, error) {
-	query := `
-		SELECT pa.promocode_id,
-		       p.keyword,
-		       p.quantity,
-		       pa.enable_time,
-		       p.start_time,
-		       p.end_time
-		FROM promocode_activation pa
-		JOIN promocode p ON p.id = pa.promocode_id
-		WHERE pa.user_id = $1
-		ORDER BY pa.enable_time DESC
-	`
-
-	rows, err := db.DB.Query(query, userID)
-	if err != nil {
-		if pqErr, ok := err.(*pq.Error); ok {
-			switch pqErr.Code {
-			case "42P01", "42703":
-				return nil, errLegacyPromocodeSchema
-			}
-		}
-		return nil, err
-	}
-	defer rows.Close()
-
-	results := []promocodeActivationResponse{}
-	for rows.Next() {
-		var (
-			item      promocodeActivationResponse
-			quantity  interface{}
-			activated sql.NullTime
-			start     sql.NullTime
-			end       sql.NullTime
-		)
-
-		if err := rows.Scan(&item.PromocodeID, &item.Keyword, &quantity, &activated, &start, &end); err != nil {
-			return nil, err
-		}
-
-		q, convErr := normalizeQuantity(quantity)
-		if convErr != nil {
-			return nil, convErr
-		}
-		item.Quantity = q
-
-		if activated.Valid {
-			item.ActivatedAt = &activated.Time
-		}
-		if start.Valid {
-			item.StartTime = &start.Time
-		}
-		if end.Valid {
-			item.EndTime = &end.Time
-		}
-
-		results = append(results, item)
-	}
-
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
-
-	return results, nil
-}
-
-func fetchPromocodeActivationsLegacy(userID int64) ([]promocodeActivationResponse, error) {
-	query := `
-		SELECT pa.promocode_id,
-		       p.keyword,
-		       p.quantity,
-		       pa.activated_at
-		FROM promocode_activations pa
-		JOIN promocodes p ON p.promocode_id = pa.promocode_id
-		WHERE pa.user_id = $1
-		ORDER BY pa.activated_at DESC
-	`
-
-	rows, err := db.DB.Query(query, userID)
-	if err != nil {
-		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "42703" {
-			rows, err = db.DB.Query(`
-				SELECT pa.promocode_id, p.keyword, p.quantity, pa.activated_at
-				FROM promocode_activations pa
-				JOIN promocodes p ON p.id = pa.promocode_id
-				WHERE pa.user_id = $1
-				ORDER BY pa.activated_at DESC
-			`, userID)
-		}
-		if err != nil {
-			return nil, err
-		}
-	}
-	defer rows.Close()
-
-	results := []promocodeActivationResponse{}
-	for rows.Next() {
-		var (
-			item      promocodeActivationResponse
-			quantity  interface{}
-			activated sql.NullTime
-		)
-		if err := rows.Scan(&item.PromocodeID, &item.Keyword, &quantity, &activated); err != nil {
-			return nil, err
-		}
-
-		q, convErr := normalizeQuantity(quantity)
-		if convErr != nil {
-			return nil, convErr
-		}
-		item.Quantity = q
-
-		if activated.Valid {
-			item.ActivatedAt = &activated.Time
-		}
-
-		results = append(results, item)
-	}
-
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
-
-	return results, nil
-}
-
-func findPromocodeByKeyword(keyword string) (*promocodeRecord, error) {
-	record := &promocodeRecord{}
-
-	var (
-		quantity interface{}
-		start    sql.NullTime
-		end      sql.NullTime
-	)
-
-	err := db.DB.QueryRow(
-		"SELECT id, name, quantity, start_time, end_time FROM promocode WHERE keyword = $1",
-		keyword,
-	).Scan(&record.ID, &record.Name, &quantity, &start, &end)
-
-	switch {
-	case err == nil:
-		q, convErr := normalizeQuantity(quantity)
-		if convErr != nil {
-			return nil, convErr
-		}
-		record.Quantity = q
-		if start.Valid {
-			record.StartTime = &start.Time
-		}
-		if end.Valid {
-			record.EndTime = &end.Time
-		}
-		record.IsActive = computePromocodeActive(record)
-		return record, nil
-	case errors.Is(err, sql.ErrNoRows):
-		// continue to legacy lookup
-	default:
-		if pqErr, ok := err.(*pq.Error); ok {
-			switch pqErr.Code {
-			case "42P01", "42703":
-				// legacy lookup below
-			default:
-				return nil, err
-			}
-		} else {
-			return nil, err
-		}
-	}
-
-	legacyQuery := `
-		SELECT promocode_id, quantity, is_active
-		FROM promocodes
-		WHERE keyword = $1
-	`
-	if err := db.DB.QueryRow(legacyQuery, keyword).Scan(&record.ID, &record.Quantity, &record.IsActive); err != nil {
-		if pqErr, ok := err.(*pq.Error); ok {
-			switch pqErr.Code {
-			case "42703":
-				if err := db.DB.QueryRow(
-					"SELECT id, quantity, active FROM promocodes WHERE keyword = $1",
-					keyword,
-				).Scan(&record.ID, &record.Quantity, &record.IsActive); err != nil {
-					return nil, err
-				}
-				return record, nil
-			case "42P01":
-				return nil, fmt.Errorf("promocodes table not found")
-			}
-		}
-		return nil, err
-	}
-
-	return record, nil
-}
-
-func normalizeQuantity(value interface{}) (float64, error) {
-	switch v := value.(type) {
-	case nil:
-		return 0, fmt.Errorf("quantity value is nil")
-	case float64:
-		return v, nil
-	case int64:
-		return float64(v), nil
-	case int32:
-		return float64(v), nil
-	case uint64:
-		return float64(v), nil
-	case []byte:
-		parsed, err := strconv.ParseFloat(string(v), 64)
-		if err != nil {
-			return 0, err
-		}
-		return parsed, nil
-	case string:
-		parsed, err := strconv.ParseFloat(v, 64)
-		if err != nil {
-			return 0, err
-		}
-		return parsed, nil
-	default:
-		return 0, fmt.Errorf("unsupported quantity type %T", value)
-	}
-}
-
-func computePromocodeActive(record *promocodeRecord) bool {
-	if record == nil {
-		return false
-	}
-
-	now := time.Now().UTC()
-	if record.StartTime != nil && now.Before(*record.StartTime) {
-		return false
-	}
-	if record.EndTime != nil && now.After(*record.EndTime) {
-		return false
+func newPromocodeActivationResponses(activations []store.PromocodeActivation) []promocodeActivationResponse {
+	responses := make([]promocodeActivationResponse, 0, len(activations))
+	for _, a := range activations {
+		responses = append(responses, promocodeActivationResponse{
+			PromocodeID: a.PromocodeID,
+			Keyword:     a.Keyword,
+			Quantity:    a.Quantity,
+			ActivatedAt: a.ActivatedAt,
+			StartTime:   a.StartTime,
+			EndTime:     a.EndTime,
+		})
 	}
-
-	return true
+	return responses
 }
 
 func generatePromocodeKeyword(length int) (string, error) {
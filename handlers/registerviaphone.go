@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"speak/sms"
+	"speak/store"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type registerViaPhoneRequest struct {
+	FirstName   string `json:"firstname"`
+	LastName    string `json:"lastname"`
+	DateOfBirth string `json:"dateofbirth"`
+	Phone       string `json:"phone"`
+}
+
+type verifyPhoneRequest struct {
+	Phone string `json:"phone"`
+	Code  string `json:"code"`
+}
+
+// RegisterViaPhone mirrors RegisterViaEmail: it holds the signup as a pending
+// user and texts a code that VerifyPhone confirms.
+func (h *Handlers) RegisterViaPhone(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	if !sms.Enabled() {
+		return apiError(codeProviderUnavailable)
+	}
+
+	var req registerViaPhoneRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest).wrap(err)
+	}
+
+	firstName := strings.TrimSpace(req.FirstName)
+	lastName := strings.TrimSpace(req.LastName)
+	if firstName == "" || lastName == "" || req.DateOfBirth == "" || req.Phone == "" {
+		return fieldRequired("firstname", "lastname", "dateofbirth", "phone")
+	}
+
+	phone, err := sms.NormalizePhone(req.Phone)
+	if err != nil {
+		return apiError(codeInvalidPhone)
+	}
+
+	dob, err := time.Parse("2006-01-02", req.DateOfBirth)
+	if err != nil {
+		return apiError(codeInvalidDate)
+	}
+
+	var existingID int64
+	existing, err := h.Users.FindUserByPhone(ctx, phone)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return internalError("failed to check phone number", err)
+	}
+	if err == nil {
+		if existing.Status != userStatusPending {
+			return apiError(codePhoneTaken)
+		}
+		existingID = existing.ID
+	}
+
+	if taken, err := h.Users.IsIdentityTaken(ctx, identityProviderPhone, phone, existingID); err != nil {
+		return internalError("failed to check phone number", err)
+	} else if taken {
+		return apiError(codePhoneTaken)
+	}
+
+	// Signups count against the client IP, when it is known, until their
+	// number is verified, so looping over numbers can't send texts and
+	// create pending users without bound
+	attempt, retryAfter, err := h.takeAttempt(ctx, signupKeys(c)...)
+	if err != nil {
+		return internalError("failed to check lockout", err)
+	}
+	if retryAfter > 0 {
+		return tooManyAttempts(c, retryAfter)
+	}
+	// Nothing was sent when the signup fails, so it doesn't count
+	failed := func(err error) error {
+		if err := attempt.release(ctx); err != nil {
+			slog.ErrorContext(ctx, "failed to clear lockout", "error", err)
+		}
+		return err
+	}
+
+	if err := h.checkResendLimits(c, phone); err != nil {
+		return failed(err)
+	}
+
+	userID, err := h.Users.SaveSignup(ctx, store.Signup{
+		ID:          existingID,
+		FirstName:   firstName,
+		LastName:    lastName,
+		DateOfBirth: dob,
+		Phone:       phone,
+	})
+	if errors.Is(err, store.ErrConflict) {
+		return failed(apiError(codePhoneTaken))
+	}
+	if err != nil {
+		return failed(internalError("failed to create user", err))
+	}
+
+	code, err := h.createVerification(ctx, userID, phone, verificationTypeSMS)
+	if err != nil {
+		return failed(internalError("failed to create verification", err))
+	}
+
+	if err := sendSMSCode(ctx, phone, code); err != nil {
+		slog.ErrorContext(ctx, "failed to send SMS", "error", err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Verification code sent to phone"})
+}
+
+func (h *Handlers) VerifyPhone(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var req verifyPhoneRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest).wrap(err)
+	}
+
+	if req.Phone == "" || req.Code == "" {
+		return fieldRequired("phone", "code")
+	}
+
+	phone, err := sms.NormalizePhone(req.Phone)
+	if err != nil {
+		return apiError(codeCodeInvalid)
+	}
+
+	lockKeys := withClientIP(c, lockoutKeyPhone(phone))
+	attempt, retryAfter, err := h.takeAttempt(ctx, lockKeys...)
+	if err != nil {
+		return internalError("failed to check lockout", err)
+	}
+	if retryAfter > 0 {
+		return tooManyAttempts(c, retryAfter)
+	}
+
+	record, err := h.matchVerificationByPhone(ctx, phone, strings.TrimSpace(req.Code))
+	if errors.Is(err, errInvalidCode) {
+		return apiError(codeCodeInvalid)
+	}
+	if err != nil {
+		return internalError("failed to fetch verification", err)
+	}
+	if err := attempt.release(ctx, lockKeys[0]); err != nil {
+		slog.ErrorContext(ctx, "failed to clear lockout", "error", err)
+	}
+	userID := record.UserID
+
+	err = h.Users.ActivateUser(ctx, userID, identityProviderPhone, phone, verificationTypeSMS)
+	if errors.Is(err, store.ErrConflict) {
+		return apiError(codePhoneTaken)
+	}
+	if err != nil {
+		return internalError("failed to activate account", err)
+	}
+
+	// The signup is verified, so the attempt RegisterViaPhone counted
+	// against the client IP is given back
+	for _, key := range signupKeys(c) {
+		if err := h.Lockouts.ReturnAttempt(ctx, key, lockoutPolicy); err != nil {
+			slog.ErrorContext(ctx, "failed to clear lockout", "error", err)
+		}
+	}
+
+	result, err := h.loginResult(c, userID)
+	if err != nil {
+		return internalError("failed to generate token", err)
+	}
+
+	return c.JSON(result)
+}
+
+func sendSMSCode(ctx context.Context, phone, code string) error {
+	message := fmt.Sprintf("SpeakAllRight: your verification code is %s. It expires in %s.", code, verificationCodeTTLText())
+	// The text goes out even if the client disconnects, still traced as
+	// part of the request
+	ctx, cancel := backgroundContext(ctx)
+	defer cancel()
+	return sms.Default.Send(ctx, phone, message)
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"speak/logging"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	headerRequestID = "X-Request-ID"
+	// maxRequestIDLength bounds a client-supplied request ID
+	maxRequestIDLength = 128
+	// localsUserID is the c.Locals key holding the authenticated user, for
+	// the access log
+	localsUserID = "user_id"
+)
+
+// RequestID is middleware that tags each request with an ID, taken from the
+// X-Request-ID header when the client or proxy sent a usable one and
+// generated otherwise. The ID is echoed in the response header, added to
+// JSON error bodies and carried by c.UserContext() into every log line.
+func RequestID(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Get(headerRequestID))
+	if !validRequestID(id) {
+		id = newRequestID()
+	} else {
+		id = strings.Clone(id)
+	}
+
+	c.SetUserContext(logging.WithRequestID(c.UserContext(), id))
+	c.Set(headerRequestID, id)
+
+	// Errors are rendered here rather than after the middleware chain
+	// unwinds, so the body can be tagged below and the access log sees the
+	// final status
+	if err := c.Next(); err != nil {
+		if err := c.App().ErrorHandler(c, err); err != nil {
+			return err
+		}
+	}
+
+	if c.Response().StatusCode() >= fiber.StatusBadRequest {
+		tagErrorBody(c, id)
+	}
+	return nil
+}
+
+// AccessLog is middleware that logs one line per request with its status,
+// latency and, once authenticated, the user. It must run after RequestID.
+func AccessLog(c *fiber.Ctx) error {
+	start := time.Now()
+	if err := c.Next(); err != nil {
+		if err := c.App().ErrorHandler(c, err); err != nil {
+			return err
+		}
+	}
+
+	status := c.Response().StatusCode()
+	level := slog.LevelInfo
+	switch {
+	case status >= fiber.StatusInternalServerError:
+		level = slog.LevelError
+	case status >= fiber.StatusBadRequest:
+		level = slog.LevelWarn
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", c.Method()),
+		slog.String("path", c.Path()),
+		slog.Int("status", status),
+		slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+		slog.String("ip", c.IP()),
+		slog.Int("bytes", len(c.Response().Body())),
+	}
+	if userID, ok := c.Locals(localsUserID).(int64); ok {
+		attrs = append(attrs, slog.Int64("user_id", userID))
+	}
+	slog.LogAttrs(c.UserContext(), level, "request", attrs...)
+
+	return nil
+}
+
+// tagErrorBody adds request_id to a JSON object response body.
+func tagErrorBody(c *fiber.Ctx, id string) {
+	if !strings.HasPrefix(string(c.Response().Header.ContentType()), fiber.MIMEApplicationJSON) {
+		return
+	}
+
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(c.Response().Body(), &body); err != nil {
+		return
+	}
+	if _, ok := body["request_id"]; ok {
+		return
+	}
+	body["request_id"], _ = json.Marshal(id)
+
+	if tagged, err := json.Marshal(body); err == nil {
+		c.Response().SetBody(tagged)
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"time"
+
+	"speak/store"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const resendCapWindow = 24 * time.Hour
+
+type resendCodeRequest struct {
+	Email string `json:"email"`
+}
+
+// ResendCode rotates the code of a pending registration or login and mails
+// it again. Codes are only stored hashed, so the old code can't be re-sent;
+// issuing a new one also invalidates the old.
+func (h *Handlers) ResendCode(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var req resendCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest).wrap(err)
+	}
+
+	email := normalizeEmail(req.Email)
+	if email == "" {
+		return fieldRequired("email")
+	}
+	if !validEmail(email) {
+		return apiError(codeInvalidEmail)
+	}
+
+	cooldown := resendCooldown()
+	retryAfter, err := h.resendRetryAfter(ctx, email, cooldown, resendDailyCap())
+	if err != nil {
+		return internalError("failed to check resend limits", err)
+	}
+	if retryAfter > 0 {
+		return tooManyAttempts(c, retryAfter)
+	}
+
+	// Same response whether or not anything was pending for this email
+	response := fiber.Map{
+		"message":     "If a verification is pending, a new code has been sent",
+		"retry_after": int(math.Ceil(cooldown.Seconds())),
+	}
+
+	pending, err := h.Verifications.FindVerification(ctx, store.VerificationQuery{
+		Type:           verificationTypeEmail,
+		Email:          email,
+		IncludeExpired: true,
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return h.replyNothingPending(c, email, response)
+	}
+	if err != nil {
+		return internalError("failed to fetch verification", err)
+	}
+
+	user, err := h.Users.GetUser(ctx, pending.UserID)
+	if errors.Is(err, store.ErrNotFound) {
+		return h.replyNothingPending(c, email, response)
+	}
+	if err != nil {
+		return internalError("failed to fetch user", err)
+	}
+
+	code, err := h.createVerification(ctx, user.ID, email, verificationTypeEmail)
+	if err != nil {
+		return internalError("failed to create verification", err)
+	}
+
+	// The magic link from the original login email stays valid, so only the
+	// code is rotated. The email goes out after replying, so pending
+	// addresses answer as quickly as the rest.
+	signup := user.Status == userStatusPending
+	goBackground(func() {
+		ctx, cancel := backgroundContext(ctx)
+		defer cancel()
+
+		var err error
+		if signup {
+			err = sendVerificationEmail(ctx, email, code)
+		} else {
+			err = sendLoginVerificationEmail(ctx, email, code, "")
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to send email", "error", err)
+		}
+	})
+
+	return c.JSON(response)
+}
+
+// replyNothingPending answers a resend for an email with nothing pending.
+// The request still counts towards the email's resend limits, so a second
+// request within the cooldown is refused just as it is for a pending one.
+func (h *Handlers) replyNothingPending(c *fiber.Ctx, email string, response fiber.Map) error {
+	ctx := c.UserContext()
+	if err := h.Verifications.RecordSend(ctx, email, time.Now()); err != nil {
+		slog.ErrorContext(ctx, "failed to record resend", "error", err)
+	}
+	return c.JSON(response)
+}
+
+// resendRetryAfter returns how long destination (an email or phone number)
+// has to wait before another code may be sent to it, or zero if it may be
+// sent now.
+func (h *Handlers) resendRetryAfter(ctx context.Context, destination string, cooldown time.Duration, dailyCap int) (time.Duration, error) {
+	sent, err := h.Verifications.SendStats(ctx, destination, time.Now().Add(-resendCapWindow))
+	if err != nil {
+		return 0, err
+	}
+
+	var wait time.Duration
+	if sent.Count > 0 {
+		wait = time.Until(sent.Last.Add(cooldown))
+	}
+	if sent.Count >= dailyCap && sent.Count > 0 {
+		if untilFree := time.Until(sent.First.Add(resendCapWindow)); untilFree > wait {
+			wait = untilFree
+		}
+	}
+	if wait < 0 {
+		return 0, nil
+	}
+	return wait, nil
+}
+
+// checkResendLimits rejects a request to send a code to destination while
+// it is in its resend cooldown or over its daily cap. Every endpoint that
+// sends a code calls it first.
+func (h *Handlers) checkResendLimits(c *fiber.Ctx, destination string) error {
+	retryAfter, err := h.resendRetryAfter(c.UserContext(), destination, resendCooldown(), resendDailyCap())
+	if err != nil {
+		return internalError("failed to check resend limits", err)
+	}
+	if retryAfter > 0 {
+		return tooManyAttempts(c, retryAfter)
+	}
+	return nil
+}
+
+// resendCooldown is the minimum wait between codes sent to one email or
+// phone number.
+func resendCooldown() time.Duration {
+	return appConfig.Verification.ResendCooldown
+}
+
+// resendDailyCap is the number of codes an email or phone number may
+// receive per 24 hours.
+func resendDailyCap() int {
+	return appConfig.Verification.ResendDailyCap
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode"
+
+	"speak/store"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	sessionTTL = 72 * time.Hour
+	// sessionTouchInterval limits how often last_seen_at is written, so busy
+	// clients don't turn every request into an UPDATE
+	sessionTouchInterval = time.Minute
+	// sessionRetention keeps revoked and expired sessions around for a while
+	// before cleanup removes them
+	sessionRetention   = 30 * 24 * time.Hour
+	maxUserAgentLength = 512
+)
+
+var errSessionRevoked = errors.New("session has been revoked")
+
+type sessionResponse struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	Location   string    `json:"location,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+func (h *Handlers) ListSessions(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
+	if err != nil {
+		return unauthorizedError(err)
+	}
+
+	sessions, err := h.fetchSessions(ctx, claims.UserID, claims.ID)
+	if err != nil {
+		return internalError("failed to fetch sessions", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"sessions": sessions,
+	})
+}
+
+// RevokeSession logs one of the user's devices out. Tokens for it stop
+// working on their next request.
+func (h *Handlers) RevokeSession(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
+	if err != nil {
+		return unauthorizedError(err)
+	}
+
+	err = h.Sessions.RevokeSession(ctx, claims.UserID, c.Params("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		return apiError(codeSessionNotFound)
+	}
+	if err != nil {
+		return internalError("failed to revoke session", err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Session revoked"})
+}
+
+// createSession records a login from the device making the request and
+// returns the session id carried in the token's jti claim.
+func (h *Handlers) createSession(c *fiber.Ctx, userID int64, expiresAt time.Time) (string, error) {
+	ctx := c.UserContext()
+
+	id, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	userAgent := c.Get(fiber.HeaderUserAgent)
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	err = h.Sessions.CreateSession(ctx, &store.Session{
+		ID:        id,
+		UserID:    userID,
+		UserAgent: userAgent,
+		IP:        c.IP(),
+		Location:  approximateLocation(c),
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// checkSession rejects tokens whose session was revoked and notes that the
+// session is still in use. Tokens issued before sessions were recorded have
+// no id and are accepted until they expire.
+func (h *Handlers) checkSession(ctx context.Context, claims *Claims) error {
+	if claims.ID == "" {
+		return nil
+	}
+
+	session, err := h.Sessions.GetSession(ctx, claims.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		return errSessionRevoked
+	}
+	if err != nil {
+		return err
+	}
+	if session.Revoked || session.UserID != claims.UserID {
+		return errSessionRevoked
+	}
+
+	if time.Since(session.LastSeenAt) > sessionTouchInterval {
+		if err := h.Sessions.TouchSession(ctx, claims.ID); err != nil {
+			slog.ErrorContext(ctx, "failed to update session", "error", err)
+		}
+	}
+	return nil
+}
+
+// fetchSessions lists the user's active sessions, flagging currentID.
+func (h *Handlers) fetchSessions(ctx context.Context, userID int64, currentID string) ([]sessionResponse, error) {
+	sessions, err := h.Sessions.ListSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]sessionResponse, 0, len(sessions))
+	for _, s := range sessions {
+		items = append(items, sessionResponse{
+			ID:         s.ID,
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			Location:   s.Location,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			ExpiresAt:  s.ExpiresAt,
+			Current:    s.ID == currentID,
+		})
+	}
+	return items, nil
+}
+
+// maxCityLength bounds the city name kept from the proxy's header.
+const maxCityLength = 64
+
+// approximateLocation reads the country and city a CDN or reverse proxy
+// attached to the request. The header names default to Cloudflare's. Any
+// client can send these headers itself, so they are only read on requests
+// from a trusted proxy, and only the characters a place name needs are kept.
+func approximateLocation(c *fiber.Ctx) string {
+	if !fromTrustedProxy(c) {
+		return ""
+	}
+
+	var parts []string
+	if city := sanitizeCity(c.Get(appConfig.Server.GeoCityHeader)); city != "" {
+		parts = append(parts, city)
+	}
+	// Cloudflare reports XX for unknown and T1 for Tor
+	if country := strings.TrimSpace(c.Get(appConfig.Server.GeoCountryHeader)); isCountryCode(country) && country != "XX" && country != "T1" {
+		parts = append(parts, country)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// fromTrustedProxy reports whether the request came through one of the
+// configured trusted proxies, so the headers it adds can be believed.
+func fromTrustedProxy(c *fiber.Ctx) bool {
+	return len(appConfig.Server.TrustedProxies) > 0 && c.IsProxyTrusted()
+}
+
+// sanitizeCity keeps the letters, digits, spaces and the few punctuation
+// marks of a place name, collapses runs of spaces and cuts the result to
+// maxCityLength characters.
+func sanitizeCity(city string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range city {
+		if n == maxCityLength {
+			break
+		}
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(".-'", r):
+		case unicode.IsSpace(r):
+			r = ' '
+		default:
+			continue
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// isCountryCode reports whether s is a two-letter ISO 3166 code.
+func isCountryCode(s string) bool {
+	return len(s) == 2 && s[0] >= 'A' && s[0] <= 'Z' && s[1] >= 'A' && s[1] <= 'Z'
+}
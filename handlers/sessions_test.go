@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestListSessions(t *testing.T) {
+	s := newTestServer(t)
+	phone := "+998901234578"
+	s.signUp(t, phone)
+	token := s.logIn(t, phone)["token"].(string)
+
+	status, reply := s.do(t, "GET", "/api/me/sessions", token, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("got %d %v", status, reply)
+	}
+
+	sessions := reply["sessions"].([]any)
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(sessions))
+	}
+	current := 0
+	for _, session := range sessions {
+		if session.(map[string]any)["current"] == true {
+			current++
+		}
+	}
+	if current != 1 {
+		t.Errorf("%d sessions marked current, want 1", current)
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	s := newTestServer(t)
+	phone := "+998901234579"
+	first := s.signUp(t, phone)
+	second := s.logIn(t, phone)["token"].(string)
+
+	claims, err := parseToken(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, reply := s.do(t, "DELETE", "/api/me/sessions/"+claims.ID, second, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("got %d %v", status, reply)
+	}
+
+	status, reply = s.do(t, "GET", "/api/me/sessions", first, nil)
+	expectError(t, status, reply, codeSessionRevoked)
+
+	status, reply = s.do(t, "GET", "/api/me/sessions", second, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("other session: got %d %v", status, reply)
+	}
+}
+
+func TestRevokeSessionOfOtherUser(t *testing.T) {
+	s := newTestServer(t)
+	mine := s.signUp(t, "+998901234580")
+	theirs := s.signUp(t, "+998901234581")
+
+	claims, err := parseToken(theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, reply := s.do(t, "DELETE", "/api/me/sessions/"+claims.ID, mine, nil)
+	expectError(t, status, reply, codeSessionNotFound)
+
+	status, reply = s.do(t, "DELETE", "/api/me/sessions/unknown", mine, nil)
+	expectError(t, status, reply, codeSessionNotFound)
+
+	status, reply = s.do(t, "GET", "/api/me/sessions", theirs, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("other user's session: got %d %v", status, reply)
+	}
+}
+
+func TestRevokeAllSessionsLink(t *testing.T) {
+	s := newTestServer(t)
+	token := s.signUp(t, "+998901234582")
+	claims, err := parseToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := s.h.revokeSessionsURL(context.Background(), &loginNotice{UserID: claims.UserID, Time: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkToken := strings.TrimPrefix(link, revokeSessionsPath+"?token=")
+	linkToken, _ = url.QueryUnescape(linkToken)
+
+	send := func(method, path string, form url.Values) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+		resp, err := s.app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Opening the link only asks for confirmation
+	if status := send("GET", link, nil); status != fiber.StatusOK {
+		t.Fatalf("opening link: got %d", status)
+	}
+	status, reply := s.do(t, "GET", "/api/me/sessions", token, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("session after opening link: got %d %v", status, reply)
+	}
+
+	if status := send("POST", revokeSessionsPath, url.Values{"token": {linkToken}}); status != fiber.StatusOK {
+		t.Fatalf("confirming: got %d", status)
+	}
+	status, reply = s.do(t, "GET", "/api/me/sessions", token, nil)
+	expectError(t, status, reply, codeSessionRevoked)
+
+	// The link works once
+	if status := send("POST", revokeSessionsPath, url.Values{"token": {linkToken}}); status != fiber.StatusBadRequest {
+		t.Errorf("reusing link: got %d, want %d", status, fiber.StatusBadRequest)
+	}
+}
+
+func TestApproximateLocation(t *testing.T) {
+	newTestServer(t)
+	appConfig.Server.GeoCityHeader = "CF-IPCity"
+	appConfig.Server.GeoCountryHeader = "CF-IPCountry"
+
+	locate := func(trusted []string, city, country string) string {
+		t.Helper()
+		appConfig.Server.TrustedProxies = trusted
+		app := fiber.New(fiber.Config{EnableTrustedProxyCheck: true, TrustedProxies: trusted})
+
+		var location string
+		app.Get("/", func(c *fiber.Ctx) error {
+			location = approximateLocation(c)
+			return nil
+		})
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("CF-IPCity", city)
+		req.Header.Set("CF-IPCountry", country)
+		if _, err := app.Test(req); err != nil {
+			t.Fatal(err)
+		}
+		return location
+	}
+
+	if got := locate(nil, "Tashkent", "UZ"); got != "" {
+		t.Errorf("without trusted proxies: got %q, want nothing", got)
+	}
+	if got := locate([]string{"192.0.2.1"}, "Tashkent", "UZ"); got != "" {
+		t.Errorf("from an untrusted address: got %q, want nothing", got)
+	}
+	if got := locate([]string{"0.0.0.0"}, "Tashkent", "UZ"); got != "Tashkent, UZ" {
+		t.Errorf("from a trusted proxy: got %q, want %q", got, "Tashkent, UZ")
+	}
+	if got := locate([]string{"0.0.0.0"}, "<a href=x>Click\there</a>", "Uzbekistan"); got != "a hrefxClick herea" {
+		t.Errorf("markup in the headers: got %q", got)
+	}
+	if got := locate([]string{"0.0.0.0"}, strings.Repeat("a", 200), "UZ"); got != strings.Repeat("a", maxCityLength)+", UZ" {
+		t.Errorf("long city: got %q", got)
+	}
+}
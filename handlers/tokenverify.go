@@ -1,75 +1,46 @@
 package handlers
 
 import (
-	"database/sql"
-	"os"
-	"speak/db"
+	"errors"
+
+	"speak/store"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
 )
 
 type TokenVerifyRequest struct {
 	Token string `json:"token"`
 }
 
-func TokenVerify(c *fiber.Ctx) error {
+func (h *Handlers) TokenVerify(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
 	var req TokenVerifyRequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return apiError(codeInvalidRequest)
 	}
 
 	if req.Token == "" {
-		return c.Status(400).JSON(fiber.Map{"error": "Token is required"})
-	}
-
-	// Get JWT secret
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "default-secret-key-change-in-production"
+		return fieldRequired("token")
 	}
 
-	// Parse and verify token
-	parsedToken, err := jwt.ParseWithClaims(req.Token, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, jwt.ErrSignatureInvalid
-		}
-		return []byte(jwtSecret), nil
-	})
-
+	// Same checks as an authenticated request: signature, expiry, purpose
+	// and a session the user hasn't logged out
+	claims, err := h.parseClaimsFromToken(ctx, req.Token)
 	if err != nil {
-		return c.Status(401).JSON(fiber.Map{"error": "Invalid or expired token"})
-	}
-
-	// Extract claims
-	claims, ok := parsedToken.Claims.(*Claims)
-	if !ok || !parsedToken.Valid {
-		return c.Status(401).JSON(fiber.Map{"error": "Invalid token"})
+		return unauthorizedError(err)
 	}
 
-	// Get user info from database
-	var firstName, lastName sql.NullString
-	err = db.DB.QueryRow(
-		"SELECT first_name, last_name FROM users WHERE user_id = $1",
-		claims.UserID,
-	).Scan(&firstName, &lastName)
-
-	if err == sql.ErrNoRows {
-		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+	user, err := h.Users.GetUser(ctx, claims.UserID)
+	if errors.Is(err, store.ErrNotFound) || (err == nil && user.Deleted) {
+		return apiError(codeUserNotFound)
 	}
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		return internalError("database error", err)
 	}
 
-	// Prepare response
-	response := fiber.Map{}
-	if firstName.Valid {
-		response["firstname"] = firstName.String
-	}
-	if lastName.Valid {
-		response["lastname"] = lastName.String
-	}
-
-	return c.JSON(response)
+	return c.JSON(fiber.Map{
+		"firstname": user.FirstName,
+		"lastname":  user.LastName,
+	})
 }
-
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters per RFC 6238, matching what authenticator apps assume when
+// the provisioning URI leaves them out.
+const (
+	totpIssuer     = "SpeakAllRight"
+	totpPeriod     = 30
+	totpSecretSize = 20
+	// totpSkew accepts codes from one step either side of now, to allow for
+	// clock drift on the phone
+	totpSkew = 1
+)
+
+const (
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() ([]byte, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// totpProvisioningURI returns the otpauth:// URI that authenticator apps
+// read from a QR code.
+func totpProvisioningURI(secret []byte, account string) string {
+	query := url.Values{
+		"secret": {totpEncoding.EncodeToString(secret)},
+		"issuer": {totpIssuer},
+	}
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+account) + "?" + query.Encode()
+}
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// matchTOTP returns the time step code is valid for, or false if it matches
+// none of the steps within the allowed skew.
+func matchTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// generateRecoveryCodes returns single-use codes formatted as xxxx-xxxx.
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	buf := make([]byte, recoveryCodeBytes)
+	for i := 0; i < recoveryCodeCount; i++ {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(buf))
+		codes = append(codes, code[:4]+"-"+code[4:])
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode strips the separator and case so codes can be typed
+// loosely.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// totpKey derives the AES key TOTP secrets are encrypted with from the
+// configured encryption key, falling back to the JWT secret.
+func totpKey() []byte {
+	secret := appConfig.Auth.TOTPEncryptionKey
+	if secret == "" {
+		secret = jwtSecret()
+	}
+	key := sha256.Sum256([]byte(secret))
+	return key[:]
+}
+
+func encryptTOTPSecret(secret []byte) (string, error) {
+	block, err := aes.NewCipher(totpKey())
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, secret, nil)), nil
+}
+
+func decryptTOTPSecret(stored string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(totpKey())
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("stored TOTP secret is too short")
+	}
+
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"speak/store"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type loginTwoFactorRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+// BeginTOTPEnrollment generates a new authenticator secret for the current
+// user. It stays inactive until ConfirmTOTPEnrollment sees a code from it.
+func (h *Handlers) BeginTOTPEnrollment(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
+	if err != nil {
+		return unauthorizedError(err)
+	}
+
+	enabled, err := h.isTwoFactorEnabled(ctx, claims.UserID)
+	if err != nil {
+		return internalError("failed to check two-factor status", err)
+	}
+	if enabled {
+		return apiError(codeTwoFactorAlreadyEnabled)
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return internalError("failed to generate secret", err)
+	}
+	encrypted, err := encryptTOTPSecret(secret)
+	if err != nil {
+		return internalError("failed to generate secret", err)
+	}
+
+	if err := h.TwoFactor.SaveTOTPSecret(ctx, claims.UserID, encrypted); err != nil {
+		return internalError("failed to save secret", err)
+	}
+
+	account, err := h.totpAccountName(ctx, claims.UserID)
+	if err != nil {
+		return internalError("failed to fetch user", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"secret":           totpEncoding.EncodeToString(secret),
+		"provisioning_uri": totpProvisioningURI(secret, account),
+	})
+}
+
+// ConfirmTOTPEnrollment enables two-factor once the user proves their
+// authenticator works. The recovery codes are only ever shown here.
+func (h *Handlers) ConfirmTOTPEnrollment(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
+	if err != nil {
+		return unauthorizedError(err)
+	}
+
+	var req twoFactorCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest).wrap(err)
+	}
+
+	enrollment, err := h.TwoFactor.GetTOTP(ctx, claims.UserID)
+	if errors.Is(err, store.ErrNotFound) {
+		return apiError(codeTwoFactorNotStarted)
+	}
+	if err != nil {
+		return internalError("failed to fetch two-factor settings", err)
+	}
+	if enrollment.Enabled {
+		return apiError(codeTwoFactorAlreadyEnabled)
+	}
+
+	secret, err := decryptTOTPSecret(enrollment.Secret)
+	if err != nil {
+		return internalError("failed to read two-factor settings", err)
+	}
+
+	lockKeys := withClientIP(c, lockoutKeyUser(claims.UserID))
+	attempt, retryAfter, err := h.takeAttempt(ctx, lockKeys...)
+	if err != nil {
+		return internalError("failed to check lockout", err)
+	}
+	if retryAfter > 0 {
+		return tooManyAttempts(c, retryAfter)
+	}
+
+	step, ok := matchTOTP(secret, strings.TrimSpace(req.Code), time.Now())
+	if !ok {
+		return apiError(codeCodeInvalid)
+	}
+	if err := attempt.release(ctx, lockKeys[0]); err != nil {
+		slog.ErrorContext(ctx, "failed to clear lockout", "error", err)
+	}
+
+	recoveryCodes, err := generateRecoveryCodes()
+	if err != nil {
+		return internalError("failed to generate recovery codes", err)
+	}
+	hashes := make([]string, len(recoveryCodes))
+	for i, code := range recoveryCodes {
+		hashes[i] = hashVerificationCode(normalizeRecoveryCode(code))
+	}
+
+	// Enabling checks again that the enrollment is unconfirmed, so two
+	// concurrent confirmations can't both hand out recovery codes
+	err = h.TwoFactor.EnableTOTP(ctx, claims.UserID, step, hashes)
+	if errors.Is(err, store.ErrNotFound) {
+		return apiError(codeTwoFactorNotStarted)
+	}
+	if errors.Is(err, store.ErrConflict) {
+		return apiError(codeTwoFactorAlreadyEnabled)
+	}
+	if err != nil {
+		return internalError("failed to enable two-factor authentication", err)
+	}
+
+	// The code just checked counts as a second factor, so swap the session
+	// for one admin endpoints accept without logging in again
+	tokenString, err := h.issueToken(c, claims.UserID, amrOTP, amrMFA)
+	if err != nil {
+		return internalError("failed to generate token", err)
+	}
+	if claims.ID != "" {
+		if err := h.Sessions.RevokeSession(ctx, claims.UserID, claims.ID); err != nil && !errors.Is(err, store.ErrNotFound) {
+			slog.ErrorContext(ctx, "failed to revoke session", "error", err)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": recoveryCodes,
+		"token":          tokenString,
+	})
+}
+
+// DisableTOTP turns two-factor off. It takes a current authenticator or
+// recovery code so a stolen session token alone can't remove it.
+func (h *Handlers) DisableTOTP(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	claims, err := h.getClaimsFromContext(c)
+	if err != nil {
+		return unauthorizedError(err)
+	}
+
+	var req twoFactorCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest).wrap(err)
+	}
+
+	lockKeys := withClientIP(c, lockoutKeyUser(claims.UserID))
+	attempt, retryAfter, err := h.takeAttempt(ctx, lockKeys...)
+	if err != nil {
+		return internalError("failed to check lockout", err)
+	}
+	if retryAfter > 0 {
+		return tooManyAttempts(c, retryAfter)
+	}
+
+	if _, err := h.checkSecondFactor(ctx, claims.UserID, req.Code); err != nil {
+		if errors.Is(err, errInvalidCode) {
+			return apiError(codeCodeInvalid)
+		}
+		return internalError("failed to check code", err)
+	}
+	if err := attempt.release(ctx, lockKeys[0]); err != nil {
+		slog.ErrorContext(ctx, "failed to clear lockout", "error", err)
+	}
+
+	if err := h.TwoFactor.DeleteTwoFactor(ctx, claims.UserID); err != nil {
+		return internalError("failed to disable two-factor authentication", err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Two-factor authentication disabled"})
+}
+
+// LoginTwoFactor is the second login step for users with two-factor enabled.
+// It exchanges the challenge token from the first step and an authenticator
+// or recovery code for a session token.
+func (h *Handlers) LoginTwoFactor(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var req loginTwoFactorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest).wrap(err)
+	}
+
+	if req.MFAToken == "" || req.Code == "" {
+		return fieldRequired("mfa_token", "code")
+	}
+
+	challenge, err := parseToken(req.MFAToken)
+	if err == nil && challenge.Purpose != tokenPurposeMFA {
+		err = errWrongPurpose
+	}
+	if err != nil {
+		return unauthorizedError(err)
+	}
+	if err := h.ensureAccountActive(ctx, challenge.UserID); err != nil {
+		return unauthorizedError(err)
+	}
+
+	lockKeys := withClientIP(c, lockoutKeyUser(challenge.UserID))
+	attempt, retryAfter, err := h.takeAttempt(ctx, lockKeys...)
+	if err != nil {
+		return internalError("failed to check lockout", err)
+	}
+	if retryAfter > 0 {
+		return tooManyAttempts(c, retryAfter)
+	}
+
+	usedRecovery, err := h.checkSecondFactor(ctx, challenge.UserID, req.Code)
+	if errors.Is(err, errInvalidCode) {
+		return apiError(codeCodeInvalid)
+	}
+	if err != nil {
+		return internalError("failed to check code", err)
+	}
+	if err := attempt.release(ctx, lockKeys[0]); err != nil {
+		slog.ErrorContext(ctx, "failed to clear lockout", "error", err)
+	}
+
+	tokenString, err := h.issueToken(c, challenge.UserID, amrOTP, amrMFA)
+	if err != nil {
+		return internalError("failed to generate token", err)
+	}
+
+	response := fiber.Map{
+		"token":  tokenString,
+		"userid": challenge.UserID,
+	}
+	if usedRecovery {
+		if remaining, err := h.TwoFactor.CountRecoveryCodes(ctx, challenge.UserID); err != nil {
+			slog.ErrorContext(ctx, "failed to count recovery codes", "error", err)
+		} else {
+			response["recovery_codes_remaining"] = remaining
+		}
+	}
+
+	return c.JSON(response)
+}
+
+func (h *Handlers) isTwoFactorEnabled(ctx context.Context, userID int64) (bool, error) {
+	enrollment, err := h.TwoFactor.GetTOTP(ctx, userID)
+	if errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return enrollment.Enabled, nil
+}
+
+// checkSecondFactor accepts either a code from the user's authenticator or
+// one of their unused recovery codes, reporting which it was. Authenticator
+// codes can't be replayed within their time window and recovery codes are
+// spent on use.
+func (h *Handlers) checkSecondFactor(ctx context.Context, userID int64, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+
+	if _, err := strconv.Atoi(code); err == nil && len(code) == 6 {
+		enrollment, err := h.TwoFactor.GetTOTP(ctx, userID)
+		if errors.Is(err, store.ErrNotFound) || (err == nil && !enrollment.Enabled) {
+			return false, errInvalidCode
+		}
+		if err != nil {
+			return false, err
+		}
+
+		secret, err := decryptTOTPSecret(enrollment.Secret)
+		if err != nil {
+			return false, err
+		}
+
+		step, ok := matchTOTP(secret, code, time.Now())
+		if !ok {
+			return false, errInvalidCode
+		}
+
+		fresh, err := h.TwoFactor.UseTOTPStep(ctx, userID, step)
+		if err != nil {
+			return false, err
+		}
+		if !fresh {
+			return false, errInvalidCode
+		}
+		return false, nil
+	}
+
+	spent, err := h.TwoFactor.UseRecoveryCode(ctx, userID, hashVerificationCode(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	if !spent {
+		return false, errInvalidCode
+	}
+	return true, nil
+}
+
+// totpAccountName labels the entry in the authenticator app.
+func (h *Handlers) totpAccountName(ctx context.Context, userID int64) (string, error) {
+	user, err := h.Users.GetUser(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case user.Email != "":
+		return user.Email, nil
+	case user.Phone != "":
+		return user.Phone, nil
+	}
+	return fmt.Sprintf("user %d", userID), nil
+}
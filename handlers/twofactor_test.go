@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// enrollTOTP turns two-factor on for the token's user and returns the
+// authenticator secret, the step of the code used to confirm it, the
+// recovery codes and the session token issued in exchange.
+func (s *testServer) enrollTOTP(t *testing.T, token string) ([]byte, int64, []string, string) {
+	t.Helper()
+
+	status, reply := s.do(t, "POST", "/api/me/2fa/totp", token, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("starting enrollment: got %d %v", status, reply)
+	}
+	secret, err := totpEncoding.DecodeString(reply["secret"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step := time.Now().Unix() / totpPeriod
+	status, reply = s.do(t, "POST", "/api/me/2fa/totp/confirm", token, fiber.Map{"code": totpCode(secret, step)})
+	if status != fiber.StatusOK {
+		t.Fatalf("confirming enrollment: got %d %v", status, reply)
+	}
+
+	var recoveryCodes []string
+	for _, code := range reply["recovery_codes"].([]any) {
+		recoveryCodes = append(recoveryCodes, code.(string))
+	}
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(recoveryCodes), recoveryCodeCount)
+	}
+	return secret, step, recoveryCodes, reply["token"].(string)
+}
+
+func TestConfirmTOTPEnrollment(t *testing.T) {
+	s := newTestServer(t)
+	token := s.signUp(t, "+998901234573")
+
+	status, reply := s.do(t, "POST", "/api/me/2fa/totp/confirm", token, fiber.Map{"code": "123456"})
+	expectError(t, status, reply, codeTwoFactorNotStarted)
+
+	status, reply = s.do(t, "POST", "/api/me/2fa/totp", token, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("starting enrollment: got %d %v", status, reply)
+	}
+	status, reply = s.do(t, "POST", "/api/me/2fa/totp/confirm", token, fiber.Map{"code": "abcdef"})
+	expectError(t, status, reply, codeCodeInvalid)
+}
+
+func TestTOTPEnrollmentReplacesSession(t *testing.T) {
+	s := newTestServer(t)
+	token := s.signUp(t, "+998901234574")
+
+	_, _, _, mfaToken := s.enrollTOTP(t, token)
+
+	status, reply := s.do(t, "GET", "/api/me/sessions", token, nil)
+	expectError(t, status, reply, codeSessionRevoked)
+
+	status, reply = s.do(t, "GET", "/api/me/sessions", mfaToken, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("got %d %v", status, reply)
+	}
+
+	status, reply = s.do(t, "POST", "/api/me/2fa/totp", mfaToken, nil)
+	expectError(t, status, reply, codeTwoFactorAlreadyEnabled)
+}
+
+func TestLoginTwoFactor(t *testing.T) {
+	s := newTestServer(t)
+	phone := "+998901234575"
+	secret, step, _, _ := s.enrollTOTP(t, s.signUp(t, phone))
+
+	reply := s.logIn(t, phone)
+	if reply["mfa_required"] != true || reply["token"] != nil {
+		t.Fatalf("login without second factor: got %v", reply)
+	}
+	challenge := reply["mfa_token"].(string)
+
+	// The challenge isn't a session token
+	status, reply := s.do(t, "GET", "/api/me/sessions", challenge, nil)
+	expectError(t, status, reply, codeTokenInvalid)
+
+	// The code that confirmed enrollment can't be replayed
+	status, reply = s.do(t, "POST", "/api/login/2fa", "", fiber.Map{"mfa_token": challenge, "code": totpCode(secret, step)})
+	expectError(t, status, reply, codeCodeInvalid)
+
+	status, reply = s.do(t, "POST", "/api/login/2fa", "", fiber.Map{"mfa_token": challenge, "code": totpCode(secret, step+1)})
+	if status != fiber.StatusOK || reply["token"] == nil {
+		t.Fatalf("got %d %v", status, reply)
+	}
+}
+
+func TestLoginTwoFactorRecoveryCode(t *testing.T) {
+	s := newTestServer(t)
+	phone := "+998901234576"
+	_, _, recoveryCodes, _ := s.enrollTOTP(t, s.signUp(t, phone))
+
+	challenge := s.logIn(t, phone)["mfa_token"].(string)
+
+	status, reply := s.do(t, "POST", "/api/login/2fa", "", fiber.Map{"mfa_token": challenge, "code": recoveryCodes[0]})
+	if status != fiber.StatusOK || reply["token"] == nil {
+		t.Fatalf("got %d %v", status, reply)
+	}
+	if remaining := reply["recovery_codes_remaining"]; remaining != float64(recoveryCodeCount-1) {
+		t.Errorf("recovery_codes_remaining = %v, want %d", remaining, recoveryCodeCount-1)
+	}
+
+	// Recovery codes are spent on use
+	status, reply = s.do(t, "POST", "/api/login/2fa", "", fiber.Map{"mfa_token": challenge, "code": recoveryCodes[0]})
+	expectError(t, status, reply, codeCodeInvalid)
+}
+
+func TestDisableTOTP(t *testing.T) {
+	s := newTestServer(t)
+	phone := "+998901234577"
+	_, _, recoveryCodes, token := s.enrollTOTP(t, s.signUp(t, phone))
+
+	status, reply := s.do(t, "DELETE", "/api/me/2fa/totp", token, fiber.Map{"code": "wrong-code"})
+	expectError(t, status, reply, codeCodeInvalid)
+
+	status, reply = s.do(t, "DELETE", "/api/me/2fa/totp", token, fiber.Map{"code": recoveryCodes[1]})
+	if status != fiber.StatusOK {
+		t.Fatalf("got %d %v", status, reply)
+	}
+
+	reply = s.logIn(t, phone)
+	if reply["token"] == nil {
+		t.Errorf("login after disabling two-factor: got %v", reply)
+	}
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"speak/store"
+)
+
+// Values of verifications.type. Each flow only accepts codes issued for its
+// own type, so a login code can't confirm an email change and vice versa.
+const (
+	verificationTypeEmail       = "email"
+	verificationTypeEmailChange = "email_change"
+	verificationTypeDeletion    = "account_deletion"
+	verificationTypeDeletionSMS = "account_deletion_sms"
+	verificationTypeMagicLink   = "magic_link"
+	verificationTypeSMS         = "sms"
+	verificationTypeLinkEmail   = "link_email"
+	verificationTypeLinkPhone   = "link_phone"
+)
+
+// maxVerificationAttempts is how many guesses a single code is checked
+// against before it is invalidated and a new one has to be requested.
+const maxVerificationAttempts = 5
+
+// errInvalidCode covers every way a code check can fail (unknown email, wrong
+// code, expired, exhausted) so responses don't reveal which one it was.
+var errInvalidCode = errors.New("invalid or expired code")
+
+type verificationRecord struct {
+	UserID   int64
+	Email    string
+	Phone    string
+	CodeHash string
+	Attempts int
+	Type     string
+}
+
+// createVerification replaces any outstanding verification of the given type
+// for userID with a freshly generated code sent to destination, an email
+// address or, for SMS verifications, a phone number, and counts the send
+// towards its resend limits. Only the code's hash is stored; the plaintext
+// is returned so the caller can send it.
+func (h *Handlers) createVerification(ctx context.Context, userID int64, destination, verificationType string) (string, error) {
+	code, err := generateVerificationCode(verificationCodeLength())
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	v := &store.Verification{
+		UserID:    userID,
+		Type:      verificationType,
+		CodeHash:  hashVerificationCode(code),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(verificationCodeTTL()),
+	}
+	if verificationType == verificationTypeSMS || verificationType == verificationTypeLinkPhone || verificationType == verificationTypeDeletionSMS {
+		v.Phone = destination
+	} else {
+		v.Email = destination
+	}
+	if err := h.Verifications.CreateVerification(ctx, v); err != nil {
+		return "", err
+	}
+
+	if err := h.Verifications.RecordSend(ctx, destination, now); err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+func generateVerificationCode(length int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(length)), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", length, n), nil
+}
+
+// hashVerificationCode returns the keyed hash stored in verifications.code.
+func hashVerificationCode(code string) string {
+	secret := appConfig.Auth.VerificationCodeSecret
+	if secret == "" {
+		secret = jwtSecret()
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verificationCodeLength is the number of digits in a code, between 4 and
+// 10.
+func verificationCodeLength() int {
+	return appConfig.Verification.CodeLength
+}
+
+// verificationCodeTTL is how long a code stays valid.
+func verificationCodeTTL() time.Duration {
+	return appConfig.Verification.CodeTTL
+}
+
+// verificationCodeTTLText describes the code lifetime for emails, e.g.
+// "10 minutes".
+func verificationCodeTTLText() string {
+	minutes := int(verificationCodeTTL().Round(time.Minute) / time.Minute)
+	if minutes <= 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
+
+// matchVerificationByEmail checks code against the latest verification of
+// the given type issued to email.
+func (h *Handlers) matchVerificationByEmail(ctx context.Context, email, verificationType, code string) (*verificationRecord, error) {
+	return h.matchVerification(ctx, store.VerificationQuery{Type: verificationType, Email: email}, code)
+}
+
+// matchVerificationByPhone checks code against the latest SMS verification
+// issued to phone.
+func (h *Handlers) matchVerificationByPhone(ctx context.Context, phone, code string) (*verificationRecord, error) {
+	return h.matchVerification(ctx, store.VerificationQuery{Type: verificationTypeSMS, Phone: phone}, code)
+}
+
+// matchVerificationByUser checks code against the latest verification of
+// the given type issued to userID.
+func (h *Handlers) matchVerificationByUser(ctx context.Context, userID int64, verificationType, code string) (*verificationRecord, error) {
+	return h.matchVerification(ctx, store.VerificationQuery{Type: verificationType, UserID: userID}, code)
+}
+
+// matchVerification spends an attempt on the unexpired verification
+// selected by q and compares its code hash in constant time. Once every
+// attempt is spent the verification matches nothing. The caller deletes it
+// after a successful match.
+func (h *Handlers) matchVerification(ctx context.Context, q store.VerificationQuery, code string) (*verificationRecord, error) {
+	v, err := h.Verifications.UseAttempt(ctx, q, maxVerificationAttempts)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, errInvalidCode
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal([]byte(hashVerificationCode(code)), []byte(v.CodeHash)) {
+		return nil, errInvalidCode
+	}
+
+	record := &verificationRecord{
+		UserID:   v.UserID,
+		Email:    v.Email,
+		Phone:    v.Phone,
+		CodeHash: v.CodeHash,
+		Attempts: v.Attempts,
+		Type:     v.Type,
+	}
+	return record, nil
+}
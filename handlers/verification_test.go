@@ -0,0 +1,409 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"speak/sms"
+	"speak/store"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestVerifyPhoneActivatesAccount(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	phone := "+998901234567"
+
+	status, reply := s.do(t, "POST", "/api/registerviaphone", "", fiber.Map{
+		"firstname":   "Aziz",
+		"lastname":    "Karimov",
+		"dateofbirth": "1990-05-17",
+		"phone":       phone,
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("registering: got %d %v", status, reply)
+	}
+	code := s.sms.lastCode(t, phone)
+
+	user, err := s.store.FindUserByPhone(ctx, phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Status != store.StatusPending {
+		t.Fatalf("status before verifying = %q, want %q", user.Status, store.StatusPending)
+	}
+
+	status, reply = s.do(t, "POST", "/api/verifyphone", "", fiber.Map{"phone": phone, "code": code})
+	if status != fiber.StatusOK || reply["token"] == nil {
+		t.Fatalf("verifying: got %d %v", status, reply)
+	}
+
+	user, err = s.store.GetUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Status != store.StatusActive {
+		t.Errorf("status after verifying = %q, want %q", user.Status, store.StatusActive)
+	}
+	if id, err := s.store.FindUserByIdentity(ctx, store.ProviderPhone, phone); err != nil || id != user.ID {
+		t.Errorf("phone identity = %d, %v; want %d", id, err, user.ID)
+	}
+
+	// The code is spent once it has been used
+	status, reply = s.do(t, "POST", "/api/verifyphone", "", fiber.Map{"phone": phone, "code": code})
+	expectError(t, status, reply, codeCodeInvalid)
+}
+
+func TestSignupCodeCannotLogIn(t *testing.T) {
+	s := newTestServer(t)
+	phone := "+998901234568"
+
+	status, reply := s.do(t, "POST", "/api/registerviaphone", "", fiber.Map{
+		"firstname":   "Aziz",
+		"lastname":    "Karimov",
+		"dateofbirth": "1990-05-17",
+		"phone":       phone,
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("registering: got %d %v", status, reply)
+	}
+
+	status, reply = s.do(t, "POST", "/api/loginviaphoneverify", "", fiber.Map{
+		"phone": phone,
+		"code":  s.sms.lastCode(t, phone),
+	})
+	expectError(t, status, reply, codeCodeInvalid)
+}
+
+func TestLoginViaPhone(t *testing.T) {
+	s := newTestServer(t)
+	phone := "+998901234569"
+	s.signUp(t, phone)
+
+	reply := s.logIn(t, phone)
+	if reply["token"] == nil {
+		t.Fatalf("no token in %v", reply)
+	}
+}
+
+func TestLoginViaPhoneUnknownNumber(t *testing.T) {
+	s := newTestServer(t)
+
+	status, reply := s.do(t, "POST", "/api/loginviaphone", "", fiber.Map{"phone": "+998901234560"})
+	if status != fiber.StatusOK {
+		t.Fatalf("got %d %v, want the same reply as for a known number", status, reply)
+	}
+	WaitForWorkers(context.Background())
+	if len(s.sms.sent) != 0 {
+		t.Errorf("texts sent to an unknown number: %v", s.sms.sent)
+	}
+}
+
+func TestLoginViaPhoneDoesNotWaitForSender(t *testing.T) {
+	s := newTestServer(t)
+	known := "+998901234583"
+	s.signUp(t, known)
+	s.sms.hold(t)
+
+	// Known and unknown numbers both reply before the text goes out, so
+	// response times don't tell them apart
+	for _, phone := range []string{known, "+998901234584"} {
+		req := httptest.NewRequest("POST", "/api/loginviaphone", strings.NewReader(`{"phone": "`+phone+`"}`))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+
+		resp, err := s.app.Test(req, 1000)
+		if err != nil {
+			t.Fatalf("%s: reply waited on the sender: %v", phone, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("%s: got %d", phone, resp.StatusCode)
+		}
+	}
+}
+
+func TestVerificationCodeExhausted(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	phone := "+998901234570"
+	s.signUp(t, phone)
+
+	status, reply := s.do(t, "POST", "/api/loginviaphone", "", fiber.Map{"phone": phone})
+	if status != fiber.StatusOK {
+		t.Fatalf("requesting login code: got %d %v", status, reply)
+	}
+	code := s.sms.lastCode(t, phone)
+
+	for i := 0; i < maxVerificationAttempts; i++ {
+		status, reply := s.do(t, "POST", "/api/loginviaphoneverify", "", fiber.Map{"phone": phone, "code": "000000"})
+		expectError(t, status, reply, codeCodeInvalid)
+	}
+
+	// Lift the lockout so only the code's own attempt limit applies
+	if err := s.store.ClearLockout(ctx, lockoutKeyPhone(phone)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.ClearLockout(ctx, lockoutKeyIP("0.0.0.0")); err != nil {
+		t.Fatal(err)
+	}
+
+	status, reply = s.do(t, "POST", "/api/loginviaphoneverify", "", fiber.Map{"phone": phone, "code": code})
+	expectError(t, status, reply, codeCodeInvalid)
+}
+
+func TestConcurrentGuessesShareAttempts(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	s.store.PutUser(store.User{ID: 100, Email: "aziz@example.com", Status: store.StatusActive}, false)
+	s.store.PutVerification(store.Verification{
+		UserID:    100,
+		Email:     "aziz@example.com",
+		Type:      verificationTypeEmail,
+		CodeHash:  hashVerificationCode("482913"),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(time.Minute),
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4*maxVerificationAttempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.h.matchVerificationByUser(ctx, 100, verificationTypeEmail, "000000")
+		}()
+	}
+	wg.Wait()
+
+	v, err := s.store.FindVerification(ctx, store.VerificationQuery{Type: verificationTypeEmail, UserID: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Attempts != maxVerificationAttempts {
+		t.Errorf("attempts = %d, want %d", v.Attempts, maxVerificationAttempts)
+	}
+	if _, err := s.h.matchVerificationByUser(ctx, 100, verificationTypeEmail, "482913"); !errors.Is(err, errInvalidCode) {
+		t.Errorf("right code after the attempts ran out: got %v, want %v", err, errInvalidCode)
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	s.store.PutUser(store.User{ID: 100, Email: "aziz@example.com", Status: store.StatusPending}, false)
+	s.store.PutVerification(store.Verification{
+		UserID:    100,
+		Email:     "aziz@example.com",
+		Type:      verificationTypeEmail,
+		CodeHash:  hashVerificationCode("482913"),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(time.Minute),
+	})
+
+	status, reply := s.do(t, "POST", "/api/verifyemail", "", fiber.Map{"email": "aziz@example.com", "code": "482913"})
+	if status != fiber.StatusOK || reply["token"] == nil {
+		t.Fatalf("got %d %v", status, reply)
+	}
+
+	user, err := s.store.GetUser(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Status != store.StatusActive {
+		t.Errorf("status = %q, want %q", user.Status, store.StatusActive)
+	}
+	status, reply = s.do(t, "POST", "/api/verifyemail", "", fiber.Map{"email": "aziz@example.com", "code": "482913"})
+	expectError(t, status, reply, codeCodeInvalid)
+}
+
+func TestVerifyEmailExpiredCode(t *testing.T) {
+	s := newTestServer(t)
+	now := time.Now()
+
+	s.store.PutUser(store.User{ID: 100, Email: "aziz@example.com", Status: store.StatusPending}, false)
+	s.store.PutVerification(store.Verification{
+		UserID:    100,
+		Email:     "aziz@example.com",
+		Type:      verificationTypeEmail,
+		CodeHash:  hashVerificationCode("482913"),
+		IssuedAt:  now.Add(-time.Hour),
+		ExpiresAt: now.Add(-time.Minute),
+	})
+
+	status, reply := s.do(t, "POST", "/api/verifyemail", "", fiber.Map{"email": "aziz@example.com", "code": "482913"})
+	expectError(t, status, reply, codeCodeInvalid)
+}
+
+func TestVerifyEmailIgnoresCase(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	s.store.PutUser(store.User{ID: 100, Email: "Aziz@Example.com", Status: store.StatusPending}, false)
+	s.store.PutVerification(store.Verification{
+		UserID:    100,
+		Email:     "Aziz@Example.com",
+		Type:      verificationTypeEmail,
+		CodeHash:  hashVerificationCode("482913"),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(time.Minute),
+	})
+
+	// Misses count against the one key however the address is written
+	status, reply := s.do(t, "POST", "/api/verifyemail", "", fiber.Map{"email": "AZIZ@example.com", "code": "000000"})
+	expectError(t, status, reply, codeCodeInvalid)
+	if attempt, err := s.store.TakeAttempt(ctx, lockoutKeyEmail("aziz@example.com"), lockoutPolicy); err != nil || attempt.Attempts != 2 {
+		t.Errorf("attempts on the address = %d, %v; want 2", attempt.Attempts, err)
+	}
+
+	status, reply = s.do(t, "POST", "/api/verifyemail", "", fiber.Map{"email": " aziz@EXAMPLE.com ", "code": "482913"})
+	if status != fiber.StatusOK || reply["token"] == nil {
+		t.Fatalf("got %d %v", status, reply)
+	}
+}
+
+func TestResendCodeUnknownEmail(t *testing.T) {
+	s := newTestServer(t)
+	appConfig.Verification.ResendCooldown = time.Minute
+	now := time.Now()
+
+	s.store.PutUser(store.User{ID: 100, Email: "aziz@example.com", Status: store.StatusPending}, false)
+	s.store.PutVerification(store.Verification{
+		UserID:    100,
+		Email:     "aziz@example.com",
+		Type:      verificationTypeEmail,
+		CodeHash:  hashVerificationCode("482913"),
+		IssuedAt:  now.Add(-time.Hour),
+		ExpiresAt: now.Add(-time.Minute),
+	})
+
+	// The cooldown applies whether or not anything is pending, so it
+	// doesn't reveal which addresses have signed up
+	statuses := func(email string) []int {
+		var got []int
+		for i := 0; i < 2; i++ {
+			status, _ := s.do(t, "POST", "/api/resendcode", "", fiber.Map{"email": email})
+			got = append(got, status)
+		}
+		return got
+	}
+	pending, unknown := statuses("aziz@example.com"), statuses("nobody@example.com")
+	if pending[0] != fiber.StatusOK || pending[1] != fiber.StatusTooManyRequests {
+		t.Fatalf("pending email: got %v, want [200 429]", pending)
+	}
+	if unknown[0] != pending[0] || unknown[1] != pending[1] {
+		t.Errorf("unknown email: got %v, want %v as for a pending one", unknown, pending)
+	}
+}
+
+func TestMagicLinkNeedsNonce(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	s.store.PutUser(store.User{ID: 100, Email: "aziz@example.com", Status: store.StatusActive}, false)
+	token, err := s.h.createMagicLink(ctx, 100, "aziz@example.com", "browser-nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A forwarded link doesn't work without the nonce of the browser that
+	// asked for it
+	status, reply := s.do(t, "POST", "/api/login/magic", "", fiber.Map{"token": token, "nonce": "other-nonce"})
+	expectError(t, status, reply, codeLinkInvalid)
+
+	status, reply = s.do(t, "POST", "/api/login/magic", "", fiber.Map{"token": token, "nonce": "browser-nonce"})
+	if status != fiber.StatusOK || reply["token"] == nil {
+		t.Fatalf("got %d %v", status, reply)
+	}
+
+	// The link works once
+	status, reply = s.do(t, "POST", "/api/login/magic", "", fiber.Map{"token": token, "nonce": "browser-nonce"})
+	expectError(t, status, reply, codeLinkInvalid)
+}
+
+func TestRegisterViaEmailTrimsNames(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	status, reply := s.do(t, "POST", "/api/registerviaemail", "", fiber.Map{
+		"firstname":   "  ",
+		"lastname":    "Karimov",
+		"dateofbirth": "1990-05-17",
+		"email":       "aziz@example.com",
+	})
+	expectError(t, status, reply, codeFieldRequired)
+
+	status, reply = s.do(t, "POST", "/api/registerviaemail", "", fiber.Map{
+		"firstname":   " Aziz ",
+		"lastname":    "\tKarimov ",
+		"dateofbirth": "1990-05-17",
+		"email":       "aziz@example.com",
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("registering: got %d %v", status, reply)
+	}
+
+	// Stored the way RegisterViaPhone stores them
+	user, err := s.store.FindUserByEmail(ctx, "aziz@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.FirstName != "Aziz" || user.LastName != "Karimov" {
+		t.Errorf("names = %q %q, want %q %q", user.FirstName, user.LastName, "Aziz", "Karimov")
+	}
+}
+
+func TestPhoneSignInDisabled(t *testing.T) {
+	s := newTestServer(t)
+	sms.Default = sms.DisabledSender{}
+
+	status, reply := s.do(t, "POST", "/api/registerviaphone", "", fiber.Map{
+		"firstname":   "Aziz",
+		"lastname":    "Karimov",
+		"dateofbirth": "1990-05-17",
+		"phone":       "+998901234586",
+	})
+	expectError(t, status, reply, codeProviderUnavailable)
+
+	status, reply = s.do(t, "POST", "/api/loginviaphone", "", fiber.Map{"phone": "+998901234586"})
+	expectError(t, status, reply, codeProviderUnavailable)
+}
+
+func TestLoginCodeSpentOnce(t *testing.T) {
+	s := newTestServer(t)
+	phone := "+998901234587"
+	s.signUp(t, phone)
+
+	status, reply := s.do(t, "POST", "/api/loginviaphone", "", fiber.Map{"phone": phone})
+	if status != fiber.StatusOK {
+		t.Fatalf("requesting login code: got %d %v", status, reply)
+	}
+	code := s.sms.lastCode(t, phone)
+
+	// Of requests racing with the right code only one logs in
+	statuses := make(chan int, 4)
+	for i := 0; i < cap(statuses); i++ {
+		go func() {
+			status, _ := s.do(t, "POST", "/api/loginviaphoneverify", "", fiber.Map{"phone": phone, "code": code})
+			statuses <- status
+		}()
+	}
+	ok := 0
+	for i := 0; i < cap(statuses); i++ {
+		if <-statuses == fiber.StatusOK {
+			ok++
+		}
+	}
+	if ok != 1 {
+		t.Errorf("%d logins with one code, want 1", ok)
+	}
+}
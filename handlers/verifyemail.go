@@ -1,10 +1,9 @@
 package handlers
 
 import (
-	"database/sql"
-	"os"
-	"speak/db"
-	"time"
+	"errors"
+	"log/slog"
+	"speak/store"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
@@ -17,85 +16,66 @@ type VerifyEmailRequest struct {
 
 type Claims struct {
 	UserID int64 `json:"userid"`
+	// AMR lists how the user authenticated (RFC 8176); "mfa" is present once
+	// a second factor has been checked
+	AMR []string `json:"amr,omitempty"`
+	// Purpose marks restricted tokens, such as the two-factor challenge,
+	// that must not be accepted as a session
+	Purpose string `json:"purpose,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func VerifyEmail(c *fiber.Ctx) error {
+func (h *Handlers) VerifyEmail(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
 	var req VerifyEmailRequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return apiError(codeInvalidRequest)
 	}
 
+	req.Email = normalizeEmail(req.Email)
 	if req.Email == "" || req.Code == "" {
-		return c.Status(400).JSON(fiber.Map{"error": "Email and code are required"})
+		return fieldRequired("email", "code")
 	}
 
-	// Verify code and check expiration
-	var userID int64
-	var expireTime time.Time
-	err := db.DB.QueryRow(
-		"SELECT user_id, expire_time FROM verifications WHERE email = $1 AND code = $2 AND type = 'email'",
-		req.Email, req.Code,
-	).Scan(&userID, &expireTime)
-
-	if err == sql.ErrNoRows {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid code"})
-	}
+	// Refuse to check codes while the email or client IP is locked out
+	lockKeys := withClientIP(c, lockoutKeyEmail(req.Email))
+	attempt, retryAfter, err := h.takeAttempt(ctx, lockKeys...)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		return internalError("database error", err)
 	}
-
-	// Check if code is expired
-	if time.Now().After(expireTime) {
-		return c.Status(400).JSON(fiber.Map{"error": "Code expired"})
-	}
-
-	// Start transaction
-	tx, err := db.DB.Begin()
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	if retryAfter > 0 {
+		return tooManyAttempts(c, retryAfter)
 	}
-	defer tx.Rollback()
 
-	// Update user email
-	_, err = tx.Exec("UPDATE users SET email = $1 WHERE user_id = $2", req.Email, userID)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to update email"})
+	// Verify code and check expiration
+	record, err := h.matchVerificationByEmail(ctx, req.Email, verificationTypeEmail, req.Code)
+	if errors.Is(err, errInvalidCode) {
+		return apiError(codeCodeInvalid)
 	}
-
-	// Delete verification
-	_, err = tx.Exec("DELETE FROM verifications WHERE user_id = $1", userID)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		return internalError("database error", err)
 	}
-
-	// Commit transaction
-	if err = tx.Commit(); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	if err := attempt.release(ctx, lockKeys[0]); err != nil {
+		slog.ErrorContext(ctx, "failed to clear lockout", "error", err)
 	}
+	userID := record.UserID
 
-	// Generate JWT token (72 hours)
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "default-secret-key-change-in-production"
+	// Activate the account, record the email as a verified login method and
+	// spend the code
+	err = h.Users.ActivateUser(ctx, userID, identityProviderEmail, req.Email, verificationTypeEmail)
+	if errors.Is(err, store.ErrConflict) {
+		return apiError(codeEmailTaken)
 	}
-
-	claims := Claims{
-		UserID: userID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(72 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+	if err != nil {
+		return internalError("database error", err)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(jwtSecret))
+	// Issue a session token, or a two-factor challenge if it is enabled
+	result, err := h.loginResult(c, userID)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to generate token"})
+		return internalError("failed to generate token", err)
 	}
 
-	return c.JSON(fiber.Map{
-		"token":  tokenString,
-		"userid": userID,
-	})
+	return c.JSON(result)
 }
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// workers tracks goroutines that outlive the request that started them, so
+// shutdown can wait for them before the database is closed.
+var workers sync.WaitGroup
+
+// goBackground runs fn in a tracked goroutine.
+func goBackground(fn func()) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		fn()
+	}()
+}
+
+// WaitForWorkers blocks until every background goroutine has returned or
+// ctx is done, whichever comes first. Long-running workers such as the
+// cleanup loop only return once the context they were started with is
+// cancelled.
+func WaitForWorkers(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// heartbeat is the last time a periodic worker finished a pass.
+type heartbeat struct {
+	interval time.Duration
+	last     time.Time
+}
+
+var (
+	heartbeatsMu sync.Mutex
+	heartbeats   = map[string]*heartbeat{}
+)
+
+// registerWorker starts tracking the heartbeat of a worker that runs every
+// interval. It counts as alive from the moment it is registered.
+func registerWorker(name string, interval time.Duration) {
+	heartbeatsMu.Lock()
+	defer heartbeatsMu.Unlock()
+	heartbeats[name] = &heartbeat{interval: interval, last: time.Now()}
+}
+
+// beat records that the named worker just finished a pass.
+func beat(name string) {
+	heartbeatsMu.Lock()
+	defer heartbeatsMu.Unlock()
+	if hb, ok := heartbeats[name]; ok {
+		hb.last = time.Now()
+	}
+}
+
+// workerHeartbeats returns a copy of every registered worker's heartbeat.
+func workerHeartbeats() map[string]heartbeat {
+	heartbeatsMu.Lock()
+	defer heartbeatsMu.Unlock()
+	out := make(map[string]heartbeat, len(heartbeats))
+	for name, hb := range heartbeats {
+		out[name] = *hb
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// secretKeys are attribute keys whose values are never logged.
+var secretKeys = map[string]bool{
+	"code":          true,
+	"otp":           true,
+	"token":         true,
+	"password":      true,
+	"secret":        true,
+	"authorization": true,
+	"recovery_code": true,
+	// text is the body of an SMS, which carries a one-time code
+	"text": true,
+}
+
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// redactAttr hides secrets outright, masks attributes holding emails and
+// phone numbers, and masks email addresses embedded in any other string or
+// error, such as a mail server's rejection message.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	switch {
+	case secretKeys[key]:
+		return slog.String(a.Key, redacted)
+	case key == "email":
+		return slog.String(a.Key, MaskEmail(a.Value.String()))
+	case key == "phone":
+		return slog.String(a.Key, MaskPhone(a.Value.String()))
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, maskEmails(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, maskEmails(err.Error()))
+		}
+	}
+	return a
+}
+
+// MaskEmail keeps the first character of the local part and the domain:
+// "jane@example.com" becomes "j***@example.com".
+func MaskEmail(email string) string {
+	at := strings.LastIndexByte(email, '@')
+	if at <= 0 {
+		return redacted
+	}
+	return email[:1] + "***" + email[at:]
+}
+
+// MaskPhone keeps the last two digits: "+998901234567" becomes
+// "***67".
+func MaskPhone(phone string) string {
+	if len(phone) <= 2 {
+		return redacted
+	}
+	return "***" + phone[len(phone)-2:]
+}
+
+func maskEmails(s string) string {
+	if !strings.Contains(s, "@") {
+		return s
+	}
+	return emailPattern.ReplaceAllStringFunc(s, MaskEmail)
+}
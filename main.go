@@ -1,48 +1,373 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"speak/config"
 	"speak/db"
 	"speak/handlers"
+	"speak/logging"
+	"speak/metrics"
+	"speak/sms"
+	"speak/store"
+	"speak/tracing"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/joho/godotenv"
+	"golang.org/x/crypto/acme/autocert"
 )
 // ok
 func main() {
-	// Load .env file
-	if err := godotenv.Load(".env"); err != nil {
-		log.Printf("Warning: Could not load .env file: %v", err)
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to an optional YAML config file")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration with secrets redacted and exit")
+	healthcheck := flag.Bool("healthcheck", false, "probe /readyz on the configured listen address and exit non-zero unless ready")
+	flag.Parse()
+
+	// Load configuration from the YAML file, .env and the environment
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal("Failed to load configuration:", err)
+	}
+
+	if *printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal("Failed to print configuration:", err)
+		}
+		if err := cfg.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *healthcheck {
+		if err := probeReadiness(cfg.Server); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	logging.Setup(os.Stdout, cfg.Log)
+	for _, warning := range cfg.Warnings() {
+		slog.Warn("unsafe configuration", "problem", warning)
+	}
+	handlers.Configure(cfg)
+
+	// Export traces of requests, queries and emails
+	flushTraces, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		fatal("failed to set up tracing", err)
 	}
 
 	// Initialize database
-	if err := db.Init(); err != nil {
-		log.Fatal("Failed to connect to database:", err)
+	if err := db.Init(cfg.Database); err != nil {
+		fatal("failed to connect to database", err)
+	}
+
+	// Apply pending schema migrations
+	if err := db.Migrate(); err != nil {
+		fatal("failed to migrate database", err)
+	}
+
+	// Initialize SMS delivery
+	if err := sms.Init(cfg.SMS); err != nil {
+		fatal("failed to configure SMS delivery", err)
+	}
+
+	metrics.RegisterDB(db.DB, cfg.Database.Name)
+
+	// Background workers run until shutdown begins
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	pg := store.NewPostgres(db.DB)
+	h := &handlers.Handlers{
+		Users:         pg,
+		Sessions:      pg,
+		Verifications: pg,
+		Lockouts:      pg,
+		TwoFactor:     pg,
+		Balances:      pg,
+		Promocodes:    pg,
 	}
-	defer db.DB.Close()
 
-	app := fiber.New()
+	// Purge abandoned signups, expired lockouts and stale sessions
+	h.StartCleanup(workerCtx)
+
+	app := fiber.New(fiber.Config{
+		// Render every error as {"error", "code"} without internal details
+		ErrorHandler: handlers.ErrorHandler,
+		// Take the client IP from the proxy header only on requests that
+		// come from a trusted proxy
+		ProxyHeader:             cfg.Server.ProxyHeader,
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          cfg.Server.TrustedProxies,
+		EnableIPValidation:      true,
+	})
+
+	// Probes are routed ahead of the middleware so checks every few seconds
+	// stay out of the access log, metrics and traces
+	app.Get("/healthz", h.Healthz)
+	app.Get("/readyz", h.Readyz)
+
+	// Tag every request with an ID, log it once it completes and trace it
+	app.Use(handlers.RequestID)
+	app.Use(handlers.AccessLog)
+	app.Use(tracing.Middleware)
+	app.Use(metrics.Middleware)
 
 	// Configure CORS to allow requests from frontend
 	app.Use(cors.New(cors.Config{
-		AllowOrigins:     "http://localhost,http://localhost:80,http://localhost:8000,http://62.171.170.236,http://62.171.170.236:80,http://62.171.170.236:8080,https://speakallright.uz,https://www.speakallright.uz",
-		AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS",
-		AllowHeaders:     "Origin,Content-Type,Accept,Authorization",
-		AllowCredentials: true,
+		AllowOrigins:     strings.Join(cfg.Server.CORSOrigins, ","),
+		AllowMethods:     strings.Join(cfg.Server.CORSMethods, ","),
+		AllowHeaders:     strings.Join(cfg.Server.CORSHeaders, ","),
+		AllowCredentials: cfg.Server.CORSAllowCredentials,
 	}))
 
-	app.Get("/api/alive", handlers.Alive)
-	app.Post("/api/registerviaemail", handlers.RegisterViaEmail)
-	app.Post("/api/verifyemail", handlers.VerifyEmail)
-	app.Post("/api/loginviaemail", handlers.LoginViaEmail)
-	app.Post("/api/loginviaemailverify", handlers.LoginViaEmailVerify)
-	app.Post("/api/tokenverify", handlers.TokenVerify)
-	app.Get("/api/getbalance", handlers.GetBalance)
-	app.Get("/api/verifyadmin", handlers.VerifyAdmin)
-	app.Post("/api/addpromocode", handlers.AddPromocode)
-	app.Post("/api/activatepromocode", handlers.ActivatePromocode)
-	app.Get("/api/getpastpromocodes", handlers.GetPastPromocodes)
-
-	app.Listen(":3000")
+	// Bound each request's database work by DB_QUERY_TIMEOUT
+	app.Use(handlers.RequestDeadline)
+
+	app.Get("/api/alive", h.Alive)
+	app.Post("/api/registerviaemail", h.RegisterViaEmail)
+	app.Post("/api/verifyemail", h.VerifyEmail)
+	app.Post("/api/loginviaemail", h.LoginViaEmail)
+	app.Post("/api/loginviaemailverify", h.LoginViaEmailVerify)
+	app.Post("/api/registerviaphone", h.RegisterViaPhone)
+	app.Post("/api/verifyphone", h.VerifyPhone)
+	app.Post("/api/loginviaphone", h.LoginViaPhone)
+	app.Post("/api/loginviaphoneverify", h.LoginViaPhoneVerify)
+	app.Post("/api/auth/google", h.GoogleAuth)
+	app.Post("/api/auth/telegram", h.TelegramAuth)
+	app.Post("/api/tokenverify", h.TokenVerify)
+	app.Post("/api/resendcode", h.ResendCode)
+	app.Post("/api/login/magic", h.MagicLinkLogin)
+	app.Post("/api/login/2fa", h.LoginTwoFactor)
+	app.Get("/api/sessions/revoke", h.ConfirmRevokeAllSessions)
+	app.Post("/api/sessions/revoke", h.RevokeAllSessions)
+	app.Get("/api/getbalance", h.GetBalance)
+	app.Get("/api/verifyadmin", h.VerifyAdmin)
+	app.Post("/api/addpromocode", h.AddPromocode)
+	app.Post("/api/activatepromocode", h.ActivatePromocode)
+	app.Get("/api/getpastpromocodes", h.GetPastPromocodes)
+	app.Get("/api/me", h.GetProfile)
+	app.Patch("/api/me", h.UpdateProfile)
+	app.Post("/api/me/email", h.RequestEmailChange)
+	app.Post("/api/me/email/verify", h.VerifyEmailChange)
+	app.Get("/api/me/identities", h.ListIdentities)
+	app.Post("/api/me/identities", h.LinkIdentity)
+	app.Post("/api/me/identities/verify", h.VerifyIdentity)
+	app.Delete("/api/me/identities/:id", h.UnlinkIdentity)
+	app.Get("/api/me/sessions", h.ListSessions)
+	app.Delete("/api/me/sessions/:id", h.RevokeSession)
+	app.Post("/api/me/2fa/totp", h.BeginTOTPEnrollment)
+	app.Post("/api/me/2fa/totp/confirm", h.ConfirmTOTPEnrollment)
+	app.Delete("/api/me/2fa/totp", h.DisableTOTP)
+	app.Post("/api/me/export", h.ExportAccount)
+	app.Post("/api/me/delete", h.RequestAccountDeletion)
+	app.Delete("/api/me", h.DeleteAccount)
+
+	metricsServer := serveMetrics(app, cfg.Metrics)
+
+	// Docker stops the container with SIGTERM; Ctrl+C sends SIGINT
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- listen(app, cfg.Server)
+	}()
+
+	select {
+	case err := <-listenErr:
+		// The server never came up or died on its own; there is nothing to
+		// drain, but the workers and the pool still need stopping
+		stopWorkers()
+		handlers.WaitForWorkers(context.Background())
+		db.DB.Close()
+		flushTraces(context.Background())
+		fatal("server stopped", err)
+	case <-signals.Done():
+		stopSignals()
+		slog.Info("shutting down", "timeout", cfg.Server.ShutdownTimeout)
+		shutdown(app, metricsServer, stopWorkers, flushTraces, cfg.Server.ShutdownTimeout)
+	}
+}
+
+// shutdown stops accepting connections and lets in-flight requests finish,
+// then stops the background workers and waits for them, closes the database
+// pool and finally flushes buffered spans. All of it shares a single
+// deadline of timeout.
+func shutdown(app *fiber.App, metricsServer *http.Server, stopWorkers context.CancelFunc, flushTraces func(context.Context) error, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := app.ShutdownWithContext(ctx); err != nil {
+		slog.Error("failed to drain connections", "error", err)
+	}
+	if metricsServer != nil {
+		metricsServer.Shutdown(ctx)
+	}
+
+	stopWorkers()
+	if err := handlers.WaitForWorkers(ctx); err != nil {
+		slog.Error("background work still running at shutdown", "error", err)
+	}
+
+	if err := db.DB.Close(); err != nil {
+		slog.Error("failed to close database", "error", err)
+	}
+	if err := flushTraces(ctx); err != nil {
+		slog.Error("failed to flush traces", "error", err)
+	}
+	slog.Info("shutdown complete")
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// serveMetrics exposes /metrics on its own address when one is configured,
+// returning that server, or on app behind the bearer token otherwise.
+func serveMetrics(app *fiber.App, cfg config.Metrics) *http.Server {
+	switch {
+	case cfg.Addr != "":
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		server := &http.Server{Addr: cfg.Addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("metrics server stopped", "error", err)
+			}
+		}()
+		return server
+	case cfg.Token != "":
+		app.Get("/metrics", metrics.FiberHandler(cfg.Token))
+	default:
+		slog.Info("metrics endpoint disabled, set METRICS_ADDR or METRICS_TOKEN to enable it")
+	}
+	return nil
+}
+
+// probeReadiness asks the server listening on cfg.Addr in this container
+// for /readyz, over TLS when the server serves TLS. It lets the container
+// healthcheck follow LISTEN_ADDR instead of hard-coding a port. The server's
+// certificate is verified like any client would.
+func probeReadiness(cfg config.Server) error {
+	host, port, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", cfg.Addr, err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	scheme := "http"
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.TLSCertFile != "" || cfg.TLSAutocertDir != "" {
+		scheme = "https"
+		transport.TLSClientConfig, err = probeTLSConfig(cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	resp, err := client.Get(scheme + "://" + net.JoinHostPort(host, port) + "/readyz")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("not ready: status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// probeTLSConfig checks the server against the certificate it is configured
+// with: the one in TLSCertFile, or a publicly trusted one for the first
+// autocert host. The probe dials localhost, so the name to check comes from
+// the configuration rather than the URL.
+func probeTLSConfig(cfg config.Server) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" {
+		// --healthcheck runs before Validate, so nothing has checked this yet
+		if len(cfg.TLSAutocertHosts) == 0 {
+			return nil, fmt.Errorf("TLS_AUTOCERT_HOSTS is required with TLS_AUTOCERT_DIR")
+		}
+		return &tls.Config{ServerName: cfg.TLSAutocertHosts[0]}, nil
+	}
+
+	data, err := os.ReadFile(cfg.TLSCertFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	var leaf *x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in %s: %w", cfg.TLSCertFile, err)
+		}
+		if leaf == nil {
+			leaf = cert
+		}
+		roots.AddCert(cert)
+	}
+	if leaf == nil {
+		return nil, fmt.Errorf("no certificate in %s", cfg.TLSCertFile)
+	}
+
+	// Any name on the certificate will do; a wildcard needs a label
+	serverName := "localhost"
+	switch {
+	case len(leaf.DNSNames) > 0:
+		serverName = strings.Replace(leaf.DNSNames[0], "*", "healthcheck", 1)
+	case len(leaf.IPAddresses) > 0:
+		serverName = leaf.IPAddresses[0].String()
+	}
+	return &tls.Config{RootCAs: roots, ServerName: serverName}, nil
+}
+
+// listen serves app on the configured address, over TLS when a certificate
+// or an autocert cache directory is configured.
+func listen(app *fiber.App, cfg config.Server) error {
+	switch {
+	case cfg.TLSCertFile != "":
+		return app.ListenTLS(cfg.Addr, cfg.TLSCertFile, cfg.TLSKeyFile)
+	case cfg.TLSAutocertDir != "":
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cfg.TLSAutocertDir),
+			HostPolicy: autocert.HostWhitelist(cfg.TLSAutocertHosts...),
+		}
+		ln, err := tls.Listen("tcp", cfg.Addr, manager.TLSConfig())
+		if err != nil {
+			return err
+		}
+		return app.Listener(ln)
+	default:
+		return app.Listen(cfg.Addr)
+	}
 }
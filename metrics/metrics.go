@@ -0,0 +1,146 @@
+// Package metrics defines the Prometheus metrics the service exports and
+// the handlers that serve them.
+package metrics
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "speak"
+
+// Registry holds every metric below plus the Go runtime and process
+// collectors.
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route and status.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method, route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	emailsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "emails_sent_total",
+		Help:      "Emails handed to the mail server, by result.",
+	}, []string{"result"})
+
+	promocodeActivations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "promocode_activations_total",
+		Help:      "Promocodes activated by users.",
+	})
+
+	balanceCredited = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "balance_credited_total",
+		Help:      "Balance granted to users through promocodes.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		emailsSent,
+		promocodeActivations,
+		balanceCredited,
+	)
+}
+
+// RegisterDB exports the connection pool statistics of db.
+func RegisterDB(db *sql.DB, name string) {
+	Registry.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// EmailSent counts an attempt to send an email.
+func EmailSent(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	emailsSent.WithLabelValues(result).Inc()
+}
+
+// PromocodeActivated counts an activation that credited quantity to a
+// balance.
+func PromocodeActivated(quantity float64) {
+	promocodeActivations.Inc()
+	balanceCredited.Add(quantity)
+}
+
+// statusCoder is implemented by errors that carry the status they are
+// rendered with, such as handlers.APIError.
+type statusCoder interface {
+	StatusCode() int
+}
+
+// Middleware records the count and latency of each request under its
+// route pattern, so /api/me/sessions/:id is one series rather than one per
+// session. Requests that match no route are grouped as "unmatched".
+func Middleware(c *fiber.Ctx) error {
+	start := time.Now()
+	err := c.Next()
+
+	status := c.Response().StatusCode()
+	route := c.Route().Path
+	var sc statusCoder
+	var fe *fiber.Error
+	switch {
+	case errors.As(err, &sc):
+		status = sc.StatusCode()
+	case errors.As(err, &fe):
+		status = fe.Code
+		// The router reports a request no route matched with these
+		if fe.Code == fiber.StatusNotFound || fe.Code == fiber.StatusMethodNotAllowed {
+			route = "unmatched"
+		}
+	case err != nil:
+		status = fiber.StatusInternalServerError
+	}
+
+	labels := []string{c.Method(), route, strconv.Itoa(status)}
+	httpRequests.WithLabelValues(labels...).Inc()
+	httpDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+
+	return err
+}
+
+// Handler serves the registry in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// FiberHandler serves the registry from the main app, requiring
+// "Authorization: Bearer <token>".
+func FiberHandler(token string) fiber.Handler {
+	serve := adaptor.HTTPHandler(Handler())
+	return func(c *fiber.Ctx) error {
+		given, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		return serve(c)
+	}
+}
@@ -0,0 +1,143 @@
+package sms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultEskizBaseURL = "https://notify.eskiz.uz"
+
+// EskizSender sends messages through the Eskiz HTTP API. It logs in with the
+// account credentials on first use and again whenever the token is rejected.
+type EskizSender struct {
+	baseURL  string
+	email    string
+	password string
+	from     string
+	client   *http.Client
+
+	mu    sync.Mutex
+	token string
+}
+
+func NewEskizSender(baseURL, email, password, from string) (*EskizSender, error) {
+	if email == "" || password == "" {
+		return nil, fmt.Errorf("missing Eskiz credentials: ESKIZ_EMAIL and ESKIZ_PASSWORD are required")
+	}
+	if baseURL == "" {
+		baseURL = defaultEskizBaseURL
+	}
+	if from == "" {
+		from = "4546"
+	}
+
+	return &EskizSender{
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		email:    email,
+		password: password,
+		from:     from,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *EskizSender) Send(ctx context.Context, phone, message string) error {
+	token, err := s.authToken(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	status, body, err := s.send(ctx, token, phone, message)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusUnauthorized {
+		if token, err = s.authToken(ctx, true); err != nil {
+			return err
+		}
+		if status, body, err = s.send(ctx, token, phone, message); err != nil {
+			return err
+		}
+	}
+
+	if status < 200 || status >= 300 {
+		return fmt.Errorf("eskiz send failed with status %d: %s", status, body)
+	}
+	return nil
+}
+
+func (s *EskizSender) send(ctx context.Context, token, phone, message string) (int, string, error) {
+	form := url.Values{
+		// Eskiz expects the number without the leading plus
+		"mobile_phone": {strings.TrimPrefix(phone, "+")},
+		"message":      {message},
+		"from":         {s.from},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.baseURL+"/api/message/sms/send", strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return resp.StatusCode, string(body), nil
+}
+
+func (s *EskizSender) authToken(ctx context.Context, refresh bool) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && !refresh {
+		return s.token, nil
+	}
+
+	form := url.Values{
+		"email":    {s.email},
+		"password": {s.password},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.baseURL+"/api/auth/login", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("eskiz login failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	var payload struct {
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", fmt.Errorf("failed to decode eskiz login response: %w", err)
+	}
+	if payload.Data.Token == "" {
+		return "", fmt.Errorf("eskiz login returned no token")
+	}
+
+	s.token = payload.Data.Token
+	return s.token, nil
+}
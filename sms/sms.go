@@ -0,0 +1,113 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"speak/config"
+)
+
+// Sender delivers a text message to a phone number in E.164 format.
+type Sender interface {
+	Send(ctx context.Context, phone, message string) error
+}
+
+// Default is the sender used by the handlers, set up by Init.
+var Default Sender
+
+// ErrDisabled is returned by DisabledSender.
+var ErrDisabled = errors.New("sms delivery is disabled")
+
+// Init picks the sender from cfg.Provider: "eskiz" for the Eskiz HTTP API,
+// "log" (the default) to print messages instead of sending them, or
+// "disabled" to turn phone sign-in off.
+func Init(cfg config.SMS) error {
+	switch provider := cfg.Provider; provider {
+	case "", "log":
+		Default = LogSender{}
+	case "disabled":
+		Default = DisabledSender{}
+	case "eskiz":
+		sender, err := NewEskizSender(
+			cfg.EskizBaseURL,
+			cfg.EskizEmail,
+			cfg.EskizPassword,
+			cfg.EskizFrom,
+		)
+		if err != nil {
+			return err
+		}
+		Default = sender
+	default:
+		return fmt.Errorf("unknown SMS_PROVIDER %q", provider)
+	}
+	return nil
+}
+
+// LogSender logs messages instead of sending them. It is meant for local
+// development and refused in prod; the phone number is masked and the text,
+// which carries the code, hidden unless LOG_REDACT is off.
+type LogSender struct{}
+
+func (LogSender) Send(ctx context.Context, phone, message string) error {
+	slog.InfoContext(ctx, "sms not sent, logging instead", "phone", phone, "text", message)
+	return nil
+}
+
+// DisabledSender refuses every message. It stands in while no provider is
+// configured; the handlers check Enabled and answer phone requests as
+// unavailable instead of sending.
+type DisabledSender struct{}
+
+func (DisabledSender) Send(ctx context.Context, phone, message string) error {
+	return ErrDisabled
+}
+
+// Enabled reports whether Default can send texts.
+func Enabled() bool {
+	_, disabled := Default.(DisabledSender)
+	return Default != nil && !disabled
+}
+
+var ErrInvalidPhone = errors.New("invalid phone number")
+
+// NormalizePhone converts a user-entered phone number to E.164. Uzbek
+// numbers may be given without the country code ("90 123 45 67") or without
+// the plus ("998901234567"); other countries need a leading plus.
+func NormalizePhone(input string) (string, error) {
+	var digits strings.Builder
+	trimmed := strings.TrimSpace(input)
+	for i, r := range trimmed {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+		case r == ' ' || r == '-' || r == '(' || r == ')':
+		default:
+			return "", ErrInvalidPhone
+		}
+	}
+
+	number := digits.String()
+	hasPlus := strings.HasPrefix(trimmed, "+")
+
+	switch {
+	case !hasPlus && len(number) == 9:
+		number = "998" + number
+	case !hasPlus && strings.HasPrefix(number, "998"):
+	case !hasPlus:
+		return "", ErrInvalidPhone
+	}
+
+	if strings.HasPrefix(number, "998") && len(number) != 12 {
+		return "", ErrInvalidPhone
+	}
+	if len(number) < 8 || len(number) > 15 {
+		return "", ErrInvalidPhone
+	}
+
+	return "+" + number, nil
+}
@@ -0,0 +1,1046 @@
+package store
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory implements every store interface in process. It lets handlers run
+// without Postgres; seed it with the Put methods.
+type Memory struct {
+	mu            sync.Mutex
+	users         map[int64]User
+	admins        map[int64]bool
+	identities    []Identity
+	sessions      map[string]Session
+	revokedAt     map[string]time.Time
+	revokeLinks   map[string]memoryRevokeLink
+	verifications []Verification
+	sends         []memorySend
+	lockouts      map[string]memoryLockout
+	totp          map[int64]TOTP
+	recoveryCodes map[int64]map[string]bool
+	balances      map[int64]float64
+	promocodes    map[string]Promocode
+	activations   map[int64][]PromocodeActivation
+	nextID        int64
+}
+
+type memorySend struct {
+	destination string
+	at          time.Time
+}
+
+type memoryRevokeLink struct {
+	userID    int64
+	expiresAt time.Time
+}
+
+type memoryLockout struct {
+	failures    int
+	updatedAt   time.Time
+	lockedUntil time.Time
+}
+
+var (
+	_ UserStore         = (*Memory)(nil)
+	_ SessionStore      = (*Memory)(nil)
+	_ VerificationStore = (*Memory)(nil)
+	_ LockoutStore      = (*Memory)(nil)
+	_ TwoFactorStore    = (*Memory)(nil)
+	_ BalanceStore      = (*Memory)(nil)
+	_ PromocodeStore    = (*Memory)(nil)
+)
+
+func NewMemory() *Memory {
+	return &Memory{
+		users:         make(map[int64]User),
+		admins:        make(map[int64]bool),
+		sessions:      make(map[string]Session),
+		revokedAt:     make(map[string]time.Time),
+		revokeLinks:   make(map[string]memoryRevokeLink),
+		lockouts:      make(map[string]memoryLockout),
+		totp:          make(map[int64]TOTP),
+		recoveryCodes: make(map[int64]map[string]bool),
+		balances:      make(map[int64]float64),
+		promocodes:    make(map[string]Promocode),
+		activations:   make(map[int64][]PromocodeActivation),
+	}
+}
+
+// PutUser adds or replaces a user, marking them as an admin or not.
+func (m *Memory) PutUser(user User, admin bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[user.ID] = user
+	m.admins[user.ID] = admin
+}
+
+// PutSession adds or replaces a session.
+func (m *Memory) PutSession(session Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[session.ID] = session
+}
+
+// PutVerification replaces the user's verification of the same type.
+func (m *Memory) PutVerification(v Verification) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteVerifications(v.UserID, v.Type)
+	m.verifications = append(m.verifications, v)
+}
+
+func (m *Memory) GetUser(ctx context.Context, userID int64) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func (m *Memory) IsAdmin(ctx context.Context, userID int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.admins[userID], nil
+}
+
+func (m *Memory) FindUserByEmail(ctx context.Context, email string) (*User, error) {
+	return m.findUser(func(u User) bool { return u.Email != "" && strings.EqualFold(u.Email, email) })
+}
+
+func (m *Memory) FindUserByPhone(ctx context.Context, phone string) (*User, error) {
+	return m.findUser(func(u User) bool { return u.Phone != "" && u.Phone == phone })
+}
+
+func (m *Memory) findUser(match func(User) bool) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, user := range m.users {
+		if match(user) {
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *Memory) SaveSignup(ctx context.Context, s Signup) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, u := range m.users {
+		if id != s.ID && ((s.Email != "" && strings.EqualFold(u.Email, s.Email)) || (s.Phone != "" && u.Phone == s.Phone)) {
+			return 0, ErrConflict
+		}
+	}
+
+	now := time.Now()
+	dob := s.DateOfBirth
+	if user, ok := m.users[s.ID]; ok {
+		if user.Status == StatusPending {
+			user.FirstName, user.LastName, user.DateOfBirth, user.CreatedAt = s.FirstName, s.LastName, &dob, &now
+			m.users[s.ID] = user
+		}
+		return s.ID, nil
+	}
+
+	m.nextID++
+	m.users[m.nextID] = User{
+		ID:          m.nextID,
+		Email:       s.Email,
+		Phone:       s.Phone,
+		FirstName:   s.FirstName,
+		LastName:    s.LastName,
+		DateOfBirth: &dob,
+		Locale:      "uz",
+		Status:      StatusPending,
+		CreatedAt:   &now,
+	}
+	return m.nextID, nil
+}
+
+func (m *Memory) ActivateUser(ctx context.Context, userID int64, provider, subject, verificationType string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.linkIdentity(userID, provider, subject); err != nil {
+		return err
+	}
+	if user, ok := m.users[userID]; ok {
+		user.Status = StatusActive
+		m.users[userID] = user
+	}
+	m.deleteVerifications(userID, verificationType)
+	return nil
+}
+
+func (m *Memory) UpdateProfile(ctx context.Context, userID int64, u ProfileUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	if u.FirstName != nil {
+		user.FirstName = *u.FirstName
+	}
+	if u.LastName != nil {
+		user.LastName = *u.LastName
+	}
+	if u.DateOfBirth != nil {
+		dob := *u.DateOfBirth
+		user.DateOfBirth = &dob
+	}
+	if u.Locale != nil {
+		user.Locale = *u.Locale
+	}
+	m.users[userID] = user
+	return nil
+}
+
+func (m *Memory) ChangeEmail(ctx context.Context, userID int64, email, verificationType, codeHash string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return "", ErrNotFound
+	}
+	spent := -1
+	for i, v := range m.verifications {
+		if v.UserID == userID && v.Type == verificationType && v.CodeHash == codeHash {
+			spent = i
+			break
+		}
+	}
+	if spent < 0 {
+		return "", ErrNotFound
+	}
+	if m.isEmailTaken(email, userID) {
+		return "", ErrConflict
+	}
+	m.verifications = append(m.verifications[:spent], m.verifications[spent+1:]...)
+	m.deletePendingUsersByEmail(email)
+
+	oldEmail := user.Email
+	user.Email = email
+	m.users[userID] = user
+
+	if oldEmail != "" {
+		m.removeIdentities(func(i Identity) bool {
+			return i.UserID == userID && i.Provider == ProviderEmail && i.Subject == NormalizeSubject(ProviderEmail, oldEmail)
+		})
+	}
+	if err := m.linkIdentity(userID, ProviderEmail, email); err != nil {
+		return "", err
+	}
+	return oldEmail, nil
+}
+
+func (m *Memory) DeleteUser(ctx context.Context, userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Collect every address and number the user was known by before the
+	// records naming them are scrubbed
+	contacts := make(map[string]bool)
+	addContact := func(contact string) {
+		if contact != "" {
+			contacts[strings.ToLower(contact)] = true
+		}
+	}
+	if user, ok := m.users[userID]; ok {
+		addContact(user.Email)
+		addContact(user.Phone)
+		m.users[userID] = User{ID: userID, Locale: user.Locale, Status: user.Status, CreatedAt: user.CreatedAt, Deleted: true}
+	}
+	for _, i := range m.identities {
+		if i.UserID == userID && (i.Provider == ProviderEmail || i.Provider == ProviderPhone) {
+			addContact(i.Subject)
+		}
+	}
+	for _, v := range m.verifications {
+		if v.UserID == userID {
+			addContact(v.Email)
+			addContact(v.Phone)
+		}
+	}
+
+	m.removeIdentities(func(i Identity) bool { return i.UserID == userID })
+	for id, session := range m.sessions {
+		if session.UserID == userID {
+			delete(m.sessions, id)
+		}
+	}
+	for id, link := range m.revokeLinks {
+		if link.userID == userID {
+			delete(m.revokeLinks, id)
+		}
+	}
+	delete(m.totp, userID)
+	delete(m.recoveryCodes, userID)
+
+	kept := m.verifications[:0]
+	for _, v := range m.verifications {
+		if v.UserID != userID {
+			kept = append(kept, v)
+		}
+	}
+	m.verifications = kept
+
+	sends := m.sends[:0]
+	for _, s := range m.sends {
+		if !contacts[strings.ToLower(s.destination)] {
+			sends = append(sends, s)
+		}
+	}
+	m.sends = sends
+	for contact := range contacts {
+		delete(m.lockouts, LockoutKey(contactProvider(contact), contact))
+	}
+	return nil
+}
+
+func (m *Memory) PurgePendingUsers(ctx context.Context, cutoff time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var purged int64
+	for id, user := range m.users {
+		if user.Status != StatusPending || user.CreatedAt == nil || !user.CreatedAt.Before(cutoff) {
+			continue
+		}
+		kept := m.verifications[:0]
+		for _, v := range m.verifications {
+			if v.UserID != id {
+				kept = append(kept, v)
+			}
+		}
+		m.verifications = kept
+		delete(m.users, id)
+		purged++
+	}
+	return purged, nil
+}
+
+func (m *Memory) FindUserByIdentity(ctx context.Context, provider, subject string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.findUserByIdentity(provider, subject)
+}
+
+func (m *Memory) findUserByIdentity(provider, subject string) (int64, error) {
+	subject = NormalizeSubject(provider, subject)
+	for _, i := range m.identities {
+		if i.Provider != provider || i.Subject != subject {
+			continue
+		}
+		if user := m.users[i.UserID]; user.Status == StatusActive && !user.Deleted {
+			return i.UserID, nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+func (m *Memory) IsIdentityTaken(ctx context.Context, provider, subject string, userID int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.isIdentityTaken(provider, subject, userID), nil
+}
+
+func (m *Memory) isIdentityTaken(provider, subject string, userID int64) bool {
+	subject = NormalizeSubject(provider, subject)
+	for _, i := range m.identities {
+		if i.Provider == provider && i.Subject == subject && i.UserID != userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memory) IsEmailTaken(ctx context.Context, email string, userID int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.isEmailTaken(email, userID), nil
+}
+
+func (m *Memory) isEmailTaken(email string, userID int64) bool {
+	for id, user := range m.users {
+		if id != userID && user.Status != StatusPending && user.Email != "" && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+	return m.isIdentityTaken(ProviderEmail, email, userID)
+}
+
+func (m *Memory) ListIdentities(ctx context.Context, userID int64) ([]Identity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	identities := []Identity{}
+	for _, i := range m.identities {
+		if i.UserID == userID {
+			identities = append(identities, i)
+		}
+	}
+	return identities, nil
+}
+
+func (m *Memory) LinkIdentity(ctx context.Context, userID int64, provider, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.linkIdentity(userID, provider, subject)
+}
+
+func (m *Memory) linkIdentity(userID int64, provider, subject string) error {
+	now := time.Now()
+	normalized := NormalizeSubject(provider, subject)
+	linked := false
+	for i := range m.identities {
+		identity := &m.identities[i]
+		if identity.Provider != provider || identity.Subject != normalized {
+			continue
+		}
+		if identity.UserID != userID {
+			return ErrConflict
+		}
+		identity.VerifiedAt = &now
+		linked = true
+	}
+	if !linked {
+		m.nextID++
+		m.identities = append(m.identities, Identity{
+			ID:         m.nextID,
+			UserID:     userID,
+			Provider:   provider,
+			Subject:    normalized,
+			VerifiedAt: &now,
+			CreatedAt:  now,
+		})
+	}
+
+	user, ok := m.users[userID]
+	if !ok {
+		return nil
+	}
+	switch {
+	case provider == ProviderEmail && user.Email == "":
+		user.Email = strings.TrimSpace(subject)
+	case provider == ProviderPhone && user.Phone == "":
+		user.Phone = strings.TrimSpace(subject)
+	}
+	m.users[userID] = user
+	return nil
+}
+
+func (m *Memory) removeIdentities(match func(Identity) bool) {
+	kept := m.identities[:0]
+	for _, i := range m.identities {
+		if !match(i) {
+			kept = append(kept, i)
+		}
+	}
+	m.identities = kept
+}
+
+func (m *Memory) UnlinkIdentity(ctx context.Context, userID, identityID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var (
+		count   int
+		removed *Identity
+	)
+	for _, i := range m.identities {
+		if i.UserID != userID {
+			continue
+		}
+		count++
+		if i.ID == identityID {
+			found := i
+			removed = &found
+		}
+	}
+	if removed == nil {
+		return ErrNotFound
+	}
+	if count <= 1 {
+		return ErrLastIdentity
+	}
+
+	m.removeIdentities(func(i Identity) bool { return i.ID == identityID })
+
+	if removed.Provider != ProviderEmail && removed.Provider != ProviderPhone {
+		return nil
+	}
+	var fallback string
+	for _, i := range m.identities {
+		if i.UserID == userID && i.Provider == removed.Provider {
+			fallback = i.Subject
+			break
+		}
+	}
+	user := m.users[userID]
+	switch {
+	case removed.Provider == ProviderEmail && strings.EqualFold(user.Email, removed.Subject):
+		user.Email = fallback
+	case removed.Provider == ProviderPhone && user.Phone == removed.Subject:
+		user.Phone = fallback
+	}
+	m.users[userID] = user
+	return nil
+}
+
+func (m *Memory) FindOrCreateExternalUser(ctx context.Context, a ExternalAccount) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if userID, err := m.findUserByIdentity(a.Provider, a.Subject); err == nil {
+		return userID, nil
+	}
+
+	var userID int64
+	if a.Email != "" {
+		m.deletePendingUsersByEmail(a.Email)
+		for id, user := range m.users {
+			if !user.Deleted && user.Status == StatusActive && (strings.EqualFold(user.Email, a.Email) || m.ownsIdentity(id, ProviderEmail, a.Email)) {
+				userID = id
+				break
+			}
+		}
+	}
+	if userID == 0 {
+		now := time.Now()
+		m.nextID++
+		userID = m.nextID
+		m.users[userID] = User{
+			ID:        userID,
+			Email:     a.Email,
+			FirstName: a.FirstName,
+			LastName:  a.LastName,
+			Locale:    "uz",
+			Status:    StatusActive,
+			CreatedAt: &now,
+		}
+	}
+
+	if a.Email != "" {
+		if err := m.linkIdentity(userID, ProviderEmail, a.Email); err != nil {
+			return 0, err
+		}
+	}
+	if err := m.linkIdentity(userID, a.Provider, a.Subject); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+func (m *Memory) deletePendingUsersByEmail(email string) {
+	for id, user := range m.users {
+		if user.Status != StatusPending || !strings.EqualFold(user.Email, email) {
+			continue
+		}
+		kept := m.verifications[:0]
+		for _, v := range m.verifications {
+			if v.UserID != id {
+				kept = append(kept, v)
+			}
+		}
+		m.verifications = kept
+		delete(m.users, id)
+	}
+}
+
+func (m *Memory) ownsIdentity(userID int64, provider, subject string) bool {
+	subject = NormalizeSubject(provider, subject)
+	for _, i := range m.identities {
+		if i.UserID == userID && i.Provider == provider && i.Subject == subject {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memory) CreateSession(ctx context.Context, s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	s.CreatedAt, s.LastSeenAt = now, now
+	m.sessions[s.ID] = *s
+	return nil
+}
+
+func (m *Memory) GetSession(ctx context.Context, sessionID string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &session, nil
+}
+
+func (m *Memory) TouchSession(ctx context.Context, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if session, ok := m.sessions[sessionID]; ok {
+		session.LastSeenAt = time.Now()
+		m.sessions[sessionID] = session
+	}
+	return nil
+}
+
+func (m *Memory) ListSessions(ctx context.Context, userID int64) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	sessions := []Session{}
+	for _, s := range m.sessions {
+		if s.UserID == userID && !s.Revoked && s.ExpiresAt.After(now) {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions, nil
+}
+
+func (m *Memory) RevokeSession(ctx context.Context, userID int64, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok || session.UserID != userID || session.Revoked {
+		return ErrNotFound
+	}
+	session.Revoked = true
+	m.sessions[sessionID] = session
+	m.revokedAt[sessionID] = time.Now()
+	return nil
+}
+
+func (m *Memory) RevokeSessions(ctx context.Context, userID int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var revoked int64
+	for id, session := range m.sessions {
+		if session.UserID == userID && !session.Revoked {
+			session.Revoked = true
+			m.sessions[id] = session
+			m.revokedAt[id] = time.Now()
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+func (m *Memory) LoginHistory(ctx context.Context, userID int64, userAgent, ip string) (LoginHistory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var h LoginHistory
+	for _, s := range m.sessions {
+		if s.UserID != userID {
+			continue
+		}
+		h.HasSessions = true
+		h.KnownAgent = h.KnownAgent || s.UserAgent == userAgent
+		h.KnownIP = h.KnownIP || s.IP == ip
+	}
+	return h, nil
+}
+
+func (m *Memory) CreateRevokeLink(ctx context.Context, id string, userID int64, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.revokeLinks[id] = memoryRevokeLink{userID: userID, expiresAt: expiresAt}
+	return nil
+}
+
+func (m *Memory) UseRevokeLink(ctx context.Context, id string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	link, ok := m.revokeLinks[id]
+	if !ok || !link.expiresAt.After(time.Now()) {
+		return 0, ErrNotFound
+	}
+	delete(m.revokeLinks, id)
+	return link.userID, nil
+}
+
+func (m *Memory) PurgeSessions(ctx context.Context, cutoff time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, link := range m.revokeLinks {
+		if link.expiresAt.Before(cutoff) {
+			delete(m.revokeLinks, id)
+		}
+	}
+
+	for id, s := range m.sessions {
+		if revokedAt, ok := m.revokedAt[id]; s.ExpiresAt.Before(cutoff) || (ok && revokedAt.Before(cutoff)) {
+			delete(m.sessions, id)
+			delete(m.revokedAt, id)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) CreateVerification(ctx context.Context, v *Verification) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteVerifications(v.UserID, v.Type)
+	m.verifications = append(m.verifications, *v)
+	return nil
+}
+
+func (m *Memory) FindVerification(ctx context.Context, q VerificationQuery) (*Verification, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	latest := m.findVerification(q)
+	if latest == nil {
+		return nil, ErrNotFound
+	}
+	found := *latest
+	return &found, nil
+}
+
+func (m *Memory) findVerification(q VerificationQuery) *Verification {
+	now := time.Now()
+	var latest *Verification
+	for i := range m.verifications {
+		v := &m.verifications[i]
+		switch {
+		case v.Type != q.Type || (!q.IncludeExpired && !v.ExpiresAt.After(now)):
+			continue
+		case q.Email != "" && !strings.EqualFold(v.Email, NormalizeSubject(ProviderEmail, q.Email)):
+			continue
+		case q.Phone != "" && v.Phone != q.Phone:
+			continue
+		case q.CodeHash != "" && v.CodeHash != q.CodeHash:
+			continue
+		case q.Email == "" && q.Phone == "" && q.CodeHash == "" && v.UserID != q.UserID:
+			continue
+		}
+		if latest == nil || v.IssuedAt.After(latest.IssuedAt) {
+			latest = v
+		}
+	}
+	return latest
+}
+
+func (m *Memory) UseAttempt(ctx context.Context, q VerificationQuery, maxAttempts int) (*Verification, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q.IncludeExpired = false
+	v := m.findVerification(q)
+	if v == nil || v.Attempts >= maxAttempts {
+		return nil, ErrNotFound
+	}
+	v.Attempts++
+	found := *v
+	return &found, nil
+}
+
+func (m *Memory) deleteVerifications(userID int64, verificationTypes ...string) {
+	kept := m.verifications[:0]
+	for _, v := range m.verifications {
+		if v.UserID != userID || !slices.Contains(verificationTypes, v.Type) {
+			kept = append(kept, v)
+		}
+	}
+	m.verifications = kept
+}
+
+func (m *Memory) DeleteVerifications(ctx context.Context, userID int64, verificationTypes ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteVerifications(userID, verificationTypes...)
+	return nil
+}
+
+func (m *Memory) DeleteVerificationByCode(ctx context.Context, userID int64, verificationType, codeHash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := false
+	kept := m.verifications[:0]
+	for _, v := range m.verifications {
+		if v.UserID == userID && v.Type == verificationType && v.CodeHash == codeHash {
+			deleted = true
+			continue
+		}
+		kept = append(kept, v)
+	}
+	m.verifications = kept
+	return deleted, nil
+}
+
+func (m *Memory) RecordSend(ctx context.Context, destination string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sends = append(m.sends, memorySend{destination: destination, at: at})
+	return nil
+}
+
+func (m *Memory) SendStats(ctx context.Context, destination string, since time.Time) (SendStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var stats SendStats
+	for _, s := range m.sends {
+		if s.destination != destination || !s.at.After(since) {
+			continue
+		}
+		stats.Count++
+		if stats.First.IsZero() || s.at.Before(stats.First) {
+			stats.First = s.at
+		}
+		if s.at.After(stats.Last) {
+			stats.Last = s.at
+		}
+	}
+	return stats, nil
+}
+
+func (m *Memory) PurgeSends(ctx context.Context, cutoff time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := m.sends[:0]
+	for _, s := range m.sends {
+		if !s.at.Before(cutoff) {
+			kept = append(kept, s)
+		}
+	}
+	m.sends = kept
+	return nil
+}
+
+func (m *Memory) GetBalance(ctx context.Context, userID int64) (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.balances[userID], nil
+}
+
+func (m *Memory) CreatePromocode(ctx context.Context, p *Promocode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, taken := m.promocodes[p.Keyword]; taken {
+		return ErrConflict
+	}
+	m.nextID++
+	p.ID = m.nextID
+	if p.StartTime != nil && p.EndTime != nil {
+		p.IsActive = p.activeAt(time.Now().UTC())
+	}
+	m.promocodes[p.Keyword] = *p
+	return nil
+}
+
+func (m *Memory) FindPromocode(ctx context.Context, keyword string) (*Promocode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.promocodes[keyword]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if p.StartTime != nil || p.EndTime != nil {
+		p.IsActive = p.activeAt(time.Now().UTC())
+	}
+	return &p, nil
+}
+
+func (m *Memory) ActivatePromocode(ctx context.Context, p *Promocode, userID int64) (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, a := range m.activations[userID] {
+		if a.PromocodeID == p.ID {
+			return 0, ErrAlreadyActivated
+		}
+	}
+
+	now := time.Now().UTC()
+	m.activations[userID] = append(m.activations[userID], PromocodeActivation{
+		PromocodeID: p.ID,
+		Keyword:     p.Keyword,
+		Quantity:    p.Quantity,
+		ActivatedAt: &now,
+		StartTime:   p.StartTime,
+		EndTime:     p.EndTime,
+	})
+	m.balances[userID] += p.Quantity
+	return m.balances[userID], nil
+}
+
+func (m *Memory) ListPromocodeActivations(ctx context.Context, userID int64) ([]PromocodeActivation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := append([]PromocodeActivation{}, m.activations[userID]...)
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].ActivatedAt.After(*results[j].ActivatedAt)
+	})
+	return results, nil
+}
+
+func (m *Memory) TakeAttempt(ctx context.Context, key string, p LockoutPolicy) (Attempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	l := m.lockouts[key]
+	if l.lockedUntil.After(now) {
+		return Attempt{Attempts: l.failures, LockedUntil: l.lockedUntil}, nil
+	}
+
+	if l.updatedAt.Before(now.Add(-p.Window)) {
+		l.failures = 0
+	}
+	l.failures++
+	l.updatedAt = now
+	l.lockedUntil = time.Time{}
+	if l.failures >= p.Threshold {
+		l.lockedUntil = now.Add(p.Delay(l.failures))
+	}
+	m.lockouts[key] = l
+	return Attempt{Counted: true, Attempts: l.failures, LockedUntil: l.lockedUntil}, nil
+}
+
+func (m *Memory) ReturnAttempt(ctx context.Context, key string, p LockoutPolicy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if l, ok := m.lockouts[key]; ok {
+		l.failures = max(l.failures-1, 0)
+		if l.failures < p.Threshold {
+			l.lockedUntil = time.Time{}
+		}
+		m.lockouts[key] = l
+	}
+	return nil
+}
+
+func (m *Memory) ClearLockout(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.lockouts, key)
+	return nil
+}
+
+func (m *Memory) PurgeLockouts(ctx context.Context, cutoff time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for key, l := range m.lockouts {
+		if l.updatedAt.Before(cutoff) && l.lockedUntil.Before(now) {
+			delete(m.lockouts, key)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) GetTOTP(ctx context.Context, userID int64) (*TOTP, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.totp[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &t, nil
+}
+
+func (m *Memory) SaveTOTPSecret(ctx context.Context, userID int64, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.totp[userID] = TOTP{Secret: secret}
+	return nil
+}
+
+func (m *Memory) EnableTOTP(ctx context.Context, userID, step int64, recoveryCodeHashes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.totp[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	if t.Enabled {
+		return ErrConflict
+	}
+	t.Enabled, t.LastUsedStep = true, step
+	m.totp[userID] = t
+
+	codes := make(map[string]bool, len(recoveryCodeHashes))
+	for _, hash := range recoveryCodeHashes {
+		codes[hash] = false
+	}
+	m.recoveryCodes[userID] = codes
+	return nil
+}
+
+func (m *Memory) UseTOTPStep(ctx context.Context, userID, step int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.totp[userID]
+	if !ok || !t.Enabled || t.LastUsedStep >= step {
+		return false, nil
+	}
+	t.LastUsedStep = step
+	m.totp[userID] = t
+	return true, nil
+}
+
+func (m *Memory) UseRecoveryCode(ctx context.Context, userID int64, codeHash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	used, ok := m.recoveryCodes[userID][codeHash]
+	if !ok || used || !m.totp[userID].Enabled {
+		return false, nil
+	}
+	m.recoveryCodes[userID][codeHash] = true
+	return true, nil
+}
+
+func (m *Memory) CountRecoveryCodes(ctx context.Context, userID int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	remaining := 0
+	for _, used := range m.recoveryCodes[userID] {
+		if !used {
+			remaining++
+		}
+	}
+	return remaining, nil
+}
+
+func (m *Memory) DeleteTwoFactor(ctx context.Context, userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.totp, userID)
+	delete(m.recoveryCodes, userID)
+	return nil
+}
@@ -0,0 +1,1385 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Postgres implements every store interface on top of a database/sql pool.
+// The promocode and admin queries fall back to the older table layouts some
+// deployments still have.
+type Postgres struct {
+	db *sql.DB
+}
+
+var (
+	_ UserStore         = (*Postgres)(nil)
+	_ SessionStore      = (*Postgres)(nil)
+	_ VerificationStore = (*Postgres)(nil)
+	_ LockoutStore      = (*Postgres)(nil)
+	_ TwoFactorStore    = (*Postgres)(nil)
+	_ BalanceStore      = (*Postgres)(nil)
+	_ PromocodeStore    = (*Postgres)(nil)
+)
+
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+// isSchemaMismatch reports whether err is Postgres complaining about a
+// missing table (42P01) or column (42703).
+func isSchemaMismatch(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == "42P01" || pqErr.Code == "42703")
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx, so helpers can run
+// inside a transaction or outside one.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+const userColumns = `user_id, COALESCE(email, ''), COALESCE(phone, ''), COALESCE(first_name, ''),
+	COALESCE(last_name, ''), date_of_birth, locale, status, created_at, deleted_at IS NOT NULL`
+
+func scanUser(row *sql.Row) (*User, error) {
+	var (
+		user                   User
+		dateOfBirth, createdAt sql.NullTime
+	)
+	err := row.Scan(&user.ID, &user.Email, &user.Phone, &user.FirstName, &user.LastName,
+		&dateOfBirth, &user.Locale, &user.Status, &createdAt, &user.Deleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dateOfBirth.Valid {
+		user.DateOfBirth = &dateOfBirth.Time
+	}
+	if createdAt.Valid {
+		user.CreatedAt = &createdAt.Time
+	}
+	return &user, nil
+}
+
+func (s *Postgres) GetUser(ctx context.Context, userID int64) (*User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE user_id = $1", userID))
+}
+
+func (s *Postgres) FindUserByEmail(ctx context.Context, email string) (*User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE LOWER(email) = LOWER($1)", email))
+}
+
+func (s *Postgres) FindUserByPhone(ctx context.Context, phone string) (*User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE phone = $1", phone))
+}
+
+func (s *Postgres) IsAdmin(ctx context.Context, userID int64) (bool, error) {
+	queries := []string{
+		"SELECT is_admin FROM users WHERE user_id = $1",
+		"SELECT role = 'admin' FROM users WHERE user_id = $1",
+		"SELECT EXISTS (SELECT 1 FROM admins WHERE user_id = $1)",
+		"SELECT EXISTS (SELECT 1 FROM user_roles WHERE user_id = $1 AND role = 'admin')",
+	}
+
+	for _, query := range queries {
+		var isAdmin bool
+		err := s.db.QueryRowContext(ctx, query, userID).Scan(&isAdmin)
+		switch {
+		case err == nil:
+			return isAdmin, nil
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		case isSchemaMismatch(err):
+			continue
+		default:
+			return false, err
+		}
+	}
+
+	return false, fmt.Errorf("could not determine admin status for user %d", userID)
+}
+
+func (s *Postgres) SaveSignup(ctx context.Context, su Signup) (int64, error) {
+	column, contact := "email", su.Email
+	if su.Phone != "" {
+		column, contact = "phone", su.Phone
+	}
+
+	userID := su.ID
+	var err error
+	if userID != 0 {
+		_, err = s.db.ExecContext(ctx,
+			"UPDATE users SET first_name = $1, last_name = $2, date_of_birth = $3, created_at = NOW() WHERE user_id = $4 AND status = $5",
+			su.FirstName, su.LastName, su.DateOfBirth, userID, StatusPending,
+		)
+	} else {
+		err = s.db.QueryRowContext(ctx,
+			"INSERT INTO users (first_name, last_name, date_of_birth, "+column+", status) VALUES ($1, $2, $3, $4, $5) RETURNING user_id",
+			su.FirstName, su.LastName, su.DateOfBirth, contact, StatusPending,
+		).Scan(&userID)
+	}
+	if isUniqueViolation(err) {
+		return 0, ErrConflict
+	}
+	if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+func (s *Postgres) ActivateUser(ctx context.Context, userID int64, provider, subject, verificationType string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE users SET status = $1 WHERE user_id = $2",
+		StatusActive, userID,
+	); err != nil {
+		return err
+	}
+	if err := linkIdentity(ctx, tx, userID, provider, subject); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM verifications WHERE user_id = $1 AND type = $2",
+		userID, verificationType,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Postgres) UpdateProfile(ctx context.Context, userID int64, u ProfileUpdate) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE users
+		SET first_name = COALESCE($1, first_name),
+		    last_name = COALESCE($2, last_name),
+		    date_of_birth = COALESCE($3::date, date_of_birth),
+		    locale = COALESCE($4, locale)
+		WHERE user_id = $5
+	`, u.FirstName, u.LastName, u.DateOfBirth, u.Locale, userID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *Postgres) ChangeEmail(ctx context.Context, userID int64, email, verificationType, codeHash string) (string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Of concurrent requests with the same code only the one that deletes
+	// it goes on; the others wait on the row lock and find nothing
+	result, err := tx.ExecContext(ctx,
+		"DELETE FROM verifications WHERE user_id = $1 AND type = $2 AND code = $3",
+		userID, verificationType, codeHash,
+	)
+	if err != nil {
+		return "", err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 0 {
+		return "", ErrNotFound
+	}
+
+	var oldEmail sql.NullString
+	err = tx.QueryRowContext(ctx,
+		"SELECT email FROM users WHERE user_id = $1 FOR UPDATE",
+		userID,
+	).Scan(&oldEmail)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	taken, err := isEmailTaken(ctx, tx, email, userID)
+	if err != nil {
+		return "", err
+	}
+	if taken {
+		return "", ErrConflict
+	}
+
+	// Whoever started a pending signup for the address never proved they
+	// own it, so it gives way to the verified change
+	if err := deletePendingUsersByEmail(ctx, tx, email); err != nil {
+		return "", err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET email = $1 WHERE user_id = $2", email, userID); err != nil {
+		if isUniqueViolation(err) {
+			return "", ErrConflict
+		}
+		return "", err
+	}
+
+	// The new address replaces the old one as a login method too
+	if oldEmail.String != "" {
+		if _, err := tx.ExecContext(ctx,
+			"DELETE FROM user_identities WHERE user_id = $1 AND provider = $2 AND subject = $3",
+			userID, ProviderEmail, NormalizeSubject(ProviderEmail, oldEmail.String),
+		); err != nil {
+			return "", err
+		}
+	}
+	if err := linkIdentity(ctx, tx, userID, ProviderEmail, email); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return oldEmail.String, nil
+}
+
+func (s *Postgres) DeleteUser(ctx context.Context, userID int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Collect every address and number the user was known by before the
+	// rows naming them are scrubbed
+	rows, err := tx.QueryContext(ctx, `
+		SELECT DISTINCT LOWER(contact) FROM (
+			SELECT email AS contact FROM users WHERE user_id = $1
+			UNION ALL SELECT phone FROM users WHERE user_id = $1
+			UNION ALL SELECT subject FROM user_identities WHERE user_id = $1 AND provider IN ($2, $3)
+			UNION ALL SELECT email FROM verifications WHERE user_id = $1
+			UNION ALL SELECT phone FROM verifications WHERE user_id = $1
+		) contacts
+		WHERE contact IS NOT NULL AND contact <> ''
+	`, userID, ProviderEmail, ProviderPhone)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var contacts, lockoutKeys []string
+	for rows.Next() {
+		var contact string
+		if err := rows.Scan(&contact); err != nil {
+			return err
+		}
+		contacts = append(contacts, contact)
+		lockoutKeys = append(lockoutKeys, LockoutKey(contactProvider(contact), contact))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE users
+		SET email = NULL,
+		    phone = NULL,
+		    first_name = '',
+		    last_name = '',
+		    date_of_birth = NULL,
+		    deleted_at = NOW()
+		WHERE user_id = $1
+	`, userID); err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		"DELETE FROM user_identities WHERE user_id = $1",
+		"DELETE FROM user_sessions WHERE user_id = $1",
+		"DELETE FROM session_revoke_links WHERE user_id = $1",
+		"DELETE FROM user_recovery_codes WHERE user_id = $1",
+		"DELETE FROM user_totp WHERE user_id = $1",
+		"DELETE FROM verifications WHERE user_id = $1",
+	} {
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM verification_sends WHERE LOWER(destination) = ANY($1)",
+		pq.Array(contacts),
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM auth_lockouts WHERE key = ANY($1)",
+		pq.Array(lockoutKeys),
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Postgres) PurgePendingUsers(ctx context.Context, cutoff time.Time) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM verifications
+		WHERE user_id IN (SELECT user_id FROM users WHERE status = $1 AND created_at < $2)
+	`, StatusPending, cutoff); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx,
+		"DELETE FROM users WHERE status = $1 AND created_at < $2",
+		StatusPending, cutoff,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *Postgres) FindUserByIdentity(ctx context.Context, provider, subject string) (int64, error) {
+	return findUserByIdentity(ctx, s.db, provider, subject)
+}
+
+func findUserByIdentity(ctx context.Context, q querier, provider, subject string) (int64, error) {
+	var userID int64
+	err := q.QueryRowContext(ctx, `
+		SELECT u.user_id
+		FROM user_identities ui
+		JOIN users u ON u.user_id = ui.user_id
+		WHERE ui.provider = $1 AND ui.subject = $2
+		  AND u.status = $3 AND u.deleted_at IS NULL
+	`, provider, NormalizeSubject(provider, subject), StatusActive).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return userID, err
+}
+
+func (s *Postgres) IsIdentityTaken(ctx context.Context, provider, subject string, userID int64) (bool, error) {
+	return isIdentityTaken(ctx, s.db, provider, subject, userID)
+}
+
+func isIdentityTaken(ctx context.Context, q querier, provider, subject string, userID int64) (bool, error) {
+	var taken bool
+	err := q.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM user_identities WHERE provider = $1 AND subject = $2 AND user_id <> $3)",
+		provider, NormalizeSubject(provider, subject), userID,
+	).Scan(&taken)
+	return taken, err
+}
+
+func (s *Postgres) IsEmailTaken(ctx context.Context, email string, userID int64) (bool, error) {
+	return isEmailTaken(ctx, s.db, email, userID)
+}
+
+func isEmailTaken(ctx context.Context, q querier, email string, userID int64) (bool, error) {
+	var taken bool
+	err := q.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM users WHERE LOWER(email) = LOWER($1) AND user_id <> $2 AND status <> $3)",
+		email, userID, StatusPending,
+	).Scan(&taken)
+	if err != nil || taken {
+		return taken, err
+	}
+	return isIdentityTaken(ctx, q, ProviderEmail, email, userID)
+}
+
+func (s *Postgres) ListIdentities(ctx context.Context, userID int64) ([]Identity, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, provider, subject, verified_at, created_at FROM user_identities WHERE user_id = $1 ORDER BY created_at",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		item := Identity{UserID: userID}
+		var verifiedAt sql.NullTime
+		if err := rows.Scan(&item.ID, &item.Provider, &item.Subject, &verifiedAt, &item.CreatedAt); err != nil {
+			return nil, err
+		}
+		if verifiedAt.Valid {
+			item.VerifiedAt = &verifiedAt.Time
+		}
+		identities = append(identities, item)
+	}
+	return identities, rows.Err()
+}
+
+func (s *Postgres) LinkIdentity(ctx context.Context, userID int64, provider, subject string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := linkIdentity(ctx, tx, userID, provider, subject); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// linkIdentity records a verified identity for userID, refreshing
+// verified_at if the user has it already, and gives users without an email
+// or phone somewhere to send codes to.
+func linkIdentity(ctx context.Context, q querier, userID int64, provider, subject string) error {
+	var owner int64
+	err := q.QueryRowContext(ctx, `
+		INSERT INTO user_identities (user_id, provider, subject, verified_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (provider, subject) DO UPDATE SET verified_at = NOW()
+		WHERE user_identities.user_id = EXCLUDED.user_id
+		RETURNING user_id
+	`, userID, provider, NormalizeSubject(provider, subject)).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+
+	if provider == ProviderEmail || provider == ProviderPhone {
+		column := provider
+		_, err = q.ExecContext(ctx,
+			"UPDATE users SET "+column+" = $1 WHERE user_id = $2 AND "+column+" IS NULL",
+			strings.TrimSpace(subject), userID,
+		)
+	}
+	return err
+}
+
+func (s *Postgres) UnlinkIdentity(ctx context.Context, userID, identityID int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the user's identities so two concurrent unlinks can't both pass
+	// the last-identity check
+	rows, err := tx.QueryContext(ctx,
+		"SELECT id, provider, subject FROM user_identities WHERE user_id = $1 FOR UPDATE",
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	var (
+		count    int
+		found    bool
+		provider string
+		subject  string
+	)
+	for rows.Next() {
+		var id int64
+		var p, sub string
+		if err := rows.Scan(&id, &p, &sub); err != nil {
+			rows.Close()
+			return err
+		}
+		count++
+		if id == identityID {
+			found, provider, subject = true, p, sub
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if !found {
+		return ErrNotFound
+	}
+	if count <= 1 {
+		return ErrLastIdentity
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_identities WHERE id = $1", identityID); err != nil {
+		return err
+	}
+
+	// users.email and users.phone are where codes and notices are sent, so
+	// fall back to another linked address of the same kind, if any
+	if provider == ProviderEmail || provider == ProviderPhone {
+		column := provider
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE users
+			SET `+column+` = (
+				SELECT subject FROM user_identities
+				WHERE user_id = $1 AND provider = $2
+				ORDER BY created_at
+				LIMIT 1
+			)
+			WHERE user_id = $1 AND LOWER(`+column+`) = $3
+		`, userID, provider, subject); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *Postgres) FindOrCreateExternalUser(ctx context.Context, a ExternalAccount) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	userID, err := findUserByIdentity(ctx, tx, a.Provider, a.Subject)
+	if err == nil {
+		return userID, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return 0, err
+	}
+
+	// The provider has verified the email, so it signs in to the active
+	// account that owns it. A pending signup for it was never proven by
+	// whoever started it, so it is dropped rather than taken over.
+	err = sql.ErrNoRows
+	if a.Email != "" {
+		err = deletePendingUsersByEmail(ctx, tx, a.Email)
+		if err == nil {
+			err = tx.QueryRowContext(ctx, `
+				SELECT u.user_id FROM users u
+				WHERE u.deleted_at IS NULL AND u.status = $3 AND (
+					LOWER(u.email) = LOWER($1) OR EXISTS (
+						SELECT 1 FROM user_identities ui
+						WHERE ui.user_id = u.user_id AND ui.provider = $2 AND ui.subject = LOWER($1)
+					)
+				)
+				LIMIT 1
+			`, a.Email, ProviderEmail, StatusActive).Scan(&userID)
+		}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tx.QueryRowContext(ctx,
+			"INSERT INTO users (first_name, last_name, email, status) VALUES ($1, $2, NULLIF($3, ''), $4) RETURNING user_id",
+			a.FirstName, a.LastName, a.Email, StatusActive,
+		).Scan(&userID)
+	}
+	if err == nil && a.Email != "" {
+		err = linkIdentity(ctx, tx, userID, ProviderEmail, a.Email)
+	}
+	if err == nil {
+		err = linkIdentity(ctx, tx, userID, a.Provider, a.Subject)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// deletePendingUsersByEmail removes unactivated signups for email along
+// with their codes.
+func deletePendingUsersByEmail(ctx context.Context, tx *sql.Tx, email string) error {
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM verifications
+		WHERE user_id IN (SELECT user_id FROM users WHERE LOWER(email) = LOWER($1) AND status = $2)
+	`, email, StatusPending); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx,
+		"DELETE FROM users WHERE LOWER(email) = LOWER($1) AND status = $2",
+		email, StatusPending,
+	)
+	return err
+}
+
+func (s *Postgres) CreateSession(ctx context.Context, session *Session) error {
+	return s.db.QueryRowContext(ctx, `
+		INSERT INTO user_sessions (id, user_id, user_agent, ip, location, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at, last_seen_at
+	`, session.ID, session.UserID, session.UserAgent, session.IP, session.Location, session.ExpiresAt,
+	).Scan(&session.CreatedAt, &session.LastSeenAt)
+}
+
+func (s *Postgres) GetSession(ctx context.Context, sessionID string) (*Session, error) {
+	session := &Session{ID: sessionID}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT user_id, user_agent, ip, location, created_at, last_seen_at, expires_at, revoked_at IS NOT NULL
+		FROM user_sessions
+		WHERE id = $1
+	`, sessionID).Scan(
+		&session.UserID, &session.UserAgent, &session.IP, &session.Location,
+		&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &session.Revoked,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *Postgres) TouchSession(ctx context.Context, sessionID string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE user_sessions SET last_seen_at = NOW() WHERE id = $1",
+		sessionID,
+	)
+	return err
+}
+
+func (s *Postgres) ListSessions(ctx context.Context, userID int64) ([]Session, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, user_agent, ip, location, created_at, last_seen_at, expires_at
+		FROM user_sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_seen_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		item := Session{UserID: userID}
+		if err := rows.Scan(
+			&item.ID, &item.UserAgent, &item.IP, &item.Location,
+			&item.CreatedAt, &item.LastSeenAt, &item.ExpiresAt,
+		); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, item)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *Postgres) RevokeSession(ctx context.Context, userID int64, sessionID string) error {
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE user_sessions SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		sessionID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *Postgres) RevokeSessions(ctx context.Context, userID int64) (int64, error) {
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE user_sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL",
+		userID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *Postgres) LoginHistory(ctx context.Context, userID int64, userAgent, ip string) (LoginHistory, error) {
+	var h LoginHistory
+	err := s.db.QueryRowContext(ctx, `
+		SELECT
+			EXISTS (SELECT 1 FROM user_sessions WHERE user_id = $1),
+			EXISTS (SELECT 1 FROM user_sessions WHERE user_id = $1 AND user_agent = $2),
+			EXISTS (SELECT 1 FROM user_sessions WHERE user_id = $1 AND ip = $3)
+	`, userID, userAgent, ip).Scan(&h.HasSessions, &h.KnownAgent, &h.KnownIP)
+	return h, err
+}
+
+func (s *Postgres) CreateRevokeLink(ctx context.Context, id string, userID int64, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO session_revoke_links (id, user_id, expires_at) VALUES ($1, $2, $3)",
+		id, userID, expiresAt,
+	)
+	return err
+}
+
+func (s *Postgres) UseRevokeLink(ctx context.Context, id string) (int64, error) {
+	var userID int64
+	err := s.db.QueryRowContext(ctx,
+		"DELETE FROM session_revoke_links WHERE id = $1 AND expires_at > NOW() RETURNING user_id",
+		id,
+	).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return userID, err
+}
+
+func (s *Postgres) PurgeSessions(ctx context.Context, cutoff time.Time) error {
+	if _, err := s.db.ExecContext(ctx,
+		"DELETE FROM user_sessions WHERE expires_at < $1 OR revoked_at < $1",
+		cutoff,
+	); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx,
+		"DELETE FROM session_revoke_links WHERE expires_at < $1",
+		cutoff,
+	)
+	return err
+}
+
+func (s *Postgres) CreateVerification(ctx context.Context, v *Verification) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM verifications WHERE user_id = $1 AND type = $2",
+		v.UserID, v.Type,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO verifications (user_id, email, phone, issue_time, expire_time, type, code, nonce)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, $5, $6, $7, NULLIF($8, ''))
+	`, v.UserID, v.Email, v.Phone, v.IssuedAt, v.ExpiresAt, v.Type, v.CodeHash, v.NonceHash); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// verificationColumn returns the column a VerificationQuery matches on and
+// the value to match.
+func verificationColumn(q VerificationQuery) (string, interface{}) {
+	switch {
+	case q.Email != "":
+		return "LOWER(email)", NormalizeSubject(ProviderEmail, q.Email)
+	case q.Phone != "":
+		return "phone", q.Phone
+	case q.CodeHash != "":
+		return "code", q.CodeHash
+	}
+	return "user_id", q.UserID
+}
+
+func (s *Postgres) FindVerification(ctx context.Context, q VerificationQuery) (*Verification, error) {
+	column, key := verificationColumn(q)
+
+	unexpired := " AND expire_time > NOW()"
+	if q.IncludeExpired {
+		unexpired = ""
+	}
+
+	v := &Verification{Type: q.Type}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT user_id, COALESCE(email, ''), COALESCE(phone, ''), code, COALESCE(nonce, ''), attempts, issue_time, expire_time
+		FROM verifications
+		WHERE `+column+` = $1 AND type = $2`+unexpired+`
+		ORDER BY issue_time DESC
+		LIMIT 1
+	`, key, q.Type).Scan(&v.UserID, &v.Email, &v.Phone, &v.CodeHash, &v.NonceHash, &v.Attempts, &v.IssuedAt, &v.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (s *Postgres) UseAttempt(ctx context.Context, q VerificationQuery, maxAttempts int) (*Verification, error) {
+	column, key := verificationColumn(q)
+
+	// Concurrent guesses queue on the row lock and each sees the attempts
+	// the others spent, so no more than maxAttempts codes get compared
+	v := &Verification{Type: q.Type}
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE verifications
+		SET attempts = attempts + 1
+		WHERE user_id = (
+			SELECT user_id FROM verifications
+			WHERE `+column+` = $1 AND type = $2 AND expire_time > NOW()
+			ORDER BY issue_time DESC
+			LIMIT 1
+		) AND type = $2 AND expire_time > NOW() AND attempts < $3
+		RETURNING user_id, COALESCE(email, ''), COALESCE(phone, ''), code, COALESCE(nonce, ''), attempts, issue_time, expire_time
+	`, key, q.Type, maxAttempts).Scan(&v.UserID, &v.Email, &v.Phone, &v.CodeHash, &v.NonceHash, &v.Attempts, &v.IssuedAt, &v.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (s *Postgres) DeleteVerifications(ctx context.Context, userID int64, verificationTypes ...string) error {
+	_, err := s.db.ExecContext(ctx,
+		"DELETE FROM verifications WHERE user_id = $1 AND type = ANY($2)",
+		userID, pq.Array(verificationTypes),
+	)
+	return err
+}
+
+func (s *Postgres) DeleteVerificationByCode(ctx context.Context, userID int64, verificationType, codeHash string) (bool, error) {
+	result, err := s.db.ExecContext(ctx,
+		"DELETE FROM verifications WHERE user_id = $1 AND code = $2 AND type = $3",
+		userID, codeHash, verificationType,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *Postgres) RecordSend(ctx context.Context, destination string, at time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO verification_sends (destination, sent_at) VALUES ($1, $2)",
+		destination, at,
+	)
+	return err
+}
+
+func (s *Postgres) SendStats(ctx context.Context, destination string, since time.Time) (SendStats, error) {
+	var (
+		stats       SendStats
+		first, last sql.NullTime
+	)
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), MIN(sent_at), MAX(sent_at)
+		FROM verification_sends
+		WHERE destination = $1 AND sent_at > $2
+	`, destination, since).Scan(&stats.Count, &first, &last)
+	stats.First, stats.Last = first.Time, last.Time
+	return stats, err
+}
+
+func (s *Postgres) PurgeSends(ctx context.Context, cutoff time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		"DELETE FROM verification_sends WHERE sent_at < $1",
+		cutoff,
+	)
+	return err
+}
+
+func (s *Postgres) GetBalance(ctx context.Context, userID int64) (float64, error) {
+	var quantity float64
+	err := s.db.QueryRowContext(ctx, "SELECT quantity FROM balance WHERE user_id = $1", userID).Scan(&quantity)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return quantity, err
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		"INSERT INTO balance (user_id, quantity) VALUES ($1, 0) ON CONFLICT (user_id) DO NOTHING",
+		userID,
+	)
+	return 0, err
+}
+
+func (s *Postgres) CreatePromocode(ctx context.Context, p *Promocode) error {
+	quantity := int64(math.Round(p.Quantity))
+
+	if p.StartTime != nil && p.EndTime != nil {
+		_, err := s.db.ExecContext(ctx, `
+			INSERT INTO promocode (name, keyword, start_time, end_time, quantity, created_at)
+			VALUES ($1, $2, $3, $4, $5, NOW())
+		`, p.Name, p.Keyword, *p.StartTime, *p.EndTime, quantity)
+		switch {
+		case err == nil:
+			p.IsActive = p.activeAt(time.Now().UTC())
+			return nil
+		case isUniqueViolation(err):
+			return ErrConflict
+		case !isSchemaMismatch(err):
+			return err
+		}
+		// fall back to the legacy table below
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO promocodes (keyword, quantity, is_active, created_at)
+		VALUES ($1, $2, $3, NOW())
+	`, p.Keyword, quantity, p.IsActive)
+	if isSchemaMismatch(err) {
+		_, err = s.db.ExecContext(ctx,
+			"INSERT INTO promocodes (keyword, quantity, is_active) VALUES ($1, $2, $3)",
+			p.Keyword, quantity, p.IsActive,
+		)
+	}
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *Postgres) FindPromocode(ctx context.Context, keyword string) (*Promocode, error) {
+	p := &Promocode{Keyword: keyword}
+
+	var (
+		quantity interface{}
+		start    sql.NullTime
+		end      sql.NullTime
+	)
+	err := s.db.QueryRowContext(ctx,
+		"SELECT id, name, quantity, start_time, end_time FROM promocode WHERE keyword = $1",
+		keyword,
+	).Scan(&p.ID, &p.Name, &quantity, &start, &end)
+	switch {
+	case err == nil:
+		if p.Quantity, err = normalizeQuantity(quantity); err != nil {
+			return nil, err
+		}
+		if start.Valid {
+			p.StartTime = &start.Time
+		}
+		if end.Valid {
+			p.EndTime = &end.Time
+		}
+		p.IsActive = p.activeAt(time.Now().UTC())
+		return p, nil
+	case errors.Is(err, sql.ErrNoRows), isSchemaMismatch(err):
+		// try the legacy table below
+	default:
+		return nil, err
+	}
+
+	err = s.db.QueryRowContext(ctx,
+		"SELECT promocode_id, quantity, is_active FROM promocodes WHERE keyword = $1",
+		keyword,
+	).Scan(&p.ID, &p.Quantity, &p.IsActive)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "42703":
+			err = s.db.QueryRowContext(ctx,
+				"SELECT id, quantity, active FROM promocodes WHERE keyword = $1",
+				keyword,
+			).Scan(&p.ID, &p.Quantity, &p.IsActive)
+		case "42P01":
+			return nil, fmt.Errorf("promocodes table not found")
+		}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *Postgres) ActivatePromocode(ctx context.Context, p *Promocode, userID int64) (float64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var existing int
+	err = tx.QueryRowContext(ctx,
+		"SELECT 1 FROM promocode_activation WHERE promocode_id = $1 AND user_id = $2",
+		p.ID, userID,
+	).Scan(&existing)
+	if isSchemaMismatch(err) {
+		err = tx.QueryRowContext(ctx,
+			"SELECT 1 FROM promocode_activations WHERE promocode_id = $1 AND user_id = $2",
+			p.ID, userID,
+		).Scan(&existing)
+	}
+	switch {
+	case err == nil:
+		return 0, ErrAlreadyActivated
+	case !errors.Is(err, sql.ErrNoRows):
+		return 0, fmt.Errorf("failed to check promocode activation: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO balance (user_id, quantity) VALUES ($1, 0) ON CONFLICT (user_id) DO NOTHING",
+		userID,
+	); err != nil {
+		return 0, fmt.Errorf("failed to prepare balance record: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE balance SET quantity = quantity + $1 WHERE user_id = $2",
+		p.Quantity, userID,
+	); err != nil {
+		return 0, fmt.Errorf("failed to update balance: %w", err)
+	}
+
+	now := time.Now().UTC()
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO promocode_activation (promocode_id, user_id, enable_time, quantity)
+		VALUES ($1, $2, $3, $4)
+	`, p.ID, userID, now, int64(math.Round(p.Quantity)))
+	if isSchemaMismatch(err) {
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO promocode_activations (promocode_id, user_id, activated_at) VALUES ($1, $2, $3)",
+			p.ID, userID, now,
+		)
+	}
+	if isUniqueViolation(err) {
+		return 0, ErrAlreadyActivated
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to record promocode activation: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	var balance float64
+	if err := s.db.QueryRowContext(ctx,
+		"SELECT quantity FROM balance WHERE user_id = $1",
+		userID,
+	).Scan(&balance); err != nil {
+		return 0, fmt.Errorf("failed to fetch updated balance: %w", err)
+	}
+	return balance, nil
+}
+
+func (s *Postgres) ListPromocodeActivations(ctx context.Context, userID int64) ([]PromocodeActivation, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT pa.promocode_id,
+		       p.keyword,
+		       p.quantity,
+		       pa.enable_time,
+		       p.start_time,
+		       p.end_time
+		FROM promocode_activation pa
+		JOIN promocode p ON p.id = pa.promocode_id
+		WHERE pa.user_id = $1
+		ORDER BY pa.enable_time DESC
+	`, userID)
+	if isSchemaMismatch(err) {
+		return s.listLegacyPromocodeActivations(ctx, userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []PromocodeActivation{}
+	for rows.Next() {
+		var (
+			item      PromocodeActivation
+			quantity  interface{}
+			activated sql.NullTime
+			start     sql.NullTime
+			end       sql.NullTime
+		)
+		if err := rows.Scan(&item.PromocodeID, &item.Keyword, &quantity, &activated, &start, &end); err != nil {
+			return nil, err
+		}
+
+		if item.Quantity, err = normalizeQuantity(quantity); err != nil {
+			return nil, err
+		}
+		if activated.Valid {
+			item.ActivatedAt = &activated.Time
+		}
+		if start.Valid {
+			item.StartTime = &start.Time
+		}
+		if end.Valid {
+			item.EndTime = &end.Time
+		}
+
+		results = append(results, item)
+	}
+
+	return results, rows.Err()
+}
+
+func (s *Postgres) listLegacyPromocodeActivations(ctx context.Context, userID int64) ([]PromocodeActivation, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT pa.promocode_id, p.keyword, p.quantity, pa.activated_at
+		FROM promocode_activations pa
+		JOIN promocodes p ON p.promocode_id = pa.promocode_id
+		WHERE pa.user_id = $1
+		ORDER BY pa.activated_at DESC
+	`, userID)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "42703" {
+		rows, err = s.db.QueryContext(ctx, `
+			SELECT pa.promocode_id, p.keyword, p.quantity, pa.activated_at
+			FROM promocode_activations pa
+			JOIN promocodes p ON p.id = pa.promocode_id
+			WHERE pa.user_id = $1
+			ORDER BY pa.activated_at DESC
+		`, userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []PromocodeActivation{}
+	for rows.Next() {
+		var (
+			item      PromocodeActivation
+			quantity  interface{}
+			activated sql.NullTime
+		)
+		if err := rows.Scan(&item.PromocodeID, &item.Keyword, &quantity, &activated); err != nil {
+			return nil, err
+		}
+
+		if item.Quantity, err = normalizeQuantity(quantity); err != nil {
+			return nil, err
+		}
+		if activated.Valid {
+			item.ActivatedAt = &activated.Time
+		}
+
+		results = append(results, item)
+	}
+
+	return results, rows.Err()
+}
+
+// normalizeQuantity converts a quantity column, which is numeric in some
+// deployments and integer in others, to a float.
+func normalizeQuantity(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, fmt.Errorf("quantity value is nil")
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case []byte:
+		return strconv.ParseFloat(string(v), 64)
+	case string:
+		return strconv.ParseFloat(v, 64)
+	default:
+		return 0, fmt.Errorf("unsupported quantity type %T", value)
+	}
+}
+
+// lockDelaySQL is LockoutPolicy.Delay for the attempt count n, with $3 the
+// threshold and $4 and $5 the base and maximum delay in seconds.
+func lockDelaySQL(n string) string {
+	return `make_interval(secs => CASE
+		WHEN ` + n + ` - $3::int > 10 THEN $5::float8
+		ELSE LEAST($5::float8, $4::float8 * POWER(2, ` + n + ` - $3::int))
+	END)`
+}
+
+// takeAttemptQuery leaves a locked row alone and otherwise counts the
+// attempt and sets or clears the lock to match the new count. A row counts
+// the attempt exactly when it gets a fresh updated_at.
+var takeAttemptQuery = `
+	INSERT INTO auth_lockouts AS l (key, failures, locked_until, updated_at)
+	VALUES ($1, 1, CASE WHEN 1 >= $3::int THEN NOW() + ` + lockDelaySQL("1") + ` END, NOW())
+	ON CONFLICT (key) DO UPDATE SET
+		failures = CASE
+			WHEN l.locked_until > NOW() THEN l.failures
+			WHEN l.updated_at < $2 THEN 1
+			ELSE l.failures + 1
+		END,
+		locked_until = CASE
+			WHEN l.locked_until > NOW() THEN l.locked_until
+			WHEN l.updated_at < $2 THEN CASE WHEN 1 >= $3::int THEN NOW() + ` + lockDelaySQL("1") + ` END
+			WHEN l.failures + 1 >= $3::int THEN NOW() + ` + lockDelaySQL("(l.failures + 1)") + `
+		END,
+		updated_at = CASE WHEN l.locked_until > NOW() THEN l.updated_at ELSE NOW() END
+	RETURNING failures, locked_until, updated_at = NOW()
+`
+
+func (s *Postgres) TakeAttempt(ctx context.Context, key string, p LockoutPolicy) (Attempt, error) {
+	var a Attempt
+	var lockedUntil sql.NullTime
+	err := s.db.QueryRowContext(ctx, takeAttemptQuery,
+		key, time.Now().Add(-p.Window), p.Threshold, p.BaseDelay.Seconds(), p.MaxDelay.Seconds(),
+	).Scan(&a.Attempts, &lockedUntil, &a.Counted)
+	a.LockedUntil = lockedUntil.Time
+	return a, err
+}
+
+func (s *Postgres) ReturnAttempt(ctx context.Context, key string, p LockoutPolicy) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE auth_lockouts SET
+			failures = GREATEST(failures - 1, 0),
+			locked_until = CASE WHEN failures - 1 >= $2 THEN locked_until END
+		WHERE key = $1
+	`, key, p.Threshold)
+	return err
+}
+
+func (s *Postgres) ClearLockout(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM auth_lockouts WHERE key = $1", key)
+	return err
+}
+
+func (s *Postgres) PurgeLockouts(ctx context.Context, cutoff time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		"DELETE FROM auth_lockouts WHERE updated_at < $1 AND (locked_until IS NULL OR locked_until < NOW())",
+		cutoff,
+	)
+	return err
+}
+
+func (s *Postgres) GetTOTP(ctx context.Context, userID int64) (*TOTP, error) {
+	t := &TOTP{}
+	err := s.db.QueryRowContext(ctx,
+		"SELECT secret, enabled_at IS NOT NULL, last_used_step FROM user_totp WHERE user_id = $1",
+		userID,
+	).Scan(&t.Secret, &t.Enabled, &t.LastUsedStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *Postgres) SaveTOTPSecret(ctx context.Context, userID int64, secret string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO user_totp (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, enabled_at = NULL, last_used_step = 0, created_at = NOW()
+	`, userID, secret)
+	return err
+}
+
+func (s *Postgres) EnableTOTP(ctx context.Context, userID, step int64, recoveryCodeHashes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var enabled bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT enabled_at IS NOT NULL FROM user_totp WHERE user_id = $1 FOR UPDATE",
+		userID,
+	).Scan(&enabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if enabled {
+		return ErrConflict
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE user_totp SET enabled_at = NOW(), last_used_step = $1 WHERE user_id = $2",
+		step, userID,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userID, hash,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *Postgres) UseTOTPStep(ctx context.Context, userID, step int64) (bool, error) {
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE user_totp SET last_used_step = $1 WHERE user_id = $2 AND enabled_at IS NOT NULL AND last_used_step < $1",
+		step, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *Postgres) UseRecoveryCode(ctx context.Context, userID int64, codeHash string) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE user_recovery_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+		  AND EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL)
+	`, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *Postgres) CountRecoveryCodes(ctx context.Context, userID int64) (int, error) {
+	var remaining int
+	err := s.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = $1 AND used_at IS NULL",
+		userID,
+	).Scan(&remaining)
+	return remaining, err
+}
+
+func (s *Postgres) DeleteTwoFactor(ctx context.Context, userID int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_totp WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,441 @@
+// Package store separates data access from the HTTP handlers. Each
+// interface covers one area of the schema; Postgres implements all of them
+// against the database and Memory implements them in process, for running
+// handlers without a database.
+package store
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when the requested row doesn't exist.
+	ErrNotFound = errors.New("store: not found")
+	// ErrConflict is returned when a unique value, such as a promocode
+	// keyword or an email address, is already taken.
+	ErrConflict = errors.New("store: already exists")
+	// ErrAlreadyActivated is returned when a user activates a promocode a
+	// second time.
+	ErrAlreadyActivated = errors.New("store: promocode already activated")
+	// ErrLastIdentity is returned when unlinking the only identity a user
+	// can sign in with.
+	ErrLastIdentity = errors.New("store: last identity")
+)
+
+// Values of User.Status. A user stays pending until their first code is
+// confirmed.
+const (
+	StatusPending = "pending"
+	StatusActive  = "active"
+)
+
+// Values of Identity.Provider. Subjects are the lowercased email, the E.164
+// phone number, the Google account id and the Telegram user id.
+const (
+	ProviderEmail    = "email"
+	ProviderPhone    = "phone"
+	ProviderGoogle   = "google"
+	ProviderTelegram = "telegram"
+)
+
+type User struct {
+	ID          int64
+	Email       string
+	Phone       string
+	FirstName   string
+	LastName    string
+	DateOfBirth *time.Time
+	Locale      string
+	Status      string
+	// CreatedAt is nil for accounts made before signup dates were recorded
+	CreatedAt *time.Time
+	Deleted   bool
+}
+
+// Signup is a registration waiting for its code. ID is the pending user it
+// refreshes, or zero to create one; exactly one of Email and Phone is set.
+type Signup struct {
+	ID          int64
+	FirstName   string
+	LastName    string
+	DateOfBirth time.Time
+	Email       string
+	Phone       string
+}
+
+// ProfileUpdate changes the fields that aren't nil.
+type ProfileUpdate struct {
+	FirstName   *string
+	LastName    *string
+	DateOfBirth *time.Time
+	Locale      *string
+}
+
+// Identity is a verified way of signing in to an account.
+type Identity struct {
+	ID         int64
+	UserID     int64
+	Provider   string
+	Subject    string
+	VerifiedAt *time.Time
+	CreatedAt  time.Time
+}
+
+// ExternalAccount is a Google or Telegram account as reported at sign-in.
+// Email is only set when the provider has verified it.
+type ExternalAccount struct {
+	Provider  string
+	Subject   string
+	Email     string
+	FirstName string
+	LastName  string
+}
+
+type Session struct {
+	ID         string
+	UserID     int64
+	UserAgent  string
+	IP         string
+	Location   string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	Revoked    bool
+}
+
+// LoginHistory tells whether a user has signed in before, and whether from
+// a given browser and IP.
+type LoginHistory struct {
+	HasSessions bool
+	KnownAgent  bool
+	KnownIP     bool
+}
+
+// Verification is an issued one-time code, sent to Email or Phone. Only
+// hashes of the code and of a magic link's nonce are kept.
+type Verification struct {
+	UserID    int64
+	Email     string
+	Phone     string
+	Type      string
+	CodeHash  string
+	NonceHash string
+	Attempts  int
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// VerificationQuery selects the latest unexpired verification of Type
+// issued to UserID, Email or Phone, or with CodeHash; exactly one of them
+// should be set. Email matches regardless of case. IncludeExpired drops the
+// expiry check.
+type VerificationQuery struct {
+	Type           string
+	UserID         int64
+	Email          string
+	Phone          string
+	CodeHash       string
+	IncludeExpired bool
+}
+
+// LockoutPolicy says when attempts lock a key: Threshold of them within
+// Window lock it for BaseDelay, doubling with every attempt after that up
+// to MaxDelay.
+type LockoutPolicy struct {
+	Threshold int
+	Window    time.Duration
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// Delay is how long the key stays locked after its attempts-th attempt.
+func (p LockoutPolicy) Delay(attempts int) time.Duration {
+	exponent := attempts - p.Threshold
+	if exponent > 10 {
+		return p.MaxDelay
+	}
+	delay := time.Duration(float64(p.BaseDelay) * math.Pow(2, float64(exponent)))
+	if delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// Attempt is the outcome of LockoutStore.TakeAttempt.
+type Attempt struct {
+	// Counted is false when the key was locked and the attempt refused
+	Counted bool
+	// Attempts is how many attempts the key has used in its window
+	Attempts    int
+	LockedUntil time.Time
+}
+
+// SendStats summarizes the codes sent to one email or phone number. First
+// and Last are zero when Count is.
+type SendStats struct {
+	Count int
+	First time.Time
+	Last  time.Time
+}
+
+// TOTP is a user's authenticator enrollment. Secret is stored as the
+// handlers encrypted it.
+type TOTP struct {
+	Secret       string
+	Enabled      bool
+	LastUsedStep int64
+}
+
+type Promocode struct {
+	ID        int64
+	Name      string
+	Keyword   string
+	Quantity  float64
+	IsActive  bool
+	StartTime *time.Time
+	EndTime   *time.Time
+}
+
+type PromocodeActivation struct {
+	PromocodeID int64
+	Keyword     string
+	Quantity    float64
+	ActivatedAt *time.Time
+	StartTime   *time.Time
+	EndTime     *time.Time
+}
+
+// UserStore reads and changes accounts and the identities they sign in
+// with. Linking an email or phone identity also makes it the user's
+// primary one when they have none.
+type UserStore interface {
+	// GetUser returns the user whether or not the account was deleted, or
+	// ErrNotFound.
+	GetUser(ctx context.Context, userID int64) (*User, error)
+	IsAdmin(ctx context.Context, userID int64) (bool, error)
+	// FindUserByEmail and FindUserByPhone return the pending or active user
+	// with that primary email, in any case, or phone, or ErrNotFound.
+	FindUserByEmail(ctx context.Context, email string) (*User, error)
+	FindUserByPhone(ctx context.Context, phone string) (*User, error)
+	// SaveSignup creates the pending user for s, or refreshes the one with
+	// s.ID, and returns its id. It returns ErrConflict when another user has
+	// the email or phone.
+	SaveSignup(ctx context.Context, s Signup) (int64, error)
+	// ActivateUser marks the user active, links the identity their code
+	// was sent to and deletes their verifications of verificationType, all
+	// or nothing, so the code can't be redeemed again. It returns
+	// ErrConflict when another user has the identity.
+	ActivateUser(ctx context.Context, userID int64, provider, subject, verificationType string) error
+	// UpdateProfile returns ErrNotFound when there is no such user.
+	UpdateProfile(ctx context.Context, userID int64, u ProfileUpdate) error
+	// ChangeEmail makes email the user's primary address and email
+	// identity in place of the old one, which it returns, and deletes the
+	// user's verification of verificationType with codeHash, all or
+	// nothing, so the code can't change the email again. A pending signup
+	// for email is dropped rather than left to block the change. It returns
+	// ErrNotFound when that verification has already been spent and
+	// ErrConflict when another user has the address.
+	ChangeEmail(ctx context.Context, userID int64, email, verificationType, codeHash string) (string, error)
+	// DeleteUser anonymizes the user instead of removing them, so balance
+	// and promocode activation rows stay intact for accounting, and removes
+	// their identities, sessions, two-factor settings and codes along with
+	// the send history and lockouts kept for their email addresses and
+	// phone numbers.
+	DeleteUser(ctx context.Context, userID int64) error
+	// PurgePendingUsers deletes signups created before cutoff that were
+	// never verified, along with their codes, and returns how many.
+	PurgePendingUsers(ctx context.Context, cutoff time.Time) (int64, error)
+
+	// FindUserByIdentity returns the active, non-deleted user with the
+	// identity, or ErrNotFound.
+	FindUserByIdentity(ctx context.Context, provider, subject string) (int64, error)
+	// IsIdentityTaken reports whether a user other than userID, pending
+	// ones included, has the identity.
+	IsIdentityTaken(ctx context.Context, provider, subject string, userID int64) (bool, error)
+	// IsEmailTaken reports whether an active user other than userID has
+	// email as their primary address or as an identity. An unverified
+	// signup doesn't hold the address against its owner.
+	IsEmailTaken(ctx context.Context, email string, userID int64) (bool, error)
+	// ListIdentities returns the user's identities, oldest first.
+	ListIdentities(ctx context.Context, userID int64) ([]Identity, error)
+	// LinkIdentity records a verified identity for the user; linking one
+	// they already have refreshes it. It returns ErrConflict when another
+	// user has it.
+	LinkIdentity(ctx context.Context, userID int64, provider, subject string) error
+	// UnlinkIdentity removes one of the user's identities, falling back to
+	// another of the same kind for their primary email or phone. It
+	// returns ErrNotFound or, for their only identity, ErrLastIdentity.
+	UnlinkIdentity(ctx context.Context, userID, identityID int64) error
+	// FindOrCreateExternalUser returns the user signed in by a, matching
+	// them by the external account first, then the active user with its
+	// email, and creating them otherwise. Pending signups for the email
+	// are deleted, not adopted.
+	FindOrCreateExternalUser(ctx context.Context, a ExternalAccount) (int64, error)
+}
+
+// SessionStore records the devices users are signed in on.
+type SessionStore interface {
+	// CreateSession stores s as created and last used now.
+	CreateSession(ctx context.Context, s *Session) error
+	// GetSession returns the session, or ErrNotFound.
+	GetSession(ctx context.Context, sessionID string) (*Session, error)
+	// TouchSession marks the session as used now.
+	TouchSession(ctx context.Context, sessionID string) error
+	// ListSessions returns the user's sessions that are neither revoked
+	// nor expired, most recently used first.
+	ListSessions(ctx context.Context, userID int64) ([]Session, error)
+	// RevokeSession ends one of the user's sessions, or returns
+	// ErrNotFound when they have no such session still active.
+	RevokeSession(ctx context.Context, userID int64, sessionID string) error
+	// RevokeSessions ends all of the user's sessions and returns how many
+	// were active.
+	RevokeSessions(ctx context.Context, userID int64) (int64, error)
+	// LoginHistory checks the user's sessions, ended ones included, for
+	// userAgent and ip.
+	LoginHistory(ctx context.Context, userID int64, userAgent, ip string) (LoginHistory, error)
+	// CreateRevokeLink records the id of a "this wasn't me" link that logs
+	// the user out everywhere until expiresAt.
+	CreateRevokeLink(ctx context.Context, id string, userID int64, expiresAt time.Time) error
+	// UseRevokeLink deletes the link if it hasn't expired and returns its
+	// user, or ErrNotFound, so each link works once.
+	UseRevokeLink(ctx context.Context, id string) (int64, error)
+	// PurgeSessions deletes sessions that expired or were revoked before
+	// cutoff, and revoke links that expired before it.
+	PurgeSessions(ctx context.Context, cutoff time.Time) error
+}
+
+// VerificationStore issues and expires one-time codes and keeps the history
+// of codes sent, which resend limits are checked against.
+type VerificationStore interface {
+	// CreateVerification replaces the user's verification of v.Type with
+	// v.
+	CreateVerification(ctx context.Context, v *Verification) error
+	// FindVerification returns the latest match for q, or ErrNotFound.
+	FindVerification(ctx context.Context, q VerificationQuery) (*Verification, error)
+	// UseAttempt spends one of the attempts of the latest unexpired match
+	// for q and returns it, or ErrNotFound when there is none with attempts
+	// left. Checking and spending happen at once, so concurrent guesses
+	// can't get past maxAttempts. IncludeExpired is ignored.
+	UseAttempt(ctx context.Context, q VerificationQuery, maxAttempts int) (*Verification, error)
+	// DeleteVerifications deletes the user's verifications of the given
+	// types.
+	DeleteVerifications(ctx context.Context, userID int64, verificationTypes ...string) error
+	// DeleteVerificationByCode deletes the user's verification of the
+	// given type with codeHash and reports whether there was one, so of two
+	// requests racing to use a single-use code only one sees true. Short
+	// codes repeat across users, so the match is limited to userID.
+	DeleteVerificationByCode(ctx context.Context, userID int64, verificationType, codeHash string) (bool, error)
+	// RecordSend counts a code sent to destination, an email or phone
+	// number, at time at.
+	RecordSend(ctx context.Context, destination string, at time.Time) error
+	// SendStats summarizes the codes sent to destination after since.
+	SendStats(ctx context.Context, destination string, since time.Time) (SendStats, error)
+	// PurgeSends forgets codes sent before cutoff.
+	PurgeSends(ctx context.Context, cutoff time.Time) error
+}
+
+// LockoutStore counts failed code checks per key, such as an email or a
+// client IP, and locks keys that fail too often.
+type LockoutStore interface {
+	// TakeAttempt counts an attempt against the key unless it is locked,
+	// starting over when the last one is older than p.Window, and locks
+	// the key for p.Delay once the count reaches p.Threshold. It is a
+	// single step, so a burst of concurrent attempts can't all get in
+	// before the lock is set.
+	TakeAttempt(ctx context.Context, key string, p LockoutPolicy) (Attempt, error)
+	// ReturnAttempt takes back an attempt that turned out not to be a
+	// failure, lifting the lock if the count drops below p.Threshold.
+	ReturnAttempt(ctx context.Context, key string, p LockoutPolicy) error
+	// ClearLockout forgets the key's failures and lock.
+	ClearLockout(ctx context.Context, key string) error
+	// PurgeLockouts deletes keys last failed before cutoff whose lock has
+	// run out.
+	PurgeLockouts(ctx context.Context, cutoff time.Time) error
+}
+
+// TwoFactorStore holds authenticator secrets and recovery codes. Recovery
+// codes are stored as hashes.
+type TwoFactorStore interface {
+	// GetTOTP returns the user's enrollment, or ErrNotFound.
+	GetTOTP(ctx context.Context, userID int64) (*TOTP, error)
+	// SaveTOTPSecret starts an enrollment, replacing any earlier one.
+	SaveTOTPSecret(ctx context.Context, userID int64, secret string) error
+	// EnableTOTP confirms the enrollment with a code for step and replaces
+	// the user's recovery codes. It returns ErrNotFound when there is no
+	// enrollment and ErrConflict when it is already enabled.
+	EnableTOTP(ctx context.Context, userID, step int64, recoveryCodeHashes []string) error
+	// UseTOTPStep records that a code for step was used, reporting false
+	// when two-factor is off or a code for that step or a later one was
+	// used already, so codes can't be replayed.
+	UseTOTPStep(ctx context.Context, userID, step int64) (bool, error)
+	// UseRecoveryCode spends the user's unused recovery code with
+	// codeHash, reporting false when two-factor is off or there is none.
+	UseRecoveryCode(ctx context.Context, userID int64, codeHash string) (bool, error)
+	// CountRecoveryCodes returns how many recovery codes the user has left.
+	CountRecoveryCodes(ctx context.Context, userID int64) (int, error)
+	// DeleteTwoFactor removes the user's enrollment and recovery codes.
+	DeleteTwoFactor(ctx context.Context, userID int64) error
+}
+
+// BalanceStore reads users' balances.
+type BalanceStore interface {
+	// GetBalance returns the user's balance, creating an empty one if the
+	// user has none yet.
+	GetBalance(ctx context.Context, userID int64) (float64, error)
+}
+
+// PromocodeStore creates promocodes and credits them to balances.
+type PromocodeStore interface {
+	// CreatePromocode stores p and sets IsActive. It returns
+	// ErrConflict when the keyword is taken.
+	CreatePromocode(ctx context.Context, p *Promocode) error
+	// FindPromocode returns the promocode with keyword, or ErrNotFound.
+	FindPromocode(ctx context.Context, keyword string) (*Promocode, error)
+	// ActivatePromocode credits p to the user's balance once and returns the
+	// new balance. It returns ErrAlreadyActivated on a repeat activation.
+	ActivatePromocode(ctx context.Context, p *Promocode, userID int64) (float64, error)
+	// ListPromocodeActivations returns the user's activations, newest
+	// first.
+	ListPromocodeActivations(ctx context.Context, userID int64) ([]PromocodeActivation, error)
+}
+
+// NormalizeSubject returns the form identities are stored in: trimmed,
+// and lowercased for emails.
+func NormalizeSubject(provider, subject string) string {
+	subject = strings.TrimSpace(subject)
+	if provider == ProviderEmail {
+		return strings.ToLower(subject)
+	}
+	return subject
+}
+
+// LockoutKey names the lockout counting failed codes for an email address
+// or phone number, e.g. "email:user@example.com".
+func LockoutKey(provider, subject string) string {
+	return provider + ":" + NormalizeSubject(provider, subject)
+}
+
+// contactProvider tells whether contact is an email address or a phone
+// number.
+func contactProvider(contact string) string {
+	if strings.Contains(contact, "@") {
+		return ProviderEmail
+	}
+	return ProviderPhone
+}
+
+// activeAt reports whether now falls within the promocode's validity
+// window.
+func (p *Promocode) activeAt(now time.Time) bool {
+	if p.StartTime != nil && now.Before(*p.StartTime) {
+		return false
+	}
+	if p.EndTime != nil && now.After(*p.EndTime) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,155 @@
+// Package tracing sets up OpenTelemetry traces: the exporter, the sampler,
+// W3C trace context propagation and a span for every HTTP request.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"speak/config"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HeaderTraceID carries the request's trace ID in every response, so a
+// client report can be matched to its trace and log lines.
+const HeaderTraceID = "X-Trace-ID"
+
+// Tracer starts the service's own spans. It goes through the global
+// provider, so spans started before Setup are simply not recorded.
+var Tracer = otel.Tracer("speak")
+
+// Setup installs the tracer provider and propagator configured by cfg as
+// the OpenTelemetry globals. The returned function flushes buffered spans
+// and must be called before the process exits.
+func Setup(ctx context.Context, cfg config.Tracing) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(cfg.ServiceName),
+		)),
+		sdktrace.WithSampler(sdktrace.ParentBased(
+			sdktrace.TraceIDRatioBased(float64(cfg.SamplePercent)/100),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Middleware starts a server span for each request, continuing the trace
+// of an incoming traceparent header, and makes it the parent of everything
+// the handlers do through c.UserContext(). The span is named after the
+// route pattern once the router has matched one.
+func Middleware(c *fiber.Ctx) error {
+	ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), headerCarrier{c})
+	ctx, span := Tracer.Start(ctx, c.Method(),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(c.Method()),
+			semconv.URLPath(c.Path()),
+			semconv.ClientAddress(c.IP()),
+		),
+	)
+	defer span.End()
+
+	c.SetUserContext(ctx)
+	if sc := span.SpanContext(); sc.HasTraceID() {
+		c.Set(HeaderTraceID, sc.TraceID().String())
+	}
+
+	err := c.Next()
+
+	status := c.Response().StatusCode()
+	var sc statusCoder
+	var fe *fiber.Error
+	switch {
+	case errors.As(err, &sc):
+		status = sc.StatusCode()
+	case errors.As(err, &fe):
+		status = fe.Code
+	case err != nil:
+		status = fiber.StatusInternalServerError
+	}
+
+	// The router reports a request no route matched with 404 or 405
+	if fe == nil || (fe.Code != fiber.StatusNotFound && fe.Code != fiber.StatusMethodNotAllowed) {
+		route := c.Route().Path
+		span.SetName(c.Method() + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route))
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	if status >= fiber.StatusInternalServerError {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.SetStatus(codes.Error, "")
+	}
+
+	return err
+}
+
+// statusCoder is implemented by errors that carry the status they are
+// rendered with, such as handlers.APIError.
+type statusCoder interface {
+	StatusCode() int
+}
+
+// headerCarrier exposes the request headers to the propagator.
+type headerCarrier struct {
+	c *fiber.Ctx
+}
+
+func (h headerCarrier) Get(key string) string {
+	return h.c.Get(key)
+}
+
+func (h headerCarrier) Set(key, value string) {
+	h.c.Request().Header.Set(key, value)
+}
+
+func (h headerCarrier) Keys() []string {
+	headers := h.c.GetReqHeaders()
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	return keys
+}